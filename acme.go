@@ -0,0 +1,177 @@
+package stdhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+	"github.com/alrusov/panic"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// ACMEConfig -- automatic certificate provisioning (Let's Encrypt or any other RFC 8555 server)
+	ACMEConfig struct {
+		Enabled       bool            `toml:"enabled"`
+		Domains       []string        `toml:"domains"`        // allowed host names
+		Email         string          `toml:"email"`          // contact email for the account
+		CacheDir      string          `toml:"cache-dir"`      // certificates and account key storage
+		DirectoryURL  string          `toml:"directory-url"`  // empty -- Let's Encrypt production
+		CARootFile    string          `toml:"ca-root-file"`   // PEM with additional roots for the ACME server itself (Pebble etc.)
+		RenewBefore   config.Duration `toml:"renew-before"`   // 0 -- 30 days
+		ChallengeAddr string          `toml:"challenge-addr"` // additional plain HTTP listener for HTTP-01 challenges (usually ":80"), other requests are redirected to https
+	}
+)
+
+const (
+	acmeChallengePrefix = "/.well-known/acme-challenge/"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetACME -- enable automatic certificate provisioning. Must be called before Start
+func (h *HTTP) SetACME(cfg *ACMEConfig) (err error) {
+	if cfg == nil || !cfg.Enabled {
+		h.acme = nil
+		return
+	}
+
+	if len(cfg.Domains) == 0 {
+		return fmt.Errorf("acme: domains list is empty")
+	}
+
+	if cfg.CacheDir == "" {
+		return fmt.Errorf("acme: cache-dir is not defined")
+	}
+
+	cacheDir, err := misc.AbsPath(cfg.CacheDir)
+	if err != nil {
+		return
+	}
+
+	client := &acme.Client{
+		DirectoryURL: cfg.DirectoryURL,
+	}
+
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	if cfg.CARootFile != "" {
+		var pem []byte
+		pem, err = os.ReadFile(cfg.CARootFile)
+		if err != nil {
+			return
+		}
+
+		pool, e := x509.SystemCertPool()
+		if e != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf(`acme: no certificates found in "%s"`, cfg.CARootFile)
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: pool,
+				},
+			},
+		}
+	}
+
+	h.acme = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cacheDir),
+		HostPolicy:  autocert.HostWhitelist(cfg.Domains...),
+		RenewBefore: cfg.RenewBefore.D(),
+		Client:      client,
+		Email:       cfg.Email,
+	}
+	h.acmeCfg = cfg
+
+	h.AddEndpointsInfo(misc.StringMap{
+		strings.TrimRight(acmeChallengePrefix, "/"): "ACME HTTP-01 challenges",
+	})
+
+	Log.Message(log.INFO, `ACME enabled for %v (%s)`, cfg.Domains, client.DirectoryURL)
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) startACME() {
+	h.srv.TLSConfig = h.acme.TLSConfig()
+
+	if h.acmeCfg.ChallengeAddr == "" {
+		return
+	}
+
+	srv := &http.Server{
+		Addr:              h.acmeCfg.ChallengeAddr,
+		Handler:           h.acmeChallengeHandler(),
+		ReadHeaderTimeout: h.listenerCfg.Timeout.D(),
+	}
+	h.acmeSrv = srv
+
+	go func() {
+		panicID := panic.ID()
+		defer panic.SaveStackToLogEx(panicID)
+
+		Log.Message(log.INFO, `ACME challenge listener created on "%s"`, srv.Addr)
+
+		err := srv.ListenAndServe()
+		if err != nil && misc.AppStarted() {
+			Log.Message(log.ERR, `ACME challenge listener: %s`, err)
+		}
+	}()
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// acmeChallengeHandler -- the challenges go through the listener (stats, logs, the embedded path table), the rest is redirected to https
+func (h *HTTP) acmeChallengeHandler() http.Handler {
+	redirect := h.acme.HTTPHandler(nil)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePrefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		redirect.ServeHTTP(w, r)
+	})
+}
+
+// isACMEChallenge -- the challenges are always available without authentication
+func (h *HTTP) isACMEChallenge(path string) bool {
+	return h.acme != nil && strings.HasPrefix(path, acmeChallengePrefix)
+}
+
+func (h *HTTP) acmeChallenge(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) bool {
+	if !h.isACMEChallenge(path) {
+		return false
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+
+	Log.Message(log.DEBUG, `[%d] ACME challenge "%s"`, id, path)
+
+	h.acme.HTTPHandler(http.NotFoundHandler()).ServeHTTP(w, r2)
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
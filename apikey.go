@@ -0,0 +1,212 @@
+package stdhttp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alrusov/auth"
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// APIKeyAuthConfig --
+	APIKeyAuthConfig struct {
+		Enabled    bool                     `toml:"enabled"`
+		Score      int                      `toml:"score"`
+		Header     string                   `toml:"header"`      // empty -- X-API-Key, "-" -- don't use
+		QueryParam string                   `toml:"query-param"` // empty -- api_key, "-" -- don't use
+		Salt       string                   `toml:"salt"`        // hash = /tools/sha?p=<key>&salt=<salt>
+		Clients    map[string]*APIKeyClient `toml:"clients"`     // by client name (used as the user name)
+	}
+
+	// APIKeyClient --
+	APIKeyClient struct {
+		Groups []string  `toml:"groups"`
+		Keys   []*APIKey `toml:"keys"` // several active keys for the rotation
+	}
+
+	// APIKey --
+	APIKey struct {
+		Name        string    `toml:"name"`
+		Hash        string    `toml:"hash"`
+		Expires     time.Time `toml:"expires"` // zero -- never
+		Permissions []string  `toml:"permissions"`
+	}
+
+	// APIKeyInfo -- stored in the auth.Identity.Extra
+	APIKeyInfo struct {
+		Name        string       `json:"name"`
+		Expires     time.Time    `json:"expires"`
+		Permissions misc.BoolMap `json:"permissions"`
+	}
+
+	// APIKeyAuthHandler -- auth.Handler implementation
+	APIKeyAuthHandler struct {
+		mutex sync.RWMutex
+		cfg   *APIKeyAuthConfig
+		keys  map[string]*apiKeyEntry // by hash
+	}
+
+	apiKeyEntry struct {
+		client string
+		groups []string
+		key    *APIKey
+		info   *APIKeyInfo
+	}
+)
+
+const (
+	APIKeyAuthMethod   = "apikey"
+	APIKeyIdentityType = "APIKey"
+
+	defaultAPIKeyHeader     = "X-API-Key"
+	defaultAPIKeyQueryParam = "api_key"
+	apiKeyDisabled          = "-"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// NewAPIKeyAuthHandler -- register the result using AddAuthHandler
+func NewAPIKeyAuthHandler(cfg *APIKeyAuthConfig) *APIKeyAuthHandler {
+	return &APIKeyAuthHandler{
+		cfg: cfg,
+	}
+}
+
+// Init --
+func (ah *APIKeyAuthHandler) Init(lCfg *config.Listener) (err error) {
+	if ah.cfg.Header == "" {
+		ah.cfg.Header = defaultAPIKeyHeader
+	}
+
+	if ah.cfg.QueryParam == "" {
+		ah.cfg.QueryParam = defaultAPIKeyQueryParam
+	}
+
+	if ah.cfg.QueryParam != apiKeyDisabled {
+		err = AddLogFilterForRequest(`([?&]`+regexp.QuoteMeta(ah.cfg.QueryParam)+`=)([^&]*)`, `$1*`)
+		if err != nil {
+			return
+		}
+	}
+
+	return ah.Update(ah.cfg.Clients)
+}
+
+// Update -- replace clients list, use it for keys rotation without restart
+func (ah *APIKeyAuthHandler) Update(clients map[string]*APIKeyClient) (err error) {
+	keys := make(map[string]*apiKeyEntry)
+
+	for name, client := range clients {
+		if client == nil {
+			continue
+		}
+
+		for i, key := range client.Keys {
+			if key == nil || strings.TrimSpace(key.Hash) == "" {
+				return fmt.Errorf(`apikey: client "%s", key #%d: empty hash`, name, i+1)
+			}
+
+			// the calculated hash is the lower case hex
+			key.Hash = strings.ToLower(strings.TrimSpace(key.Hash))
+
+			if _, exists := keys[key.Hash]; exists {
+				return fmt.Errorf(`apikey: client "%s", key #%d: duplicate key`, name, i+1)
+			}
+
+			info := &APIKeyInfo{
+				Name:        key.Name,
+				Expires:     key.Expires,
+				Permissions: make(misc.BoolMap, len(key.Permissions)),
+			}
+			for _, p := range key.Permissions {
+				info.Permissions[p] = true
+			}
+
+			keys[key.Hash] = &apiKeyEntry{
+				client: name,
+				groups: client.Groups,
+				key:    key,
+				info:   info,
+			}
+		}
+	}
+
+	ah.mutex.Lock()
+	ah.cfg.Clients = clients
+	ah.keys = keys
+	ah.mutex.Unlock()
+
+	return
+}
+
+// Enabled --
+func (ah *APIKeyAuthHandler) Enabled() bool {
+	return ah.cfg.Enabled
+}
+
+// Score --
+func (ah *APIKeyAuthHandler) Score() int {
+	return ah.cfg.Score
+}
+
+// WWWAuthHeader --
+func (ah *APIKeyAuthHandler) WWWAuthHeader() (name string, withRealm bool) {
+	return "", false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Check --
+func (ah *APIKeyAuthHandler) Check(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (identity *auth.Identity, tryNext bool, err error) {
+	key := ""
+
+	if ah.cfg.Header != apiKeyDisabled {
+		key = r.Header.Get(ah.cfg.Header)
+	}
+
+	if key == "" && ah.cfg.QueryParam != apiKeyDisabled {
+		key = r.URL.Query().Get(ah.cfg.QueryParam)
+	}
+
+	if key == "" {
+		return nil, true, nil
+	}
+
+	hash := string(auth.Hash([]byte(key), []byte(ah.cfg.Salt)))
+
+	ah.mutex.RLock()
+	entry, exists := ah.keys[hash]
+	ah.mutex.RUnlock()
+
+	if !exists || subtle.ConstantTimeCompare([]byte(entry.key.Hash), []byte(hash)) != 1 {
+		Log.Message(log.DEBUG, `[%d] Unknown API key`, id)
+		return nil, false, fmt.Errorf("invalid API key")
+	}
+
+	if !entry.key.Expires.IsZero() && misc.NowUTC().After(entry.key.Expires) {
+		Log.Message(log.INFO, `[%d] Expired API key "%s" of "%s" is used`, id, entry.key.Name, entry.client)
+		return nil, false, fmt.Errorf("API key expired")
+	}
+
+	identity = &auth.Identity{
+		Method: APIKeyAuthMethod,
+		User:   entry.client,
+		Groups: entry.groups,
+		Type:   APIKeyIdentityType,
+		Extra:  entry.info,
+	}
+
+	return identity, false, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,254 @@
+package stdhttp
+
+import (
+	"bufio"
+	"bytes"
+	"html/template"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alrusov/jsonw"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// AuditConfig --
+	AuditConfig struct {
+		File       string `toml:"file"`        // append-only JSON lines file, empty -- memory only
+		BufferSize int    `toml:"buffer-size"` // number of events shown on the audit page
+	}
+
+	// AuditEvent --
+	AuditEvent struct {
+		Time       time.Time `json:"time"`
+		RequestID  uint64    `json:"requestID,omitempty"`
+		User       string    `json:"user,omitempty"`
+		AuthMethod string    `json:"authMethod,omitempty"`
+		IP         string    `json:"ip,omitempty"`
+		Action     string    `json:"action"`
+		Details    string    `json:"details,omitempty"`
+		Outcome    string    `json:"outcome"`
+		Error      string    `json:"error,omitempty"`
+	}
+
+	auditLog struct {
+		mutex  sync.Mutex
+		fd     *os.File
+		size   int
+		events []*AuditEvent
+	}
+)
+
+const (
+	AuditOutcomeOK    = "ok"
+	AuditOutcomeError = "error"
+
+	defaultAuditBufferSize = 100
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func newAuditLog(size int) *auditLog {
+	if size <= 0 {
+		size = defaultAuditBufferSize
+	}
+
+	return &auditLog{
+		size:   size,
+		events: make([]*AuditEvent, 0, size),
+	}
+}
+
+// SetAudit -- configure the audit log. Previous events from the file are loaded to the buffer
+func (h *HTTP) SetAudit(cfg *AuditConfig) (err error) {
+	a := newAuditLog(cfg.BufferSize)
+
+	if cfg.File != "" {
+		fn, e := misc.AbsPath(cfg.File)
+		if e != nil {
+			return e
+		}
+
+		a.load(fn)
+
+		a.fd, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return
+		}
+	}
+
+	h.Lock()
+	old := h.audit
+	h.audit = a
+	h.Unlock()
+
+	if old != nil {
+		old.mutex.Lock()
+		if old.fd != nil {
+			old.fd.Close()
+			old.fd = nil
+		}
+		old.mutex.Unlock()
+	}
+
+	return
+}
+
+func (a *auditLog) load(fn string) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		ev := &AuditEvent{}
+		if jsonw.Unmarshal(scanner.Bytes(), ev) == nil {
+			a.push(ev)
+		}
+	}
+}
+
+func (a *auditLog) push(ev *AuditEvent) {
+	if len(a.events) >= a.size {
+		copy(a.events, a.events[1:])
+		a.events = a.events[:len(a.events)-1]
+	}
+	a.events = append(a.events, ev)
+}
+
+func (a *auditLog) add(ev *AuditEvent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.push(ev)
+
+	if a.fd == nil {
+		return
+	}
+
+	j, err := jsonw.Marshal(ev)
+	if err != nil {
+		Log.Message(log.ERR, "Audit: %s", err)
+		return
+	}
+
+	_, err = a.fd.Write(append(j, '\n'))
+	if err != nil {
+		Log.Message(log.ERR, "Audit: %s", err)
+	}
+}
+
+// list -- newest first
+func (a *auditLog) list() []*AuditEvent {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	list := make([]*AuditEvent, len(a.events))
+	for i, ev := range a.events {
+		list[len(a.events)-1-i] = ev
+	}
+	return list
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// getAudit -- the audit log may be replaced by SetAudit at any time
+func (h *HTTP) getAudit() *auditLog {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.audit
+}
+
+// Audit -- record the action made within the request. err == nil means success
+func (h *HTTP) Audit(id uint64, r *http.Request, action string, details string, err error) {
+	ev := &AuditEvent{
+		RequestID: id,
+		Action:    action,
+		Details:   details,
+		Outcome:   AuditOutcomeOK,
+	}
+
+	if r != nil {
+		ev.IP = h.ClientAddr(r)
+		if identity, _ := GetIdentityFromRequestContext(r); identity != nil {
+			ev.User = identity.User
+			ev.AuthMethod = identity.Method
+		}
+	}
+
+	if err != nil {
+		ev.Outcome = AuditOutcomeError
+		ev.Error = err.Error()
+	}
+
+	h.AuditEvent(ev)
+}
+
+// AuditEvent -- record the prepared event
+func (h *HTTP) AuditEvent(ev *AuditEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = misc.NowUTC()
+	}
+
+	if ev.Outcome == "" {
+		ev.Outcome = AuditOutcomeOK
+	}
+
+	Log.Message(log.INFO, `[%d] AUDIT: %s "%s" by "%s" from %s: %s %s`, ev.RequestID, ev.Action, ev.Details, ev.User, ev.IP, ev.Outcome, ev.Error)
+
+	h.getAudit().add(ev)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) showAudit(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	list := h.getAudit().list()
+
+	if r.URL.Query().Get("format") == ContentTypeJSON {
+		SendJSON(w, r, http.StatusOK, list)
+		return
+	}
+
+	params := struct {
+		Prefix string
+		Nonce  string
+		Name   string
+		ErrMsg string
+		List   []*AuditEvent
+	}{
+		Prefix: prefix,
+		Nonce:  GetCSPNonce(r),
+		Name:   "Audit log",
+		ErrMsg: r.URL.Query().Get("___err"),
+		List:   list,
+	}
+
+	t, err := template.New("audit").Parse(auditPage)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = t.Execute(buf, params)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	err = WriteReply(w, r, http.StatusOK, ContentTypeHTML, nil, buf.Bytes())
+	if err != nil {
+		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
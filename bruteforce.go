@@ -0,0 +1,413 @@
+package stdhttp
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alrusov/auth"
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// BruteForceConfig --
+	BruteForceConfig struct {
+		Enabled       bool            `toml:"enabled"`
+		MaxFailures   int             `toml:"max-failures"`   // failures within the window before lockout, 0 -- 10
+		Window        config.Duration `toml:"window"`         // 0 -- 15m
+		LockoutPeriod config.Duration `toml:"lockout-period"` // 0 -- 15m
+		DelayStep     config.Duration `toml:"delay-step"`     // added to the reply delay on each failure, 0 -- 200ms
+		MaxDelay      config.Duration `toml:"max-delay"`      // 0 -- 5s
+		LockUsers     bool            `toml:"lock-users"`     // lock the user from any IP (anyone is able to lock out the known account), false -- the user is locked on the failing IP only
+	}
+
+	// BruteForceStat --
+	BruteForceStat struct {
+		Failures uint64 `json:"failures" comment:"Failed authentications"`
+		Lockouts uint64 `json:"lockouts" comment:"Lockouts"`
+		Rejected uint64 `json:"rejected" comment:"Requests rejected due to lockout"`
+		Locked   int    `json:"locked" comment:"Currently locked IPs and users"`
+	}
+
+	// BruteForceEntry --
+	BruteForceEntry struct {
+		Key         string    `json:"key"`
+		Failures    int       `json:"failures"`
+		First       time.Time `json:"first"`
+		Last        time.Time `json:"last"`
+		LockedUntil time.Time `json:"lockedUntil"`
+	}
+
+	bruteForce struct {
+		mutex     sync.Mutex
+		cfg       BruteForceConfig
+		entries   map[string]*BruteForceEntry
+		lastPurge time.Time
+		stat      BruteForceStat
+	}
+
+	// rejectingAuthHandler -- marks the request when the handler rejects the presented credentials
+	rejectingAuthHandler struct {
+		auth.Handler
+	}
+)
+
+const (
+	bruteForceKeyIP   = "ip:"
+	bruteForceKeyUser = "user:"
+
+	ctxAuthRejected = ContextKey("auth-rejected")
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetBruteForceProtection --
+func (h *HTTP) SetBruteForceProtection(cfg *BruteForceConfig) {
+	if cfg == nil || !cfg.Enabled {
+		h.Lock()
+		h.bruteForce = nil
+		h.Unlock()
+		return
+	}
+
+	bf := &bruteForce{
+		cfg:       *cfg,
+		entries:   make(map[string]*BruteForceEntry),
+		lastPurge: time.Now(),
+	}
+
+	if bf.cfg.MaxFailures <= 0 {
+		bf.cfg.MaxFailures = 10
+	}
+	if bf.cfg.Window <= 0 {
+		bf.cfg.Window = config.Duration(15 * time.Minute)
+	}
+	if bf.cfg.LockoutPeriod <= 0 {
+		bf.cfg.LockoutPeriod = config.Duration(15 * time.Minute)
+	}
+	if bf.cfg.DelayStep <= 0 {
+		bf.cfg.DelayStep = config.Duration(200 * time.Millisecond)
+	}
+	if bf.cfg.MaxDelay <= 0 {
+		bf.cfg.MaxDelay = config.Duration(5 * time.Second)
+	}
+
+	h.Lock()
+	h.bruteForce = bf
+	h.Unlock()
+
+	h.AddEndpointsInfo(misc.StringMap{
+		"/maintenance/lockouts": "Authentication failures and lockouts",
+	})
+	h.AddPostEndpointsInfo(misc.StringMap{
+		"/maintenance/lockouts-clear": "Clear lockout ([key=<key>])",
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// bruteForceKeys -- the client address is taken from the forwarding headers only if the request came via the trusted proxy (see SetTrustedProxies)
+func (h *HTTP) bruteForceKeys(bf *bruteForce, r *http.Request, user string) []string {
+	ip := h.ClientAddr(r)
+
+	keys := []string{bruteForceKeyIP + ip}
+	if user != "" {
+		if bf.cfg.LockUsers {
+			keys = append(keys, bruteForceKeyUser+user)
+		} else {
+			keys = append(keys, bruteForceKeyUser+user+"@"+ip)
+		}
+	}
+	return keys
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// lockedFor -- how long the IP or user remains locked
+func (bf *bruteForce) lockedFor(keys []string) (d time.Duration) {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+
+	now := time.Now()
+
+	for _, key := range keys {
+		e, exists := bf.entries[key]
+		if !exists {
+			continue
+		}
+
+		if left := e.LockedUntil.Sub(now); left > d {
+			d = left
+		}
+	}
+
+	if d > 0 {
+		bf.stat.Rejected++
+	}
+
+	return
+}
+
+// fail -- registers the failure and returns the delay before the reply
+func (bf *bruteForce) fail(id uint64, keys []string) (delay time.Duration) {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+
+	now := time.Now()
+	bf.purge(now)
+
+	bf.stat.Failures++
+
+	for _, key := range keys {
+		e, exists := bf.entries[key]
+		if !exists || now.Sub(e.First) > bf.cfg.Window.D() {
+			e = &BruteForceEntry{
+				Key:   key,
+				First: now,
+			}
+			bf.entries[key] = e
+		}
+
+		e.Failures++
+		e.Last = now
+
+		if e.Failures >= bf.cfg.MaxFailures && now.After(e.LockedUntil) {
+			e.LockedUntil = now.Add(bf.cfg.LockoutPeriod.D())
+			bf.stat.Lockouts++
+			Log.Message(log.WARNING, `[%d] %s is locked until %s after %d failed authentications`, id, key, e.LockedUntil.Format(time.RFC3339), e.Failures)
+		}
+
+		if d := time.Duration(e.Failures) * bf.cfg.DelayStep.D(); d > delay {
+			delay = d
+		}
+	}
+
+	if delay > bf.cfg.MaxDelay.D() {
+		delay = bf.cfg.MaxDelay.D()
+	}
+
+	return
+}
+
+// success -- forget failures of the IP and user
+func (bf *bruteForce) success(keys []string) {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+
+	for _, key := range keys {
+		e, exists := bf.entries[key]
+		if exists && time.Now().After(e.LockedUntil) {
+			delete(bf.entries, key)
+		}
+	}
+}
+
+func (bf *bruteForce) purge(now time.Time) {
+	if now.Sub(bf.lastPurge) < bf.cfg.Window.D() {
+		return
+	}
+	bf.lastPurge = now
+
+	for key, e := range bf.entries {
+		if now.Sub(e.Last) > bf.cfg.Window.D() && now.After(e.LockedUntil) {
+			delete(bf.entries, key)
+		}
+	}
+}
+
+// clear -- empty key clears all
+func (bf *bruteForce) clear(key string) {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+
+	if key == "" {
+		bf.entries = make(map[string]*BruteForceEntry)
+		return
+	}
+
+	delete(bf.entries, key)
+}
+
+func (bf *bruteForce) list() (list []BruteForceEntry, stat BruteForceStat) {
+	bf.mutex.Lock()
+	defer bf.mutex.Unlock()
+
+	now := time.Now()
+	bf.purge(now)
+
+	list = make([]BruteForceEntry, 0, len(bf.entries))
+	stat = bf.stat
+
+	for _, e := range bf.entries {
+		list = append(list, *e)
+		if now.Before(e.LockedUntil) {
+			stat.Locked++
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Last.After(list[j].Last)
+	})
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// getBruteForce -- the protection may be replaced by SetBruteForceProtection at any time
+func (h *HTTP) getBruteForce() *bruteForce {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.bruteForce
+}
+
+// checkLockout -- sends 429 if the client or user is locked. Returns true if the request may be processed
+func (h *HTTP) checkLockout(id uint64, user string, w http.ResponseWriter, r *http.Request) bool {
+	bf := h.getBruteForce()
+	if bf == nil {
+		return true
+	}
+
+	d := bf.lockedFor(h.bruteForceKeys(bf, r, user))
+	if d <= 0 {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(d.Seconds())+1, 10))
+	Error(id, false, w, r, http.StatusTooManyRequests, "Too many failed authentications, try later", nil)
+	return false
+}
+
+// Check -- the error returned by the handler means the credentials were presented but are invalid
+func (ah rejectingAuthHandler) Check(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (identity *auth.Identity, tryNext bool, err error) {
+	identity, tryNext, err = ah.Handler.Check(id, prefix, path, w, r)
+	if err != nil {
+		if rejected, ok := GetValueFromRequestContext(r, ctxAuthRejected).(*bool); ok {
+			*rejected = true
+		}
+	}
+	return
+}
+
+// authFailed -- registers the failure and waits the progressive delay
+func (h *HTTP) authFailed(id uint64, user string, r *http.Request) {
+	bf := h.getBruteForce()
+	if bf == nil {
+		return
+	}
+
+	delay := bf.fail(id, h.bruteForceKeys(bf, r, user))
+	if delay > 0 {
+		misc.Sleep(delay)
+	}
+}
+
+// authSucceeded --
+func (h *HTTP) authSucceeded(user string, r *http.Request) {
+	bf := h.getBruteForce()
+	if bf == nil {
+		return
+	}
+
+	bf.success(h.bruteForceKeys(bf, r, user))
+}
+
+// BruteForceStat --
+func (h *HTTP) BruteForceStat() *BruteForceStat {
+	bf := h.getBruteForce()
+	if bf == nil {
+		return nil
+	}
+
+	_, stat := bf.list()
+	return &stat
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) showLockouts(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	bf := h.getBruteForce()
+	if bf == nil {
+		Error(id, false, w, r, http.StatusNotImplemented, "Brute force protection is not enabled", nil)
+		return
+	}
+
+	list, stat := bf.list()
+
+	if r.URL.Query().Get("format") == ContentTypeJSON {
+		SendJSON(w, r, http.StatusOK,
+			struct {
+				Stat BruteForceStat    `json:"stat"`
+				List []BruteForceEntry `json:"list"`
+			}{
+				Stat: stat,
+				List: list,
+			},
+		)
+		return
+	}
+
+	params := struct {
+		Prefix string
+		Nonce  string
+		CSRF   string
+		Name   string
+		ErrMsg string
+		Now    time.Time
+		Stat   BruteForceStat
+		List   []BruteForceEntry
+	}{
+		Prefix: prefix,
+		Nonce:  GetCSPNonce(r),
+		CSRF:   CSRFToken(w, r, prefix),
+		Name:   "Lockouts",
+		ErrMsg: r.URL.Query().Get("___err"),
+		Now:    time.Now(),
+		Stat:   stat,
+		List:   list,
+	}
+
+	t, err := template.New("lockouts").Parse(lockoutsPage)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = t.Execute(buf, params)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	err = WriteReply(w, r, http.StatusOK, ContentTypeHTML, nil, buf.Bytes())
+	if err != nil {
+		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+	}
+}
+
+func (h *HTTP) clearLockouts(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	bf := h.getBruteForce()
+	if bf == nil {
+		Error(id, false, w, r, http.StatusNotImplemented, "Brute force protection is not enabled", nil)
+		return
+	}
+
+	key := r.FormValue("key")
+	bf.clear(key)
+	h.Audit(id, r, "lockouts-clear", key, nil)
+
+	ReturnRefresh(id, w, r, http.StatusNoContent, ".", nil, nil)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
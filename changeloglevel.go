@@ -3,26 +3,97 @@ package stdhttp
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
-// changeLogLevel --
+type (
+	// LogLevelRevert -- the pending return of the facility to the level it had before the temporary change
+	LogLevelRevert struct {
+		Facility string    `json:"facility"`
+		Level    string    `json:"level" comment:"Temporary level"`
+		RevertTo string    `json:"revertTo"`
+		At       time.Time `json:"at"`
+		User     string    `json:"user,omitempty"`
+		timer    *time.Timer
+	}
+
+	logLevelReverts struct {
+		mutex sync.Mutex
+		list  map[string]*LogLevelRevert
+	}
+
+	// logLevelReply -- the JSON reply of set-log-level
+	logLevelReply struct {
+		Facility string     `json:"facility"`
+		Level    string     `json:"level"`
+		Previous string     `json:"previous"`
+		RevertTo string     `json:"revertTo,omitempty"`
+		RevertAt *time.Time `json:"revertAt,omitempty"`
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// changeLogLevel -- facility, level, [duration] (the level is reverted after it), [format=json]
 func (h *HTTP) changeLogLevel(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	queryParams := r.URL.Query()
-	facility := queryParams.Get("facility")
-	levelName := strings.ToUpper(queryParams.Get("level"))
+	facility := r.FormValue("facility")
+	levelName := strings.ToUpper(r.FormValue("level"))
+
+	var duration time.Duration
+	if s := r.FormValue("duration"); s != "" {
+		duration, err = misc.Interval2Duration(s)
+		if err == nil && duration <= 0 {
+			err = fmt.Errorf(`bad duration "%s"`, s)
+		}
+	}
+
+	reply := &logLevelReply{
+		Facility: facility,
+		Level:    levelName,
+	}
+
+	if err == nil {
+		f := log.GetFacility(facility)
+		if f == nil {
+			err = fmt.Errorf(`unknown facility "%s"`, facility)
+		} else {
+			user := ""
+			if identity, _ := GetIdentityFromRequestContext(r); identity != nil {
+				user = identity.User
+			}
 
-	f := log.GetFacility(facility)
-	if f == nil {
-		err = fmt.Errorf(`unknown facility "%s"`, facility)
-	} else {
-		_, err = f.SetLogLevel(levelName, "")
+			var rv *LogLevelRevert
+			reply.Previous, rv, err = h.setLogLevel(f, facility, levelName, duration, user)
+			if rv != nil {
+				reply.RevertTo = rv.RevertTo
+				reply.RevertAt = &rv.At
+			}
+		}
+	}
+
+	details := fmt.Sprintf("%s=%s", facility, levelName)
+	if duration > 0 {
+		details += " for " + misc.Duration2Interval(duration)
+	}
+	h.Audit(id, r, "set-log-level", details, err)
+
+	if r.FormValue("format") == ContentTypeJSON {
+		if err != nil {
+			Error(id, false, w, r, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		SendJSON(w, r, http.StatusOK, reply)
+		return
 	}
 
 	status := http.StatusNoContent
@@ -34,3 +105,104 @@ func (h *HTTP) changeLogLevel(id uint64, prefix string, path string, w http.Resp
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
+
+// setLogLevel -- the repeated temporary change keeps the original level, the permanent one cancels the pending revert.
+// The level is changed under the lock to be ordered with the reverts
+func (h *HTTP) setLogLevel(f *log.Facility, facility string, levelName string, duration time.Duration, user string) (previous string, rv *LogLevelRevert, err error) {
+	rs := &h.logLevelReverts
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	oldLevel, err := f.SetLogLevel(levelName, "")
+	if err != nil {
+		return
+	}
+	_, previous = log.GetLogLevelName(oldLevel)
+
+	if rs.list == nil {
+		rs.list = make(map[string]*LogLevelRevert)
+	}
+
+	revertTo := previous
+	if old, exists := rs.list[facility]; exists {
+		old.timer.Stop()
+		delete(rs.list, facility)
+		revertTo = old.RevertTo
+	}
+
+	if duration <= 0 || levelName == revertTo {
+		return
+	}
+
+	rv = &LogLevelRevert{
+		Facility: facility,
+		Level:    levelName,
+		RevertTo: revertTo,
+		At:       misc.NowUTC().Add(duration),
+		User:     user,
+	}
+	rv.timer = time.AfterFunc(duration, func() { h.revertLogLevel(rv) })
+
+	rs.list[facility] = rv
+	return
+}
+
+func (h *HTTP) revertLogLevel(rv *LogLevelRevert) {
+	rs := &h.logLevelReverts
+
+	rs.mutex.Lock()
+	if rs.list[rv.Facility] != rv {
+		// replaced or cancelled
+		rs.mutex.Unlock()
+		return
+	}
+	delete(rs.list, rv.Facility)
+	_, err := log.GetFacility(rv.Facility).SetLogLevel(rv.RevertTo, "")
+	rs.mutex.Unlock()
+
+	h.Audit(0, nil, "set-log-level-revert", fmt.Sprintf("%s=%s", rv.Facility, rv.RevertTo), err)
+}
+
+// closeLogLevelReverts -- the timers are stopped, the levels are reverted now, they are global for the process
+func (h *HTTP) closeLogLevelReverts() {
+	rs := &h.logLevelReverts
+
+	rs.mutex.Lock()
+	list := rs.list
+	rs.list = nil
+
+	errs := make(map[*LogLevelRevert]error, len(list))
+	for _, rv := range list {
+		rv.timer.Stop()
+		_, errs[rv] = log.GetFacility(rv.Facility).SetLogLevel(rv.RevertTo, "")
+	}
+	rs.mutex.Unlock()
+
+	for rv, err := range errs {
+		h.Audit(0, nil, "set-log-level-revert", fmt.Sprintf("%s=%s", rv.Facility, rv.RevertTo), err)
+	}
+}
+
+// LogLevelReverts -- pending reverts of the temporary log level changes ordered by time
+func (h *HTTP) LogLevelReverts() []*LogLevelRevert {
+	rs := &h.logLevelReverts
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	list := make([]*LogLevelRevert, 0, len(rs.list))
+	for _, rv := range rs.list {
+		v := *rv
+		v.timer = nil
+		list = append(list, &v)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].At.Before(list[j].At)
+	})
+
+	return list
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
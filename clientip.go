@@ -0,0 +1,108 @@
+package stdhttp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetTrustedProxies -- CIDRs (or single addresses) of the reverse proxies the X-Forwarded-For and X-Real-IP headers are accepted from.
+// Empty -- the headers are ignored by ClientAddr
+func (h *HTTP) SetTrustedProxies(list []string) (err error) {
+	nets, err := parseTrustedNets(list)
+	if err != nil {
+		return fmt.Errorf(`trusted proxies: %s`, err)
+	}
+
+	h.Lock()
+	h.trustedProxies = nets
+	h.Unlock()
+	return
+}
+
+// getTrustedProxies --
+func (h *HTTP) getTrustedProxies() []*net.IPNet {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.trustedProxies
+}
+
+// ClientAddr -- the client IP without port. The forwarding headers are used only if the connection came from the trusted proxy
+func (h *HTTP) ClientAddr(r *http.Request) string {
+	peer := remoteHost(r)
+	trusted := h.getTrustedProxies()
+
+	if !ipInNets(peer, trusted) {
+		return peer
+	}
+
+	// the rightmost address not added by the trusted proxies, the left ones are set by the client and may be forged
+	list := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(list) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(list[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		if !ipInNets(ip, trusted) {
+			return ip
+		}
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	return peer
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func parseTrustedNets(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return
+}
+
+// remoteHost -- the connection peer address without port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ipInNets(s string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,233 @@
+package stdhttp
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// CORSPolicy --
+	CORSPolicy struct {
+		AllowedOrigins   []string        `toml:"allowed-origins"` // "*", "https://example.com", "https://*.example.com"
+		AllowedMethods   []string        `toml:"allowed-methods"` // empty -- GET, HEAD, POST
+		AllowedHeaders   []string        `toml:"allowed-headers"` // "*" -- any requested
+		ExposedHeaders   []string        `toml:"exposed-headers"`
+		AllowCredentials bool            `toml:"allow-credentials"` // for the origins listed explicitly only, not for "*" and the patterns
+		MaxAge           config.Duration `toml:"max-age"`
+	}
+
+	// CORSConfig -- policies by endpoint pattern (the same patterns as for auth endpoints)
+	CORSConfig map[string]*CORSPolicy
+)
+
+const (
+	HTTPheaderOrigin                        = "Origin"
+	HTTPheaderVary                          = "Vary"
+	HTTPheaderAccessControlRequestMethod    = "Access-Control-Request-Method"
+	HTTPheaderAccessControlRequestHeaders   = "Access-Control-Request-Headers"
+	HTTPheaderAccessControlAllowOrigin      = "Access-Control-Allow-Origin"
+	HTTPheaderAccessControlAllowMethods     = "Access-Control-Allow-Methods"
+	HTTPheaderAccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	HTTPheaderAccessControlExposeHeaders    = "Access-Control-Expose-Headers"
+	HTTPheaderAccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	HTTPheaderAccessControlMaxAge           = "Access-Control-Max-Age"
+)
+
+var (
+	corsDefaultMethods = []string{MethodGET, MethodHEAD, MethodPOST}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetCORS -- replace all CORS policies
+func (h *HTTP) SetCORS(cfg CORSConfig) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.cors = make(CORSConfig, len(cfg))
+	h.corsKeys = make(misc.BoolMap, len(cfg))
+
+	for pattern, policy := range cfg {
+		h.addCORSPolicy(pattern, policy)
+	}
+}
+
+// AddCORSPolicy --
+func (h *HTTP) AddCORSPolicy(pattern string, policy *CORSPolicy) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.cors == nil {
+		h.cors = make(CORSConfig)
+		h.corsKeys = make(misc.BoolMap)
+	}
+
+	h.addCORSPolicy(pattern, policy)
+}
+
+func (h *HTTP) addCORSPolicy(pattern string, policy *CORSPolicy) {
+	if policy == nil {
+		delete(h.cors, pattern)
+		delete(h.corsKeys, pattern)
+		return
+	}
+
+	if policy.AllowCredentials && policy.hasWildcards() {
+		Log.Message(log.WARNING, `CORS policy "%s": credentials are not allowed for "*" and the origin patterns`, pattern)
+	}
+
+	h.cors[pattern] = policy
+	h.corsKeys[pattern] = true
+}
+
+func (h *HTTP) corsPolicy(path string) *CORSPolicy {
+	h.Lock()
+	defer h.Unlock()
+
+	pattern, exists := isPathInList(path, h.corsKeys)
+	if !exists {
+		return nil
+	}
+
+	return h.cors[pattern]
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// applyCORS -- decorates the response and answers preflight requests. Returns true if the request is completely processed
+func (h *HTTP) applyCORS(id uint64, path string, w http.ResponseWriter, r *http.Request) (processed bool) {
+	origin := r.Header.Get(HTTPheaderOrigin)
+	if origin == "" {
+		return
+	}
+
+	policy := h.corsPolicy(path)
+	if policy == nil {
+		return
+	}
+
+	preflight := r.Method == MethodOPTIONS && r.Header.Get(HTTPheaderAccessControlRequestMethod) != ""
+
+	hdr := w.Header()
+	hdr.Add(HTTPheaderVary, HTTPheaderOrigin)
+
+	if !policy.originAllowed(origin) {
+		if preflight {
+			Error(id, false, w, r, http.StatusForbidden, `Origin "`+origin+`" is not allowed`, nil)
+			return true
+		}
+		return
+	}
+
+	// any site would be able to read the authenticated replies otherwise
+	if policy.credentialsAllowed(origin) {
+		hdr.Set(HTTPheaderAccessControlAllowOrigin, origin)
+		hdr.Set(HTTPheaderAccessControlAllowCredentials, "true")
+	} else if policy.anyOrigin() {
+		hdr.Set(HTTPheaderAccessControlAllowOrigin, "*")
+	} else {
+		hdr.Set(HTTPheaderAccessControlAllowOrigin, origin)
+	}
+
+	if !preflight {
+		if len(policy.ExposedHeaders) != 0 {
+			hdr.Set(HTTPheaderAccessControlExposeHeaders, strings.Join(policy.ExposedHeaders, ", "))
+		}
+		return
+	}
+
+	hdr.Add(HTTPheaderVary, HTTPheaderAccessControlRequestMethod)
+	hdr.Add(HTTPheaderVary, HTTPheaderAccessControlRequestHeaders)
+
+	method := strings.ToUpper(r.Header.Get(HTTPheaderAccessControlRequestMethod))
+	methods := policy.AllowedMethods
+	if len(methods) == 0 {
+		methods = corsDefaultMethods
+	}
+
+	if !slices.Contains(methods, method) {
+		Error(id, false, w, r, http.StatusMethodNotAllowed, `Method "`+method+`" is not allowed`, nil)
+		return true
+	}
+
+	hdr.Set(HTTPheaderAccessControlAllowMethods, strings.Join(methods, ", "))
+
+	if requested := r.Header.Get(HTTPheaderAccessControlRequestHeaders); requested != "" {
+		if slices.Contains(policy.AllowedHeaders, "*") {
+			hdr.Set(HTTPheaderAccessControlAllowHeaders, requested)
+		} else if len(policy.AllowedHeaders) != 0 {
+			hdr.Set(HTTPheaderAccessControlAllowHeaders, strings.Join(policy.AllowedHeaders, ", "))
+		}
+	}
+
+	if policy.MaxAge > 0 {
+		hdr.Set(HTTPheaderAccessControlMaxAge, strconv.FormatInt(int64(policy.MaxAge.D().Seconds()), 10))
+	}
+
+	Log.Message(log.DEBUG, `[%d] CORS preflight from "%s" for %s`, id, origin, method)
+
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (policy *CORSPolicy) anyOrigin() bool {
+	return slices.Contains(policy.AllowedOrigins, "*")
+}
+
+func (policy *CORSPolicy) hasWildcards() bool {
+	for _, pattern := range policy.AllowedOrigins {
+		if strings.Contains(pattern, "*") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// credentialsAllowed -- the origin is listed explicitly
+func (policy *CORSPolicy) credentialsAllowed(origin string) bool {
+	if !policy.AllowCredentials {
+		return false
+	}
+
+	for _, pattern := range policy.AllowedOrigins {
+		if !strings.Contains(pattern, "*") && strings.EqualFold(pattern, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (policy *CORSPolicy) originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, pattern := range policy.AllowedOrigins {
+		pattern = strings.ToLower(pattern)
+
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+
+		if strings.Contains(pattern, "*") {
+			if ok, _ := path.Match(pattern, origin); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
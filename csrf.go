@@ -0,0 +1,190 @@
+package stdhttp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/alrusov/log"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Signed double-submit cookie: the token is stored in the cookie and must be repeated in the form field or the header.
+// The token is signed by the process secret, so the cookie can't be set to an arbitrary value by a sibling subdomain.
+
+const (
+	CSRFCookieName = "___csrf"
+	CSRFFieldName  = "___csrf"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+var (
+	csrfSecret = func() []byte {
+		b := make([]byte, 32)
+		rand.Read(b)
+		return b
+	}()
+
+	ErrCSRFMethod  = errors.New("method is not allowed, POST expected")
+	ErrCSRFMissing = errors.New("CSRF token is missing")
+	ErrCSRFInvalid = errors.New("CSRF token is invalid")
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetCSRFSecret -- use the common secret for several instances behind a balancer
+func SetCSRFSecret(secret []byte) {
+	if len(secret) != 0 {
+		csrfSecret = secret
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func csrfSign(nonce string) string {
+	m := hmac.New(sha256.New, csrfSecret)
+	m.Write([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func csrfNewToken() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	return nonce + "." + csrfSign(nonce)
+}
+
+func csrfValid(token string) bool {
+	nonce, sign, ok := strings.Cut(token, ".")
+	if !ok || nonce == "" {
+		return false
+	}
+
+	return hmac.Equal([]byte(sign), []byte(csrfSign(nonce)))
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// CSRFToken -- returns the current token, the new one is issued (and the cookie is set) if needed. Call it before writing the header
+func CSRFToken(w http.ResponseWriter, r *http.Request, prefix string) string {
+	if c, err := r.Cookie(CSRFCookieName); err == nil && csrfValid(c.Value) {
+		return c.Value
+	}
+
+	token := csrfNewToken()
+
+	path := prefix
+	if path == "" {
+		path = "/"
+	}
+
+	http.SetCookie(w,
+		&http.Cookie{
+			Name:     CSRFCookieName,
+			Value:    token,
+			Path:     path,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		},
+	)
+
+	// for the subsequent CheckCSRF in the same request
+	r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: token})
+
+	return token
+}
+
+// CheckCSRF -- checks the state changing request. The token is not required if the request was authenticated by its own credentials
+// (basic auth, API key and so on, not the session cookie) and the browser doesn't report it as the cross-site one
+func CheckCSRF(r *http.Request) error {
+	if r.Method != MethodPOST {
+		return ErrCSRFMethod
+	}
+
+	if csrfExempt(r) {
+		return nil
+	}
+
+	c, err := r.Cookie(CSRFCookieName)
+	if err != nil || c.Value == "" {
+		return ErrCSRFMissing
+	}
+
+	token := r.Header.Get(CSRFHeaderName)
+	if token == "" {
+		token = r.PostFormValue(CSRFFieldName)
+	}
+
+	if token == "" {
+		return ErrCSRFMissing
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.Value)) != 1 || !csrfValid(token) {
+		return ErrCSRFInvalid
+	}
+
+	return nil
+}
+
+// csrfExempt -- scripts using the credentials don't have the double-submit cookie
+func csrfExempt(r *http.Request) bool {
+	identity, _ := GetIdentityFromRequestContext(r)
+	if identity == nil {
+		return false
+	}
+
+	if sessionAuth, _ := GetValueFromRequestContext(r, ctxSessionAuth).(bool); sessionAuth {
+		return false
+	}
+
+	// browsers resend the cached basic auth credentials too
+	return r.Header.Get("Sec-Fetch-Site") != "cross-site" && sameOrigin(r)
+}
+
+// CSRFProtected -- checks the request and sends the error reply if the check failed. Returns true if the request may be processed
+func CSRFProtected(id uint64, w http.ResponseWriter, r *http.Request) bool {
+	err := CheckCSRF(r)
+	if err == nil {
+		return true
+	}
+
+	code := http.StatusForbidden
+	if err == ErrCSRFMethod {
+		w.Header().Set("Allow", MethodPOST)
+		code = http.StatusMethodNotAllowed
+	}
+
+	Log.Message(log.INFO, `[%d] CSRF check failed for "%s": %s`, id, r.URL.Path, err)
+	Error(id, false, w, r, code, err.Error(), nil)
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// csrfToken -- /maintenance/csrf-token, for scripts
+func (h *HTTP) csrfToken(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	type tokenReply struct {
+		Token  string `json:"token"`
+		Cookie string `json:"cookie"`
+		Field  string `json:"field"`
+		Header string `json:"header"`
+	}
+
+	SendJSON(w, r, http.StatusOK,
+		&tokenReply{
+			Token:  CSRFToken(w, r, prefix),
+			Cookie: CSRFCookieName,
+			Field:  CSRFFieldName,
+			Header: CSRFHeaderName,
+		},
+	)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -191,6 +191,22 @@ a:hover, a:hover * {
 	text-decoration:none; color: #515254 !important;
 }
 
+form.inline {
+	display: inline;
+}
+
+button.link, button.link * {
+	padding: 0;
+	border: 0;
+	background: none;
+	cursor: pointer;
+	text-decoration: underline;
+}
+
+button.link:hover, button.link:hover * {
+	text-decoration:none; color: #515254 !important;
+}
+
 table {
 	width: 100%;
 	border-collapse: collapse;
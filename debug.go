@@ -48,6 +48,8 @@ func init() {
 // debugEnv --
 func (h *HTTP) debugEnv(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
 	s := strings.Join(os.Environ(), "\n")
+	h.Audit(id, r, "show-env", "", nil)
+
 	err := WriteReply(w, r, http.StatusOK, ContentTypeText, nil, []byte(replace.Do(s)))
 	if err != nil {
 		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
@@ -59,6 +61,7 @@ func (h *HTTP) debugEnv(id uint64, prefix string, path string, w http.ResponseWr
 // debugFreeOSmem --
 func (h *HTTP) debugFreeOSmem(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
 	debug.FreeOSMemory()
+	h.Audit(id, r, "free-os-memory", "", nil)
 	ReturnRefresh(id, w, r, http.StatusNoContent, ".", nil, nil)
 }
 
@@ -14,6 +14,10 @@ import (
 func (h *HTTP) Embedded(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (processed bool) {
 	processed = true
 
+	if h.acmeChallenge(id, prefix, path, w, r) {
+		return
+	}
+
 	switch path {
 	default:
 		processed = false
@@ -40,6 +44,9 @@ func (h *HTTP) Embedded(id uint64, prefix string, path string, w http.ResponseWr
 		return
 
 	case "/debug/free-os-memory":
+		if !CSRFProtected(id, w, r) {
+			return
+		}
 		h.debugFreeOSmem(id, prefix, path, w, r)
 		return
 
@@ -59,15 +66,26 @@ func (h *HTTP) Embedded(id uint64, prefix string, path string, w http.ResponseWr
 		h.maintenance(id, prefix, path, w, r)
 		return
 
+	case "/maintenance/audit":
+		h.showAudit(id, prefix, path, w, r)
+		return
+
 	case "/maintenance/config":
 		h.showConfig(id, prefix, path, w, r)
 		return
 
+	case "/maintenance/csrf-token":
+		h.csrfToken(id, prefix, path, w, r)
+		return
+
 	case "/maintenance/endpoints":
 		h.endpoints(id, prefix, path, w, r)
 		return
 
 	case "/maintenance/exit":
+		if !CSRFProtected(id, w, r) {
+			return
+		}
 		h.exit(id, prefix, path, w, r)
 		return
 
@@ -75,20 +93,70 @@ func (h *HTTP) Embedded(id uint64, prefix string, path string, w http.ResponseWr
 		h.showInfo(id, prefix, path, w, r)
 		return
 
+	case "/maintenance/log":
+		h.showLog(id, prefix, path, w, r)
+		return
+
+	case "/maintenance/log/download":
+		h.downloadLog(id, prefix, path, w, r)
+		return
+
+	case logViewerStreamPath:
+		h.streamLog(id, prefix, path, w, r)
+		return
+
+	case "/maintenance/login":
+		h.login(id, prefix, path, w, r)
+		return
+
+	case "/maintenance/logout":
+		h.logout(id, prefix, path, w, r)
+		return
+
+	case "/maintenance/lockouts":
+		h.showLockouts(id, prefix, path, w, r)
+		return
+
+	case "/maintenance/lockouts-clear":
+		if !CSRFProtected(id, w, r) {
+			return
+		}
+		h.clearLockouts(id, prefix, path, w, r)
+		return
+
+	case "/maintenance/panics":
+		h.showPanics(id, prefix, path, w, r)
+		return
+
 	case "/maintenance/profiler-disable":
+		if !CSRFProtected(id, w, r) {
+			return
+		}
 		h.commonConfig.ProfilerEnabled = false
+		h.Audit(id, r, "profiler-disable", "", nil)
 		ReturnRefresh(id, w, r, http.StatusNoContent, ".", nil, nil)
 		return
 
 	case "/maintenance/profiler-enable":
+		if !CSRFProtected(id, w, r) {
+			return
+		}
 		h.commonConfig.ProfilerEnabled = true
+		h.Audit(id, r, "profiler-enable", "", nil)
 		ReturnRefresh(id, w, r, http.StatusNoContent, ".", nil, nil)
 		return
 
 	case "/maintenance/set-log-level":
+		if !CSRFProtected(id, w, r) {
+			return
+		}
 		h.changeLogLevel(id, prefix, path, w, r)
 		return
 
+	case "/maintenance/traces":
+		h.showTraces(id, prefix, path, w, r)
+		return
+
 	case "/status":
 		if h.statusFunc != nil {
 			h.statusFunc(id, prefix, path, w, r)
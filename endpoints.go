@@ -11,25 +11,44 @@ import (
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+type endpointItem struct {
+	Path        string
+	Description string
+	Link        bool // false -- POST only, the GET link would be useless
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func (h *HTTP) endpoints(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
 	params := struct {
 		Prefix string
+		Nonce  string
 		Name   string
 		ErrMsg string
-		List   dblStrArray
+		List   []endpointItem
 	}{
 		Prefix: prefix,
+		Nonce:  GetCSPNonce(r),
 		Name:   "Known endpoints",
 		ErrMsg: r.URL.Query().Get("___err"),
-		List:   make(dblStrArray, 0, len(h.info.Endpoints)),
+		List:   make([]endpointItem, 0, len(h.info.Endpoints)),
 	}
 
 	h.Lock()
 	for name, info := range h.info.Endpoints {
-		params.List = append(params.List, [2]string{name, info.Description})
+		params.List = append(params.List,
+			endpointItem{
+				Path:        name,
+				Description: info.Description,
+				Link:        !info.PostOnly,
+			},
+		)
 	}
 	h.Unlock()
-	sort.Sort(params.List)
+
+	sort.Slice(params.List, func(i, j int) bool {
+		return params.List[i].Path < params.List[j].Path
+	})
 
 	t, err := template.New("endpoints").Parse(endpointsPage)
 	if err != nil {
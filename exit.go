@@ -1,6 +1,7 @@
 package stdhttp
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
@@ -14,24 +15,29 @@ import (
 
 // exit --
 func (h *HTTP) exit(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
-	queryParams := r.URL.Query()
-
-	pid, err := strconv.ParseInt(queryParams.Get("pid"), 10, 64)
+	pid, err := strconv.ParseInt(r.FormValue("pid"), 10, 64)
 	if err != nil || pid != int64(os.Getpid()) {
+		if err == nil {
+			err = fmt.Errorf("pid %d, expected %d", pid, os.Getpid())
+		}
+		h.Audit(id, r, "exit", "", err)
 		Error(id, false, w, r, http.StatusBadRequest, "Illegal pid", err)
 		return
 	}
 
 	code := int64(misc.ExStopped)
-	s := queryParams.Get("code")
+	s := r.FormValue("code")
 	if s != "" {
 		code, err = strconv.ParseInt(s, 10, 16)
 		if err != nil {
+			h.Audit(id, r, "exit", "", err)
 			Error(id, false, w, r, http.StatusBadRequest, "Illegal code", err)
 			return
 		}
 	}
 
+	h.Audit(id, r, "exit", fmt.Sprintf("code=%d", code), nil)
+
 	go func() {
 		panicID := panic.ID()
 		defer panic.SaveStackToLogEx(panicID)
@@ -1,13 +1,22 @@
 package stdhttp
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"io/fs"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alrusov/log"
 	"github.com/alrusov/misc"
@@ -15,14 +24,122 @@ import (
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
-// File --
+type (
+	// FileServerConfig --
+	FileServerConfig struct {
+		Index            []string           `toml:"index"`               // index files of the directory, empty -- index.html
+		Listing          bool               `toml:"listing"`             // show the directory content if there is no index file
+		Precompressed    bool               `toml:"precompressed"`       // serve .br, .zst and .gz siblings if the client accepts them
+		CacheSize        int64              `toml:"cache-size"`          // in-memory LRU cache size in bytes, 0 -- disabled
+		CacheMaxFileSize int64              `toml:"cache-max-file-size"` // larger files are not cached, 0 -- 1MB
+		CacheControl     []CacheControlRule `toml:"cache-control"`       // the first matched rule is used
+		Symlinks         string             `toml:"symlinks"`            // within-root (default), deny or all, the listener root only
+		Dotfiles         string             `toml:"dotfiles"`            // ignore (404, default), deny (403) or allow, .well-known is always allowed
+		Deny             []string           `toml:"deny"`                // glob patterns, "/private/*" -- from the root, "*.bak" -- any element of the path
+	}
+
+	fileServer struct {
+		cfg          FileServerConfig
+		cacheControl []CacheControlRule
+		cache        *fileCache
+		etags        sync.Map // content based ETags of files without the modification time (embed.FS), by the cache key
+		mutex        sync.Mutex
+		rejections   FileRejections
+	}
+
+	// fileSource -- the file system the file is served from
+	fileSource struct {
+		fsys     fs.FS
+		cacheKey string // prefix of the cache key, unique for the source
+		confined bool   // errors other than "not exist" mean the path leaves the root
+		spaIndex string // served for unknown paths, empty -- no SPA fallback
+	}
+
+	// DirEntry --
+	DirEntry struct {
+		Name    string    `json:"name"`
+		Href    string    `json:"href"`
+		IsDir   bool      `json:"isDir"`
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"modTime"`
+	}
+)
+
+const (
+	defaultIndexFile = "index.html"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetFileServer --
+func (h *HTTP) SetFileServer(cfg *FileServerConfig) (err error) {
+	fsrv := &fileServer{}
+	if cfg != nil {
+		fsrv.cfg = *cfg
+	}
+
+	if len(fsrv.cfg.Index) == 0 {
+		fsrv.cfg.Index = []string{defaultIndexFile}
+	}
+
+	err = fsrv.checkConfig()
+	if err != nil {
+		return
+	}
+
+	fsrv.cacheControl, err = prepareCacheControl(fsrv.cfg.CacheControl)
+	if err != nil {
+		return
+	}
+
+	fsrv.cache = newFileCache(fsrv.cfg.CacheSize, fsrv.cfg.CacheMaxFileSize)
+
+	h.Lock()
+	h.fileServer = fsrv
+	h.Unlock()
+
+	return
+}
+
+func (h *HTTP) getFileServer() *fileServer {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.fileServer == nil {
+		h.fileServer = &fileServer{
+			cfg: FileServerConfig{
+				Index:    []string{defaultIndexFile},
+				Symlinks: SymlinksWithinRoot,
+				Dotfiles: DotfilesIgnore,
+			},
+		}
+	}
+
+	return h.fileServer
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// File -- mounted file systems first, then the listener root
 func (h *HTTP) File(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (processed bool) {
 	processed = false
 
-	if h.listenerCfg.Root == "" {
+	m, name := h.findMount(path)
+	if m == nil && h.listenerCfg.Root == "" {
 		return
 	}
 
+	_, span := StartSpan(r.Context(), "file", SpanKindInternal)
+	defer span.Finish()
+	span.SetAttribute("file.path", path)
+
+	if m != nil {
+		span.SetAttribute("file.mount", m.prefix)
+		return h.getFileServer().serve(id, prefix, path, &m.src, name, w, r)
+	}
+
+	fsrv := h.getFileServer()
+
 	fn, err := misc.AbsPath(h.listenerCfg.Root + "/" + path)
 	if err != nil {
 		processed = true
@@ -30,36 +147,375 @@ func (h *HTTP) File(id uint64, prefix string, path string, w http.ResponseWriter
 		return
 	}
 
-	if !strings.HasPrefix(fn, h.listenerCfg.Root) {
+	name, err = filepath.Rel(h.listenerCfg.Root, fn)
+	if err != nil || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
 		processed = true
+		fsrv.reject(id, RejectTraversal, path, err)
 		Error(id, false, w, r, http.StatusBadRequest, "Bad request", fmt.Errorf("hackers path: %s", path))
 		return
 	}
 
-	_, err = os.Stat(fn)
+	src, err := fsrv.diskSource(h.listenerCfg.Root, h.getFileRoot)
 	if err != nil {
-		// 404
+		processed = true
+		Error(id, false, w, r, http.StatusInternalServerError, "server error", err)
+		return
+	}
+
+	return fsrv.serve(id, prefix, path, src, filepath.ToSlash(name), w, r)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// serve -- name is relative to the source root, "." is the root itself
+func (s *fileServer) serve(id uint64, prefix string, path string, src *fileSource, name string, w http.ResponseWriter, r *http.Request) (processed bool) {
+	processed = false
+
+	if name == "" {
+		name = "."
+	}
+
+	if reason := s.checkName(name); reason != "" {
+		s.reject(id, reason, path, nil)
+		if reason == RejectDotfile && s.cfg.Dotfiles == DotfilesDeny {
+			processed = true
+			Error(id, false, w, r, http.StatusForbidden, "Forbidden", nil)
+		}
 		return
 	}
 
-	fd, err := os.Open(fn)
+	fi, err := fs.Stat(src.fsys, name)
 	if err != nil {
+		if src.confined && !errors.Is(err, fs.ErrNotExist) {
+			switch {
+			case src.symlinkInPath(name, err):
+				// a symbolic link out of the root or not allowed at all
+				s.reject(id, RejectSymlink, path, err)
+			case errors.Is(err, fs.ErrPermission):
+				processed = true
+				Error(id, false, w, r, http.StatusForbidden, "Forbidden", err)
+			default:
+				// ENOTDIR and so on, 404
+				Log.Message(log.DEBUG, `[%d] File "%s": %s`, id, path, err)
+			}
+			return
+		}
+
+		if src.spaIndex == "" {
+			// 404
+			return
+		}
+
+		name = src.spaIndex
+		fi, err = fs.Stat(src.fsys, name)
+		if err != nil || fi.IsDir() {
+			// 404
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		processed = true
-		Error(id, false, w, r, http.StatusInternalServerError, "server error", err)
+		w.Header().Set("Allow", "GET, HEAD")
+		Error(id, false, w, r, http.StatusMethodNotAllowed, "Method not allowed", nil)
 		return
 	}
-	defer fd.Close()
 
-	WriteContentHeader(w, strings.TrimLeft(filepath.Ext(fn), "."))
-	w.WriteHeader(http.StatusOK)
+	if fi.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// relative links in the index file and in the listing need the trailing slash
+			processed = true
+			u := *r.URL
+			u.Path = prefix + strings.TrimSuffix(path, "/") + "/"
+			u.RawPath = ""
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
 
-	_, err = io.Copy(w, bufio.NewReader(fd))
-	if err != nil {
-		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+		dir := name
+		found := false
+
+		for _, index := range s.cfg.Index {
+			name = pathJoin(dir, index)
+			fi, err = fs.Stat(src.fsys, name)
+			if err == nil && !fi.IsDir() {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			switch {
+			case s.cfg.Listing:
+				processed = true
+				s.dirListing(id, prefix, path, src, dir, w, r)
+				return
+
+			case src.spaIndex != "":
+				name = src.spaIndex
+				fi, err = fs.Stat(src.fsys, name)
+				if err != nil || fi.IsDir() {
+					// 404
+					return
+				}
+
+			default:
+				// 404
+				return
+			}
+		}
 	}
 
 	processed = true
+	s.serveFile(id, path, src, name, fi, w, r)
+	return
+}
+
+func pathJoin(dir string, name string) string {
+	if dir == "." || dir == "" {
+		return name
+	}
+
+	return dir + "/" + name
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// serveFile -- conditional requests, ranges and HEAD are handled by http.ServeContent
+func (s *fileServer) serveFile(id uint64, path string, src *fileSource, name string, fi fs.FileInfo, w http.ResponseWriter, r *http.Request) {
+	ct := fileContentType(name)
+
+	if s.cfg.Precompressed {
+		w.Header().Add(HTTPheaderVary, HTTPheaderAcceptEncoding)
+
+		encName, encFi, encoding := precompressedSibling(src.fsys, name, r)
+		if encoding != "" {
+			if ct == "" {
+				// sniff the original content, not the compressed one
+				ct = sniffContentType(src.fsys, name)
+			}
+
+			name, fi = encName, encFi
+			w.Header().Set(HTTPheaderContentEncoding, encoding)
+		}
+	}
+
+	if ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+
+	if cc := cacheControl(s.cacheControl, path); cc != "" {
+		w.Header().Set(HTTPheaderCacheControl, cc)
+	}
+
+	key := src.cacheKey + name
+	var content io.ReadSeeker
+
+	if s.cache != nil {
+		if data, ok := s.cache.get(key, fi.ModTime(), fi.Size()); ok {
+			content = bytes.NewReader(data)
+		}
+	}
+
+	if content == nil {
+		fd, err := src.fsys.Open(name)
+		if err != nil {
+			Error(id, false, w, r, http.StatusInternalServerError, "server error", err)
+			return
+		}
+		defer fd.Close()
+
+		cacheable := s.cache != nil && s.cache.cacheable(fi.Size())
+		seeker, isSeeker := fd.(io.ReadSeeker)
+
+		if isSeeker && !cacheable {
+			content = seeker
+		} else {
+			// not seekable files are read to the memory
+			data, err := readExactly(fd, fi.Size())
+			if err != nil {
+				Error(id, false, w, r, http.StatusInternalServerError, "server error", err)
+				return
+			}
+
+			if cacheable {
+				s.cache.put(key, fi.ModTime(), data)
+			}
+			content = bytes.NewReader(data)
+		}
+	}
+
+	if w.Header().Get("ETag") == "" {
+		etag, err := s.fileETag(key, fi, content)
+		if err != nil {
+			Error(id, false, w, r, http.StatusInternalServerError, "server error", err)
+			return
+		}
+		w.Header().Set("ETag", etag)
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+	Log.Message(log.TRACE3, `[%d] File "%s" sent`, id, key)
+}
+
+// precompressedSibling -- the most preferred .br, .zst or .gz file accepted by the client
+func precompressedSibling(fsys fs.FS, name string, r *http.Request) (encName string, encFi fs.FileInfo, encoding string) {
+	accepted := acceptedEncodings(r)
+	if len(accepted) == 0 {
+		return
+	}
+
+	for _, e := range fileEncodings {
+		if !accepted[e.encoding] {
+			continue
+		}
+
+		fi, err := fs.Stat(fsys, name+e.ext)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+
+		return name + e.ext, fi, e.encoding
+	}
+
 	return
 }
 
+func sniffContentType(fsys fs.FS, name string) string {
+	fd, err := fsys.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer fd.Close()
+
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(fd, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// fileContentType -- empty means "detect by the content"
+func fileContentType(fn string) string {
+	ext := filepath.Ext(fn)
+
+	if ct, exists := contentTypes[strings.ToLower(strings.TrimLeft(ext, "."))]; exists {
+		return ct
+	}
+
+	return mime.TypeByExtension(ext)
+}
+
+// fileETag -- by the modification time and the size, by the content if there is no modification time (embed.FS)
+func (s *fileServer) fileETag(key string, fi fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if !fi.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()), nil
+	}
+
+	if etag, exists := s.etags.Load(key); exists {
+		return etag.(string), nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	s.etags.Store(key, etag)
+	return etag, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (s *fileServer) dirListing(id uint64, prefix string, path string, src *fileSource, dir string, w http.ResponseWriter, r *http.Request) {
+	entries, err := fs.ReadDir(src.fsys, dir)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, "server error", err)
+		return
+	}
+
+	list := make([]DirEntry, 0, len(entries))
+
+	for _, e := range entries {
+		if s.checkName(pathJoin(dir, e.Name())) != "" {
+			continue
+		}
+
+		if e.Type()&fs.ModeSymlink != 0 && s.cfg.Symlinks == SymlinksDeny {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		name := e.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+
+		list = append(list,
+			DirEntry{
+				Name:    name,
+				Href:    (&url.URL{Path: name}).String(),
+				IsDir:   fi.IsDir(),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			},
+		)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].IsDir != list[j].IsDir {
+			return list[i].IsDir
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	if r.URL.Query().Get("format") == ContentTypeJSON {
+		SendJSON(w, r, http.StatusOK, list)
+		return
+	}
+
+	dirPath := strings.TrimSuffix(path, "/") + "/"
+
+	params := struct {
+		Prefix string
+		Nonce  string
+		Name   string
+		Path   string
+		IsRoot bool
+		List   []DirEntry
+	}{
+		Prefix: prefix,
+		Nonce:  GetCSPNonce(r),
+		Name:   dirPath,
+		Path:   dirPath,
+		IsRoot: dirPath == "/",
+		List:   list,
+	}
+
+	t, err := template.New("dir").Parse(dirListingPage)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = t.Execute(buf, params)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	err = WriteReply(w, r, http.StatusOK, ContentTypeHTML, nil, buf.Bytes())
+	if err != nil {
+		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+	}
+}
+
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,253 @@
+package stdhttp
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// CacheControlRule --
+	CacheControlRule struct {
+		Pattern string `toml:"pattern"` // regexp for the path, e.g. `\.[0-9a-f]{8,}\.(js|css)$`
+		Value   string `toml:"value"`   // e.g. "public, max-age=31536000, immutable"
+		re      *regexp.Regexp
+	}
+
+	// FileCacheStat --
+	FileCacheStat struct {
+		Files  int    `json:"files" comment:"Cached files"`
+		Size   int64  `json:"size" comment:"Cached bytes"`
+		Hits   uint64 `json:"hits" comment:"Hits"`
+		Misses uint64 `json:"misses" comment:"Misses"`
+	}
+
+	fileCache struct {
+		mutex       sync.Mutex
+		maxSize     int64
+		maxFileSize int64
+		size        int64
+		lru         *list.List
+		items       map[string]*list.Element
+		stat        FileCacheStat
+	}
+
+	fileCacheItem struct {
+		name    string
+		modTime time.Time
+		data    []byte
+	}
+
+	// precompressed sibling
+	fileEncoding struct {
+		encoding string
+		ext      string
+	}
+)
+
+const (
+	ContentEncodingBrotli = "br"
+	ContentEncodingZstd   = "zstd"
+
+	HTTPheaderCacheControl = "Cache-Control"
+
+	defaultCacheMaxFileSize = 1 << 20
+)
+
+var (
+	// in the order of preference
+	fileEncodings = []fileEncoding{
+		{encoding: ContentEncodingBrotli, ext: ".br"},
+		{encoding: ContentEncodingZstd, ext: ".zst"},
+		{encoding: ContentEncodingGzip, ext: ".gz"},
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func prepareCacheControl(rules []CacheControlRule) (prepared []CacheControlRule, err error) {
+	prepared = make([]CacheControlRule, 0, len(rules))
+
+	for i, rule := range rules {
+		rule.re, err = regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf(`cache-control rule #%d: %s`, i+1, err)
+		}
+		prepared = append(prepared, rule)
+	}
+
+	return
+}
+
+// cacheControl -- value of the first matched rule
+func cacheControl(rules []CacheControlRule, path string) string {
+	for _, rule := range rules {
+		if rule.re != nil && rule.re.MatchString(path) {
+			return rule.Value
+		}
+	}
+
+	return ""
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// acceptedEncodings -- encodings from the Accept-Encoding header with q > 0
+func acceptedEncodings(r *http.Request) map[string]bool {
+	accepted := make(map[string]bool)
+
+	for _, s := range r.Header[HTTPheaderAcceptEncoding] {
+		for v := range strings.SplitSeq(s, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(v), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			q := 1.0
+			for p := range strings.SplitSeq(params, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(p), "=")
+				if ok && strings.TrimSpace(k) == "q" {
+					if f, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+						q = f
+					}
+				}
+			}
+
+			accepted[name] = q > 0
+		}
+	}
+
+	if star, exists := accepted["*"]; exists {
+		for _, e := range fileEncodings {
+			if _, exists := accepted[e.encoding]; !exists {
+				accepted[e.encoding] = star
+			}
+		}
+	}
+
+	return accepted
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func newFileCache(maxSize int64, maxFileSize int64) *fileCache {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	if maxFileSize <= 0 {
+		maxFileSize = defaultCacheMaxFileSize
+	}
+
+	return &fileCache{
+		maxSize:     maxSize,
+		maxFileSize: maxFileSize,
+		lru:         list.New(),
+		items:       make(map[string]*list.Element),
+	}
+}
+
+// get -- the content is valid only if the modification time and the size are the same
+func (c *fileCache) get(name string, modTime time.Time, size int64) (data []byte, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, exists := c.items[name]
+	if exists {
+		item := e.Value.(*fileCacheItem)
+		if item.modTime.Equal(modTime) && int64(len(item.data)) == size {
+			c.lru.MoveToFront(e)
+			c.stat.Hits++
+			return item.data, true
+		}
+
+		c.remove(e)
+	}
+
+	c.stat.Misses++
+	return nil, false
+}
+
+func (c *fileCache) put(name string, modTime time.Time, data []byte) {
+	size := int64(len(data))
+	if size > c.maxFileSize || size > c.maxSize {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, exists := c.items[name]; exists {
+		c.remove(e)
+	}
+
+	c.items[name] = c.lru.PushFront(
+		&fileCacheItem{
+			name:    name,
+			modTime: modTime,
+			data:    data,
+		},
+	)
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove -- must be called under lock
+func (c *fileCache) remove(e *list.Element) {
+	item := e.Value.(*fileCacheItem)
+	c.lru.Remove(e)
+	delete(c.items, item.name)
+	c.size -= int64(len(item.data))
+}
+
+// cacheable -- reads the file to the cache if it is small enough
+func (c *fileCache) cacheable(size int64) bool {
+	return size <= c.maxFileSize && size <= c.maxSize
+}
+
+func (c *fileCache) getStat() FileCacheStat {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stat := c.stat
+	stat.Files = len(c.items)
+	stat.Size = c.size
+	return stat
+}
+
+// FileCacheStat -- nil if the cache is not enabled
+func (h *HTTP) FileCacheStat() *FileCacheStat {
+	fs := h.getFileServer()
+	if fs.cache == nil {
+		return nil
+	}
+
+	stat := fs.cache.getStat()
+	return &stat
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func readExactly(rd io.Reader, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(rd, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,279 @@
+package stdhttp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/alrusov/log"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// FileRejections -- rejected file requests by the reason
+	FileRejections map[string]uint64
+
+	// noSymlinksFS -- os.Root based file system that refuses symbolic links in any element of the path
+	noSymlinksFS struct {
+		root *os.Root
+		fsys fs.FS
+	}
+)
+
+const (
+	// SymlinksWithinRoot -- follow symbolic links which do not leave the root (default)
+	SymlinksWithinRoot = "within-root"
+	// SymlinksDeny -- don't follow symbolic links at all
+	SymlinksDeny = "deny"
+	// SymlinksAll -- follow all symbolic links
+	SymlinksAll = "all"
+
+	// DotfilesIgnore -- dotfiles don't exist for clients, 404 (default)
+	DotfilesIgnore = "ignore"
+	// DotfilesDeny -- 403 for dotfiles
+	DotfilesDeny = "deny"
+	// DotfilesAllow -- no special rules
+	DotfilesAllow = "allow"
+
+	// RejectTraversal --
+	RejectTraversal = "traversal"
+	// RejectSymlink --
+	RejectSymlink = "symlink"
+	// RejectDotfile --
+	RejectDotfile = "dotfile"
+	// RejectDenied --
+	RejectDenied = "denied"
+)
+
+var (
+	errSymlinkDenied = errors.New("symbolic links are not allowed")
+
+	// always allowed, RFC 8615
+	dotfilesExceptions = map[string]bool{
+		".well-known": true,
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (s *fileServer) checkConfig() (err error) {
+	switch s.cfg.Symlinks {
+	case "":
+		s.cfg.Symlinks = SymlinksWithinRoot
+	case SymlinksWithinRoot, SymlinksDeny, SymlinksAll:
+	default:
+		return fmt.Errorf(`unknown symlinks policy "%s"`, s.cfg.Symlinks)
+	}
+
+	switch s.cfg.Dotfiles {
+	case "":
+		s.cfg.Dotfiles = DotfilesIgnore
+	case DotfilesIgnore, DotfilesDeny, DotfilesAllow:
+	default:
+		return fmt.Errorf(`unknown dotfiles policy "%s"`, s.cfg.Dotfiles)
+	}
+
+	for _, pattern := range s.cfg.Deny {
+		_, err = path.Match(strings.TrimPrefix(pattern, "/"), "")
+		if err != nil {
+			return fmt.Errorf(`deny pattern "%s": %s`, pattern, err)
+		}
+	}
+
+	return
+}
+
+// diskSource -- the listener root according to the symlinks policy
+func (s *fileServer) diskSource(root string, openRoot func() (*os.Root, error)) (src *fileSource, err error) {
+	src = &fileSource{
+		cacheKey: root + "/",
+		confined: true,
+	}
+
+	if s.cfg.Symlinks == SymlinksAll {
+		src.fsys = os.DirFS(root)
+		src.confined = false
+		return src, nil
+	}
+
+	rt, err := openRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	src.fsys = rt.FS()
+	if s.cfg.Symlinks == SymlinksDeny {
+		src.fsys = &noSymlinksFS{root: rt, fsys: src.fsys}
+	}
+
+	return src, nil
+}
+
+// getFileRoot -- the listener root is opened once and closed by Close
+func (h *HTTP) getFileRoot() (*os.Root, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.fileRoot == nil {
+		rt, err := os.OpenRoot(h.listenerCfg.Root)
+		if err != nil {
+			return nil, err
+		}
+		h.fileRoot = rt
+	}
+
+	return h.fileRoot, nil
+}
+
+func (h *HTTP) closeFileRoot() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.fileRoot != nil {
+		h.fileRoot.Close()
+		h.fileRoot = nil
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// checkName -- the rejection reason for the name relative to the source root, empty if it is allowed
+func (s *fileServer) checkName(name string) (reason string) {
+	if name == "." || name == "" {
+		return ""
+	}
+
+	elems := strings.Split(name, "/")
+
+	if s.cfg.Dotfiles != DotfilesAllow {
+		for _, e := range elems {
+			if strings.HasPrefix(e, ".") && !dotfilesExceptions[e] {
+				return RejectDotfile
+			}
+		}
+	}
+
+	for _, pattern := range s.cfg.Deny {
+		if strings.Contains(pattern, "/") {
+			// full path from the root
+			if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), name); ok {
+				return RejectDenied
+			}
+			continue
+		}
+
+		// any element of the path
+		for _, e := range elems {
+			if ok, _ := path.Match(pattern, e); ok {
+				return RejectDenied
+			}
+		}
+	}
+
+	return ""
+}
+
+// symlinkInPath -- the error is caused by the symbolic link (leaving the root or not allowed) if some element of the path is the link
+func (src *fileSource) symlinkInPath(name string, err error) bool {
+	if errors.Is(err, errSymlinkDenied) {
+		return true
+	}
+
+	lfs, ok := src.fsys.(fs.ReadLinkFS)
+	if !ok {
+		return false
+	}
+
+	elems := strings.Split(name, "/")
+	for i := range elems {
+		fi, err := lfs.Lstat(strings.Join(elems[:i+1], "/"))
+		if err != nil {
+			return false
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reject -- logs and counts the rejection
+func (s *fileServer) reject(id uint64, reason string, path string, err error) {
+	s.mutex.Lock()
+	if s.rejections == nil {
+		s.rejections = make(FileRejections)
+	}
+	s.rejections[reason]++
+	s.mutex.Unlock()
+
+	if err != nil {
+		Log.Message(log.WARNING, `[%d] File "%s" rejected (%s): %s`, id, path, reason, err)
+		return
+	}
+
+	Log.Message(log.WARNING, `[%d] File "%s" rejected (%s)`, id, path, reason)
+}
+
+// FileRejections -- nil if there were no rejections
+func (h *HTTP) FileRejections() FileRejections {
+	s := h.getFileServer()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.rejections) == 0 {
+		return nil
+	}
+
+	list := make(FileRejections, len(s.rejections))
+	for reason, n := range s.rejections {
+		list[reason] = n
+	}
+
+	return list
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Lstat --
+func (f *noSymlinksFS) Lstat(name string) (fs.FileInfo, error) {
+	return f.root.Lstat(name)
+}
+
+// ReadLink --
+func (f *noSymlinksFS) ReadLink(name string) (string, error) {
+	return f.root.Readlink(name)
+}
+
+// Open --
+func (f *noSymlinksFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name != "." {
+		elems := strings.Split(name, "/")
+		for i := range elems {
+			p := strings.Join(elems[:i+1], "/")
+
+			fi, err := f.root.Lstat(p)
+			if err != nil {
+				return nil, err
+			}
+
+			if fi.Mode()&fs.ModeSymlink != 0 {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: errSymlinkDenied}
+			}
+		}
+	}
+
+	return f.fsys.Open(name)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,133 @@
+package stdhttp
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// MountOptions --
+	MountOptions struct {
+		SPA      bool   // serve the SPA index file for unknown paths under the mount
+		SPAIndex string // SPA index file relative to the file system root, empty -- index.html
+	}
+
+	fsMount struct {
+		prefix string // without the trailing slash, "" for the root
+		src    fileSource
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// MountFS -- serves fsys (os.DirFS, embed.FS, fs.Sub and so on) at the URL prefix. Longer prefixes take precedence, all mounts take precedence over the listener root
+func (h *HTTP) MountFS(prefix string, fsys fs.FS, opts *MountOptions) (err error) {
+	if fsys == nil {
+		return fmt.Errorf(`mount "%s": file system is nil`, prefix)
+	}
+
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	m := &fsMount{
+		prefix: prefix,
+		src: fileSource{
+			fsys:     fsys,
+			cacheKey: fmt.Sprintf("mount:%s:", prefix),
+		},
+	}
+
+	if opts != nil && opts.SPA {
+		m.src.spaIndex = opts.SPAIndex
+		if m.src.spaIndex == "" {
+			m.src.spaIndex = defaultIndexFile
+		}
+
+		if !fs.ValidPath(m.src.spaIndex) {
+			return fmt.Errorf(`mount "%s": bad SPA index "%s"`, prefix, m.src.spaIndex)
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	// copy on write, the old list may be in use
+	mounts := make([]*fsMount, 0, len(h.mounts)+1)
+	for _, old := range h.mounts {
+		if old.prefix != prefix {
+			mounts = append(mounts, old)
+		}
+	}
+	mounts = append(mounts, m)
+
+	sort.Slice(mounts, func(i, j int) bool {
+		return len(mounts[i].prefix) > len(mounts[j].prefix)
+	})
+
+	h.mounts = mounts
+
+	if prefix != "" {
+		if _, exists := h.info.Endpoints[prefix+"/*"]; !exists {
+			h.addEndpointsInfo(misc.StringMap{prefix + "/*": "Mounted file system"}, false)
+		}
+	}
+
+	return
+}
+
+// UnmountFS --
+func (h *HTTP) UnmountFS(prefix string) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	mounts := make([]*fsMount, 0, len(h.mounts))
+	for _, m := range h.mounts {
+		if m.prefix != prefix {
+			mounts = append(mounts, m)
+		}
+	}
+
+	h.mounts = mounts
+}
+
+// findMount -- the mount with the longest prefix and the file name relative to its root
+func (h *HTTP) findMount(path string) (m *fsMount, name string) {
+	h.Lock()
+	mounts := h.mounts
+	h.Unlock()
+
+	for _, m := range mounts {
+		if m.prefix != "" && path != m.prefix && !strings.HasPrefix(path, m.prefix+"/") {
+			continue
+		}
+
+		name = strings.Trim(path[len(m.prefix):], "/")
+		if name == "" {
+			name = "."
+		}
+
+		if !fs.ValidPath(name) {
+			// "..", empty elements and so on, the SPA index is not suitable here
+			return nil, ""
+		}
+
+		return m, name
+	}
+
+	return nil, ""
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -10,6 +10,8 @@ require (
 	github.com/alrusov/log v0.1.39
 	github.com/alrusov/misc v1.1.30
 	github.com/alrusov/panic v0.1.16
+	golang.org/x/crypto v0.45.0
+	golang.org/x/net v0.47.0
 )
 
 require (
@@ -21,4 +23,5 @@ require (
 	github.com/naoina/go-stringutil v0.1.0 // indirect
 	github.com/naoina/toml v0.1.1 // indirect
 	github.com/rogpeppe/go-internal v1.14.1 // indirect
+	golang.org/x/text v0.31.0 // indirect
 )
@@ -26,6 +26,12 @@ type (
 		Application *applicationBlock        `json:"application" comment:"Application info"`
 		Runtime     *runtimeBlock            `json:"runtime" comment:"Runtime info"`
 		Endpoints   map[string]*endpointInfo `json:"endpoints" comment:"Enpoints info"`
+		BruteForce  *BruteForceStat          `json:"bruteForce,omitempty" comment:"Authentication failures"`
+		FileCache   *FileCacheStat           `json:"fileCache,omitempty" comment:"Static files cache"`
+		FileRejects FileRejections           `json:"fileRejects,omitempty" comment:"Rejected static files requests by the reason"`
+		SSE         map[string]*SSEStat      `json:"sse,omitempty" comment:"Server-Sent Events brokers"`
+		WebSocket   *WebSocketStat           `json:"webSocket,omitempty" comment:"WebSocket connections"`
+		LogReverts  []*LogLevelRevert        `json:"logLevelReverts,omitempty" comment:"Pending reverts of the temporary log level changes"`
 		LastLog     []string                 `json:"lastLog" comment:"Last lines from the log"`
 		Extra       any                      `json:"extra" comment:"Application extra info"`
 	}
@@ -80,13 +86,18 @@ type (
 
 	endpointInfo struct {
 		Description string   `json:"description" comment:"Description"`
+		PostOnly    bool     `json:"postOnly,omitempty" comment:"Accepts POST only"`
 		Stat        *urlStat `json:"stat" comment:"Statistics"`
 	}
 
 	urlStat struct {
-		Total   uint64 `json:"total" comment:"Total requests"`
-		la      *loadavg.LoadAvg
-		LoadAvg float64 `json:"loadAvg" comment:"Load average"`
+		Total    uint64 `json:"total" comment:"Total requests"`
+		la       *loadavg.LoadAvg
+		LoadAvg  float64 `json:"loadAvg" comment:"Load average"`
+		Errors   uint64  `json:"errors" comment:"Replies with 5xx status"`
+		Bytes    uint64  `json:"bytes" comment:"Body bytes sent"`
+		Panics   uint64  `json:"panics" comment:"Recovered panics"`
+		Timeouts uint64  `json:"timeouts" comment:"Handler timeouts"`
 	}
 
 	// ExtraInfoFunc --
@@ -175,27 +186,34 @@ func (h *HTTP) initInfo() {
 
 	info.Endpoints = make(map[string]*endpointInfo)
 	h.AddEndpointsInfo(misc.StringMap{
-		url404:                          `Cumulatiive "Not Found" endpoint`,
-		"/___.css":                      "General purpose css",
-		"/":                             "Root page",
-		"/debug/build-info":             "Show applications build info",
-		"/debug/env":                    "Show environment",
+		url404:                      `Cumulatiive "Not Found" endpoint`,
+		"/___.css":                  "General purpose css",
+		"/":                         "Root page",
+		"/debug/build-info":         "Show applications build info",
+		"/debug/env":                "Show environment",
+		"/debug/gc-stat":            "Garbage collector statistics",
+		"/debug/mem-stat":           "Memory statistics",
+		"/debug/pprof":              "Profiler root",
+		"/favicon.ico":              "favicon.ico",
+		"/maintenance":              "Application maintenance page",
+		"/maintenance/audit":        "Audit log of administrative actions ([format=json])",
+		"/maintenance/config":       "Get secured app config",
+		"/maintenance/csrf-token":   "Get CSRF token for the state changing requests",
+		"/maintenance/endpoints":    "Known endpoints",
+		"/maintenance/info":         "Get app information",
+		"/maintenance/log":          "Live log viewer",
+		"/maintenance/log/download": "Download the current log file",
+		logViewerStreamPath:         "Live log [SSE] ([facility=<facility>], [level=<level>], [text=<text>], [lastEventId=<id>])",
+		"/status":                   "Application current status",
+		"/status/ping":              "Checking if the application is running",
+		"/tools/sha":                "Calculate hash (p=<string>, salt=<string>)",
+	})
+	h.AddPostEndpointsInfo(misc.StringMap{
 		"/debug/free-os-memory":         "Try to release an unused memory to the OS",
-		"/debug/gc-stat":                "Garbage collector statistics",
-		"/debug/mem-stat":               "Memory statistics",
-		"/debug/pprof":                  "Profiler root",
-		"/favicon.ico":                  "favicon.ico",
-		"/maintenance":                  "Application maintenance page",
-		"/maintenance/config":           "Get secured app config",
-		"/maintenance/endpoints":        "Known endpoints",
 		"/maintenance/exit":             "Exit application (pid=<pid>, [code=<code>])",
-		"/maintenance/info":             "Get app information",
 		"/maintenance/profiler-disable": "Disable profiler",
 		"/maintenance/profiler-enable":  "Enable profiler",
-		"/maintenance/set-log-level":    "Temporarily change log level (level=<level>)",
-		"/status":                       "Application current status",
-		"/status/ping":                  "Checking if the application is running",
-		"/tools/sha":                    "Calculate hash (p=<string>, salt=<string>)",
+		"/maintenance/set-log-level":    "Temporarily change log level (facility=<facility>, level=<level>, [duration=<interval>], [format=json])",
 	})
 }
 
@@ -206,14 +224,23 @@ func (h *HTTP) AddEndpointsInfo(list misc.StringMap) {
 	h.Lock()
 	defer h.Unlock()
 
-	h.addEndpointsInfo(list)
+	h.addEndpointsInfo(list, false)
 }
 
-func (h *HTTP) addEndpointsInfo(list misc.StringMap) {
+// AddPostEndpointsInfo -- the same as AddEndpointsInfo for the endpoints accepting POST only
+func (h *HTTP) AddPostEndpointsInfo(list misc.StringMap) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.addEndpointsInfo(list, true)
+}
+
+func (h *HTTP) addEndpointsInfo(list misc.StringMap, postOnly bool) {
 	for name, descr := range list {
 		h.info.Endpoints[name] =
 			&endpointInfo{
 				Description: descr,
+				PostOnly:    postOnly,
 				Stat:        h.newStat(),
 			}
 	}
@@ -254,20 +281,58 @@ func (h *HTTP) newStat() *urlStat {
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
-func (h *HTTP) updateEndpointStat(path string) {
+func (h *HTTP) updateEndpointStat(path string, status int, bytes int64) {
+	h.Lock()
+	defer h.Unlock()
+
+	stat := h.endpointStat(path)
+	if stat == nil {
+		return
+	}
+
+	stat.add(status, bytes)
+}
+
+func (h *HTTP) endpointPanic(path string) {
+	h.Lock()
+	defer h.Unlock()
+
+	atomic.AddUint64(&h.info.Runtime.Requests.Panics, 1)
+
+	stat := h.endpointStat(path)
+	if stat == nil {
+		return
+	}
+
+	atomic.AddUint64(&stat.Panics, 1)
+}
+
+func (h *HTTP) endpointTimedOut(path string) {
 	h.Lock()
 	defer h.Unlock()
 
+	atomic.AddUint64(&h.info.Runtime.Requests.Timeouts, 1)
+
+	stat := h.endpointStat(path)
+	if stat == nil {
+		return
+	}
+
+	atomic.AddUint64(&stat.Timeouts, 1)
+}
+
+// endpointStat -- must be called under lock
+func (h *HTTP) endpointStat(path string) *urlStat {
 	ep, exists := h.info.Endpoints[path]
 	if !exists {
-		h.addEndpointsInfo(misc.StringMap{path: "<<< NO DESCRIPTION >>>"})
+		h.addEndpointsInfo(misc.StringMap{path: "<<< NO DESCRIPTION >>>"}, false)
 		ep, exists = h.info.Endpoints[path]
 		if !exists {
-			return
+			return nil
 		}
 	}
 
-	ep.Stat.inc()
+	return ep.Stat
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -277,6 +342,18 @@ func (s *urlStat) inc() {
 	s.la.Add(1)
 }
 
+func (s *urlStat) add(status int, bytes int64) {
+	s.inc()
+
+	if status >= 500 {
+		atomic.AddUint64(&s.Errors, 1)
+	}
+
+	if bytes > 0 {
+		atomic.AddUint64(&s.Bytes, uint64(bytes))
+	}
+}
+
 func (s *urlStat) update() {
 	s.LoadAvg = s.la.Value()
 }
@@ -291,6 +368,13 @@ func (h *HTTP) SetExtraInfoFunc(f ExtraInfoFunc) {
 //----------------------------------------------------------------------------------------------------------------------------//
 
 func (h *HTTP) showInfo(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	fileCache := h.FileCacheStat()    // uses the lock inside
+	fileRejects := h.FileRejections() // uses the lock inside
+	sse := h.SSEStat()                // uses the lock inside
+	webSocket := h.WebSocketStat()    // uses the lock inside
+	bruteForce := h.BruteForceStat()  // uses the lock inside
+	logReverts := h.LogLevelReverts()
+
 	h.Lock()
 	defer h.Unlock()
 
@@ -327,6 +411,13 @@ func (h *HTTP) showInfo(id uint64, prefix string, path string, w http.ResponseWr
 	info.Runtime.NumGoroutine = runtime.NumGoroutine()
 	info.Runtime.Requests.update()
 
+	info.BruteForce = bruteForce
+	info.FileCache = fileCache
+	info.FileRejects = fileRejects
+	info.SSE = sse
+	info.WebSocket = webSocket
+	info.LogReverts = logReverts
+
 	info.LastLog = log.GetLastLog()
 
 	for _, ep := range info.Endpoints {
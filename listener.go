@@ -5,7 +5,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,6 +17,7 @@ import (
 	"github.com/alrusov/log"
 	"github.com/alrusov/misc"
 	"github.com/alrusov/panic"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -35,6 +38,33 @@ type (
 		info               *InfoBlock
 		extraRootItemFuncs []ExtraRootItemFunc
 		removedPaths       misc.BoolMap
+		acme               *autocert.Manager
+		acmeCfg            *ACMEConfig
+		acmeSrv            *http.Server
+		cors               CORSConfig
+		corsKeys           misc.BoolMap
+		secHeaders         *SecurityHeadersConfig
+		secHeadersKeys     misc.BoolMap
+		sessions           *SessionManager
+		formLogin          bool
+		audit              *auditLog
+		authz              *authz
+		bruteForce         *bruteForce
+		requestID          *requestIDcfg
+		trustedProxies     []*net.IPNet
+		tracer             *Tracer
+		panics             *panics
+		timeouts           *timeouts
+		fileServer         *fileServer
+		fileRoot           *os.Root
+		mounts             []*fsMount
+		rawBodyEndpoints   misc.BoolMap
+		webdav             *webDAV
+		sseBrokers         map[string]*SSEBroker
+		webSockets         *webSockets
+		logViewer          *logViewer
+		logViewerOnce      sync.Once
+		logLevelReverts    logLevelReverts
 	}
 
 	// Handler --
@@ -59,6 +89,9 @@ type (
 
 const (
 	CtxIdentity = ContextKey("identity")
+
+	// the longer body is truncated in the TRACE4 log
+	maxTraceBodySize = 64 << 10
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -91,6 +124,7 @@ func NewListenerEx(listenerCfg *config.Listener, handler HandlerEx) (*HTTP, erro
 		info:              &InfoBlock{},
 		connectionID:      0,
 		removedPaths:      make(misc.BoolMap),
+		audit:             newAuditLog(0),
 	}
 
 	for path := range listenerCfg.Auth.Endpoints {
@@ -111,6 +145,9 @@ func NewListenerEx(listenerCfg *config.Listener, handler HandlerEx) (*HTTP, erro
 
 	h.initInfo()
 
+	// streaming
+	h.SetEndpointTimeout(logViewerStreamPath, 0)
+
 	Log.Message(log.INFO, `Listener created on "%s"`, addr)
 
 	return h, nil
@@ -123,9 +160,13 @@ func (h *HTTP) Start() error {
 	var err error
 	cert := strings.TrimSpace(h.listenerCfg.SSLCombinedPem)
 
-	if cert == "" {
+	switch {
+	case h.acme != nil:
+		h.startACME()
+		err = h.srv.ListenAndServeTLS("", "")
+	case cert == "":
 		err = h.srv.ListenAndServe()
-	} else {
+	default:
 		err = h.srv.ListenAndServeTLS(cert, cert)
 	}
 
@@ -145,6 +186,22 @@ func (h *HTTP) Stop() error {
 
 // Close --
 func (h *HTTP) Close() error {
+	if h.acmeSrv != nil {
+		h.acmeSrv.Close()
+	}
+
+	h.replaceTracer(nil)
+
+	h.closeLogLevelReverts()
+	h.closeSSEBrokers()
+	h.closeWebSockets()
+
+	h.closeFileRoot()
+
+	if h.webdav != nil {
+		h.webdav.fs.root.Close()
+	}
+
 	return h.srv.Close()
 }
 
@@ -176,7 +233,7 @@ func (h *HTTP) AddHandlerEx(handler HandlerEx, toHead bool) {
 
 // AddAuthHandler --
 func (h *HTTP) AddAuthHandler(ah auth.Handler) (err error) {
-	return h.authHandlers.Add(ah)
+	return h.authHandlers.Add(rejectingAuthHandler{Handler: ah})
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -217,18 +274,55 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	id := atomic.AddUint64(&h.connectionID, 1)
 
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP == "" {
-		realIP = r.Header.Get("X-Forwarded-For")
-		if realIP == "" {
-			realIP = r.RemoteAddr
+	rr := NewResponseRecorder(w)
+	w = rr
+	r = AddValueToRequestContext(r, CtxResponseRecorder, rr)
+
+	realIP := GetClientIP(r)
+
+	rid, r := h.assignRequestID(w, r)
+
+	r, span := h.startServerSpan(r, rid)
+	defer finishServerSpan(span, rr)
+
+	path := ""
+	processed := true
+
+	// registered before recoverPanic to see the reply of the recovered panic
+	defer func() {
+		if !processed {
+			path = url404
 		}
+		status := rr.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		Log.Message(log.DEBUG, `[%d] Sent: %d, %d bytes, first byte in %s`, id, status, rr.Bytes(), rr.FirstByte())
+		go h.info.Runtime.Requests.add(status, rr.Bytes())
+		go h.updateEndpointStat(path, status, rr.Bytes())
+		misc.LogProcessingTime(Log.Name(), "", id, "listener", "", t0)
+	}()
+
+	defer h.recoverPanic(id, panicID, &path, rr, &r)
+
+	Log.SecuredMessage(log.DEBUG, logReplaceRequest, `[%d] New %s request "%s" from %s {%s}`, id, r.Method, r.RequestURI, realIP, rid)
+
+	path = r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	path = misc.NormalizeSlashes(path)
+
+	prefix, path := h.GetPrefix(path, r)
+
+	if path == "" {
+		path = "/"
 	}
 
-	Log.SecuredMessage(log.DEBUG, logReplaceRequest, `[%d] New %s request "%s" from %s`, id, r.Method, r.RequestURI, realIP)
+	rawBody := h.isRawBodyEndpoint(path)
 
 	var err error
-	r.Body, err = BodyReader(r.Header, r.Body)
+	r.Body, err = newBodyReader(r.Header, r.Body, rawBody)
 	if err != nil {
 		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
 		return
@@ -237,9 +331,7 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if Log.CurrentLogLevel() >= log.TRACE3 {
 		Log.Message(log.TRACE3, `[%d] Header: %v`, id, r.Header)
 		if Log.CurrentLogLevel() >= log.TRACE4 {
-			bb, _ := io.ReadAll(r.Body)
-			Log.Message(log.TRACE4, `[%d] Body: %q`, id, bb)
-			r.Body = io.NopCloser(bytes.NewBuffer(bb))
+			h.traceBody(id, path, rawBody, r)
 		}
 	}
 
@@ -248,79 +340,169 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	processed := true
+	r = h.applySecurityHeaders(path, w, r)
 
-	path := r.URL.RawPath
-	if path == "" {
-		path = r.URL.Path
+	_, exists := isPathInList(path, h.listenerCfg.DisabledEndpoints)
+	if exists {
+		Error(id, false, w, r, http.StatusLocked, `Endpoint "`+path+`" is disabled`, nil)
+		return
 	}
-	path = misc.NormalizeSlashes(path)
 
-	prefix, path := h.GetPrefix(path, r)
+	if h.applyCORS(id, path, w, r) {
+		return
+	}
 
-	if path == "" {
-		path = "/"
+	if sm := h.Sessions(); sm != nil {
+		r = sm.load(id, prefix, w, r)
 	}
 
-	defer func() {
-		if !processed {
-			path = url404
-		}
-		go h.info.Runtime.Requests.inc()
-		go h.updateEndpointStat(path)
-		misc.LogProcessingTime(Log.Name(), "", id, "listener", "", t0)
-	}()
+	r, ok := h.authenticate(id, prefix, path, w, r)
+	if !ok {
+		return
+	}
 
-	_, exists := isPathInList(path, h.listenerCfg.DisabledEndpoints)
-	if exists {
-		Error(id, false, w, r, http.StatusLocked, `Endpoint "`+path+`" is disabled`, nil)
+	if !h.authorizeEndpoint(id, path, w, r) {
 		return
 	}
 
-	authPath, exists := isPathInList(path, h.authEndpointsKeys)
-	if exists && len(h.listenerCfg.Auth.Endpoints[authPath]) != 0 {
-		identity, code, msg := h.authHandlers.Check(id, prefix, path, h.listenerCfg.Auth.Endpoints[authPath], w, r)
-		if identity == nil && code != 0 {
-			if len(w.Header()) == 0 {
-				h.authHandlers.WriteAuthRequestHeaders(w, prefix, path)
-				Error(id, false, w, r, code, msg, nil)
-			}
-			return
-		}
+	r, dispatchSpan := StartRequestSpan(r, "dispatch")
+	defer dispatchSpan.Finish()
 
-		if identity != nil {
-			Log.Message(log.DEBUG, `[%d] User "%s" logged in (%s)`, id, identity.User, identity.Method)
-			r = AddValueToRequestContext(r, CtxIdentity, identity)
-		}
+	var basePath string
+	processed, basePath = h.dispatchTimed(id, panicID, prefix, path, w, r)
+	if processed {
+		path = basePath
+		span.SetAttribute("http.route", path)
+		return
+	}
+
+	span.SetStatus(SpanStatusError, "not found")
+	Error(id, false, w, r, http.StatusNotFound, fmt.Sprintf(`Invalid endpoint "%s"`, path), nil)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// traceBody -- the beginning of the body only, streamed bodies (uploads, binary data, endpoints without the timeout) are not read at all
+func (h *HTTP) traceBody(id uint64, path string, rawBody bool, r *http.Request) {
+	ct := r.Header.Get("Content-Type")
+	if rawBody || isBinaryContent(ct) || strings.HasPrefix(strings.ToLower(ct), "multipart/") || h.timeoutExempt(path) {
+		Log.Message(log.TRACE4, `[%d] Body: not logged (%s)`, id, ct)
+		return
+	}
+
+	bb, _ := io.ReadAll(io.LimitReader(r.Body, maxTraceBodySize+1))
+	r.Body = &struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(bb), r.Body),
+		Closer: r.Body,
 	}
 
+	if len(bb) > maxTraceBodySize {
+		Log.Message(log.TRACE4, `[%d] Body: %q...`, id, bb[:maxTraceBodySize])
+		return
+	}
+
+	Log.Message(log.TRACE4, `[%d] Body: %q`, id, bb)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// dispatch -- embedded endpoints, handlers and files
+func (h *HTTP) dispatch(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (processed bool, basePath string) {
 	if !h.IsPathReplaced(path) {
 		if h.Embedded(id, prefix, path, w, r) {
-			return
+			return true, path
 		}
 
 		if h.profiler(id, prefix, path, w, r) {
-			return
+			return true, path
 		}
 	}
 
 	for _, handler := range h.handlers {
-		var basePath string
 		processed, basePath = handler.Handler(id, prefix, path, w, r)
 		if processed {
-			if basePath != "" {
-				path = basePath
+			if basePath == "" {
+				basePath = path
 			}
 			return
 		}
 	}
 
 	if h.File(id, prefix, path, w, r) {
-		return
+		return true, path
 	}
 
-	processed = false
-	Error(id, false, w, r, http.StatusNotFound, fmt.Sprintf(`Invalid endpoint "%s"`, path), nil)
+	return false, path
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// authenticate -- checks credentials for the protected endpoints. Returns false if the reply has already been sent
+func (h *HTTP) authenticate(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (newR *http.Request, ok bool) {
+	authPath, exists := isPathInList(path, h.authEndpointsKeys)
+	if !exists || len(h.listenerCfg.Auth.Endpoints[authPath]) == 0 || h.isAuthFree(path) {
+		return r, true
+	}
+
+	_, span := StartSpan(r.Context(), "auth", SpanKindInternal)
+	defer span.Finish()
+
+	var identity *auth.Identity
+	var code int
+	var msg string
+	rejected := false
+
+	user, _, _ := r.BasicAuth()
+	if !h.checkLockout(id, user, w, r) {
+		return r, false
+	}
+
+	// headers added by the auth handler mean it has already replied
+	headersCount := len(w.Header())
+
+	if si := h.sessionIdentity(r); si != nil {
+		identity = si
+		if !CheckPermissions(identity, h.listenerCfg.Auth.Endpoints[authPath]) {
+			identity, code, msg = nil, http.StatusForbidden, "Forbidden"
+		}
+		// the cookie is sent by the browser automatically, CheckCSRF needs it
+		r = AddValueToRequestContext(r, ctxSessionAuth, true)
+	} else {
+		identity, code, msg = h.authHandlers.Check(id, prefix, path, h.listenerCfg.Auth.Endpoints[authPath], w, AddValueToRequestContext(r, ctxAuthRejected, &rejected))
+	}
+
+	if code == http.StatusUnauthorized && (r.Header.Get(auth.Header) != "" || rejected) {
+		// credentials were presented
+		h.authFailed(id, user, r)
+	}
+
+	if code != 0 {
+		span.SetStatus(SpanStatusError, msg)
+
+		if code == http.StatusUnauthorized && h.formLogin && wantsHTML(r) {
+			h.redirectToLogin(prefix, w, r)
+			return r, false
+		}
+
+		if len(w.Header()) == headersCount {
+			h.authHandlers.WriteAuthRequestHeaders(w, prefix, path)
+			Error(id, false, w, r, code, msg, nil)
+		}
+		return r, false
+	}
+
+	if identity != nil {
+		h.authSucceeded(identity.User, r)
+		span.SetAttribute("enduser.id", identity.User)
+		span.SetAttribute("auth.method", identity.Method)
+		Log.Message(log.DEBUG, `[%d] User "%s" logged in (%s)`, id, identity.User, identity.Method)
+		r = AddValueToRequestContext(r, CtxIdentity, identity)
+	}
+
+	return r, true
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -451,6 +633,21 @@ func GetIdentityFromRequestContext(r *http.Request) (identity *auth.Identity, er
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// GetClientIP --
+func GetClientIP(r *http.Request) (ip string) {
+	ip = r.Header.Get("X-Real-IP")
+	if ip == "" {
+		ip = r.Header.Get("X-Forwarded-For")
+		if ip == "" {
+			ip = r.RemoteAddr
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func (h *HTTP) GetPrefix(path string, r *http.Request) (prefix string, newPath string) {
 	proxyPrefix := misc.NormalizeSlashes(h.GetPrefixFromHeader(r) + h.listenerCfg.ProxyPrefix)
 
@@ -0,0 +1,318 @@
+package stdhttp
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alrusov/auth"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	loginPath  = "/maintenance/login"
+	logoutPath = "/maintenance/logout"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// EnableFormLogin -- browsers are redirected to the login page instead of getting 401.
+// The memory session manager is created if no one was set before
+func (h *HTTP) EnableFormLogin() (err error) {
+	h.Lock()
+	if h.sessions == nil {
+		h.sessions, err = NewSessionManager(&SessionConfig{})
+	}
+	h.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	h.formLogin = true
+
+	h.AddEndpointsInfo(misc.StringMap{
+		loginPath: "Login page (back=<path>)",
+	})
+	h.AddPostEndpointsInfo(misc.StringMap{
+		logoutPath: "Logout",
+	})
+
+	return
+}
+
+// isAuthFree -- paths that must be available without authentication
+func (h *HTTP) isAuthFree(path string) bool {
+	if h.isACMEChallenge(path) {
+		return true
+	}
+
+	if !h.formLogin {
+		return false
+	}
+
+	switch path {
+	case loginPath, "/___.css", "/favicon.ico":
+		return true
+	}
+
+	return false
+}
+
+// sessionIdentity -- identity of the user logged in using the login page
+func (h *HTTP) sessionIdentity(r *http.Request) *auth.Identity {
+	if !h.formLogin {
+		return nil
+	}
+
+	s, _ := GetSessionFromRequestContext(r)
+	if s == nil {
+		return nil
+	}
+
+	return s.GetIdentity()
+}
+
+func wantsHTML(r *http.Request) bool {
+	return (r.Method == MethodGET || r.Method == MethodHEAD) && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// redirectToLogin --
+func (h *HTTP) redirectToLogin(prefix string, w http.ResponseWriter, r *http.Request) {
+	q := url.Values{}
+	q.Set("back", r.URL.RequestURI())
+
+	w.Header().Set("Location", prefix+loginPath+"?"+q.Encode())
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// safeBackPath -- only local paths are allowed to avoid open redirects.
+// Browsers drop the control characters and treat the backslash as the slash, so "/\t/host" and "/\\host" are the other host
+func safeBackPath(back string, prefix string) string {
+	def := prefix + "/maintenance"
+
+	back = strings.Map(
+		func(c rune) rune {
+			if c < 0x20 || c == 0x7f {
+				return -1
+			}
+			return c
+		},
+		back,
+	)
+
+	if back == "" || strings.ContainsRune(back, '\\') {
+		return def
+	}
+
+	u, err := url.Parse(back)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return def
+	}
+
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(u.Path, "//") {
+		return def
+	}
+
+	return back
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// checkCredentials -- tries configured auth handlers with the basic auth header, then the standard identity providers
+func (h *HTTP) checkCredentials(id uint64, prefix string, path string, user string, password string, r *http.Request) (identity *auth.Identity, code int, msg string) {
+	permissions := misc.BoolMap{"*": true}
+	authPath, exists := isPathInList(path, h.authEndpointsKeys)
+	if exists && len(h.listenerCfg.Auth.Endpoints[authPath]) != 0 {
+		permissions = h.listenerCfg.Auth.Endpoints[authPath]
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.Header = make(http.Header)
+	r2.SetBasicAuth(user, password)
+
+	identity, code, msg = h.authHandlers.Check(id, prefix, path, permissions, &BlackHole{}, r2)
+	if identity != nil || (code != 0 && code != http.StatusUnauthorized) {
+		if identity != nil && !CheckPermissions(identity, permissions) {
+			return nil, http.StatusForbidden, "Forbidden"
+		}
+		return
+	}
+
+	identity, _, err := auth.StdCheckUser(user, password, false)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err.Error()
+	}
+
+	if identity == nil {
+		return nil, http.StatusUnauthorized, "Invalid user name or password"
+	}
+
+	identity.Method = "form"
+
+	if !CheckPermissions(identity, permissions) {
+		return nil, http.StatusForbidden, "Forbidden"
+	}
+
+	return identity, 0, ""
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) login(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	if !h.formLogin {
+		Error(id, false, w, r, http.StatusNotFound, `Invalid endpoint "`+path+`"`, nil)
+		return
+	}
+
+	back := safeBackPath(r.FormValue("back"), prefix)
+
+	if r.Method != MethodPOST {
+		h.loginPage(id, prefix, back, "", http.StatusOK, w, r)
+		return
+	}
+
+	if !CSRFProtected(id, w, r) {
+		return
+	}
+
+	user := r.PostFormValue("user")
+	if !h.checkLockout(id, user, w, r) {
+		return
+	}
+
+	backPath := back
+	if u, err := url.Parse(back); err == nil {
+		backPath = u.Path
+	}
+	_, backPath = h.GetPrefix(backPath, r)
+
+	identity, code, msg := h.checkCredentials(id, prefix, backPath, user, r.PostFormValue("password"), r)
+	if identity == nil {
+		if code == 0 {
+			code = http.StatusUnauthorized
+		}
+		Log.Message(log.INFO, `[%d] Login failed for "%s": %s`, id, user, msg)
+		if code == http.StatusUnauthorized {
+			h.authFailed(id, user, r)
+		}
+		h.AuditEvent(&AuditEvent{
+			RequestID: id,
+			User:      user,
+			IP:        h.ClientAddr(r),
+			Action:    "login",
+			Outcome:   AuditOutcomeError,
+			Error:     msg,
+		})
+		h.loginPage(id, prefix, back, msg, code, w, r)
+		return
+	}
+
+	h.authSucceeded(user, r)
+
+	sm := h.Sessions()
+
+	s, r, err := sm.Start(w, r, prefix)
+	if err == nil {
+		s.SetIdentity(identity)
+		err = sm.Rotate(w, r, prefix, s)
+	}
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, "Session error", err)
+		return
+	}
+
+	Log.Message(log.INFO, `[%d] User "%s" logged in using the login page (%s)`, id, identity.User, identity.Method)
+	h.AuditEvent(&AuditEvent{
+		RequestID:  id,
+		User:       identity.User,
+		AuthMethod: identity.Method,
+		IP:         h.ClientAddr(r),
+		Action:     "login",
+	})
+
+	w.Header().Set("Location", back)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func (h *HTTP) loginPage(id uint64, prefix string, back string, errMsg string, status int, w http.ResponseWriter, r *http.Request) {
+	params := struct {
+		Prefix string
+		Nonce  string
+		CSRF   string
+		Name   string
+		ErrMsg string
+		Back   string
+	}{
+		Prefix: prefix,
+		Nonce:  GetCSPNonce(r),
+		CSRF:   CSRFToken(w, r, prefix),
+		Name:   "Login",
+		ErrMsg: errMsg,
+		Back:   back,
+	}
+
+	if params.ErrMsg == "" {
+		params.ErrMsg = r.URL.Query().Get("___err")
+	}
+
+	buf := new(bytes.Buffer)
+
+	t, err := template.New("login").Parse(loginPage)
+	if err == nil {
+		err = t.Execute(buf, params)
+	}
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	err = WriteReply(w, r, status, ContentTypeHTML, nil, buf.Bytes())
+	if err != nil {
+		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) logout(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	if !h.formLogin {
+		Error(id, false, w, r, http.StatusNotFound, `Invalid endpoint "`+path+`"`, nil)
+		return
+	}
+
+	if !CSRFProtected(id, w, r) {
+		return
+	}
+
+	s, _ := GetSessionFromRequestContext(r)
+	if s != nil {
+		if identity := s.GetIdentity(); identity != nil {
+			Log.Message(log.INFO, `[%d] User "%s" logged out`, id, identity.User)
+			h.AuditEvent(&AuditEvent{
+				RequestID:  id,
+				User:       identity.User,
+				AuthMethod: identity.Method,
+				IP:         h.ClientAddr(r),
+				Action:     "logout",
+			})
+		}
+	}
+
+	err := h.Sessions().Destroy(w, r, prefix, s)
+	if err != nil {
+		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+	}
+
+	w.Header().Set("Location", prefix+loginPath)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
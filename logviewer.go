@@ -0,0 +1,375 @@
+package stdhttp
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// logViewer -- tails the log (the file or the last log buffer if the file is not used) into the SSE broker
+	logViewer struct {
+		broker   *SSEBroker
+		fileName string
+		offset   int64
+		rest     []byte
+		seed     misc.BoolMap // lines already published from the last log buffer
+		last     []string
+	}
+
+	logEntry struct {
+		level    log.Level
+		facility string
+	}
+)
+
+const (
+	logViewerBroker     = "log"
+	logViewerHistory    = 1000
+	logViewerPoll       = 500 * time.Millisecond
+	logViewerMaxChunk   = 1 << 20
+	logViewerStreamPath = "/maintenance/log/stream"
+)
+
+var (
+	// [pid] LV date time <facility> message
+	logLineRE = regexp.MustCompile(`^\[\d+\] (\S+) \S+ \S+(?: <([^>]*)>)?`)
+
+	logLevelsByShortName = func() map[string]log.Level {
+		m := make(map[string]log.Level)
+		for level := log.EMERG; level < log.UNKNOWN; level++ {
+			short, _ := log.GetLogLevelName(level)
+			m[short] = level
+		}
+		return m
+	}()
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// getLogViewer -- the tailer is started on the first use and works until the listener is closed
+func (h *HTTP) getLogViewer() *logViewer {
+	h.logViewerOnce.Do(func() {
+		v := &logViewer{
+			broker: h.NewSSEBroker(logViewerBroker, &SSEConfig{BufferSize: logViewerHistory}),
+		}
+
+		v.init()
+		h.logViewer = v
+
+		go v.run()
+	})
+
+	return h.logViewer
+}
+
+func (v *logViewer) init() {
+	v.last = log.GetLastLog()
+	v.publish(v.last)
+
+	v.fileName = log.FileName()
+	if v.fileName == "" {
+		return
+	}
+
+	if fi, err := os.Stat(v.fileName); err == nil {
+		v.offset = fi.Size()
+	}
+
+	// buffered lines are written to the file later
+	v.seed = make(misc.BoolMap, len(v.last))
+	for _, s := range v.last {
+		v.seed[s] = true
+	}
+}
+
+func (v *logViewer) run() {
+	ticker := time.NewTicker(logViewerPoll)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if v.broker.isClosed() {
+			return
+		}
+
+		if log.FileName() == "" {
+			v.pollLastLog()
+		} else {
+			v.pollFile()
+		}
+	}
+}
+
+// pollLastLog -- the new lines are after the longest tail of the previous snapshot found at the beginning of the current one
+func (v *logViewer) pollLastLog() {
+	cur := log.GetLastLog()
+	prev := v.last
+	v.last = cur
+
+	start := 0
+
+outer:
+	for k := min(len(prev), len(cur)); k > 0; k-- {
+		tail := prev[len(prev)-k:]
+		for i := range k {
+			if tail[i] != cur[i] {
+				continue outer
+			}
+		}
+		start = k
+		break
+	}
+
+	v.publish(cur[start:])
+}
+
+func (v *logViewer) pollFile() {
+	name := log.FileName()
+	if name != v.fileName {
+		// the next day file
+		v.fileName = name
+		v.offset = 0
+		v.rest = nil
+	}
+
+	fd, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return
+	}
+
+	size := fi.Size()
+	if size < v.offset {
+		// truncated
+		v.offset = 0
+		v.rest = nil
+	}
+
+	if size == v.offset {
+		return
+	}
+
+	if size-v.offset > logViewerMaxChunk {
+		// too much at once, the oldest part is skipped
+		v.offset = size - logViewerMaxChunk
+		v.rest = nil
+	}
+
+	data := make([]byte, size-v.offset)
+	n, err := fd.ReadAt(data, v.offset)
+	if err != nil && err != io.EOF {
+		return
+	}
+	v.offset += int64(n)
+
+	data = append(v.rest, data[:n]...)
+	v.rest = nil
+
+	i := bytes.LastIndexByte(data, '\n')
+	if i < 0 {
+		v.rest = data
+		return
+	}
+	v.rest = append([]byte(nil), data[i+1:]...)
+
+	lines := strings.Split(strings.TrimRight(string(data[:i]), "\r\n"), "\n")
+	list := make([]string, 0, len(lines))
+	for _, s := range lines {
+		s = strings.TrimRight(s, "\r")
+		if v.seed != nil && v.seed[strings.TrimSpace(s)] {
+			delete(v.seed, strings.TrimSpace(s))
+			continue
+		}
+		list = append(list, s)
+	}
+	v.seed = nil
+
+	v.publish(list)
+}
+
+// publish -- the lines without the header are continuation of the previous message
+func (v *logViewer) publish(lines []string) {
+	var msg []string
+
+	flush := func() {
+		if len(msg) > 0 {
+			v.broker.Publish("", "", strings.Join(msg, "\n"))
+			msg = msg[:0]
+		}
+	}
+
+	for _, s := range lines {
+		if s == "" {
+			continue
+		}
+		if logLineRE.MatchString(s) {
+			flush()
+		}
+		msg = append(msg, s)
+	}
+
+	flush()
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func parseLogEntry(s string) (e logEntry, ok bool) {
+	m := logLineRE.FindStringSubmatch(s)
+	if m == nil {
+		return logEntry{level: log.UNKNOWN}, false
+	}
+
+	e.level, ok = logLevelsByShortName[m[1]]
+	if !ok {
+		e.level = log.UNKNOWN
+	}
+	e.facility = m[2]
+
+	return e, true
+}
+
+// logFilter -- facility (if present, "" -- the default one), level (the entries with this and more important levels), text (case insensitive)
+func logFilter(r *http.Request) SSEFilter {
+	q := r.URL.Query()
+
+	facility, useFacility := "", q.Has("facility")
+	if useFacility {
+		facility = q.Get("facility")
+	}
+
+	maxLevel := log.UNKNOWN
+	if name := q.Get("level"); name != "" {
+		if level, ok := log.Str2Level(name); ok {
+			maxLevel = level
+		}
+	}
+
+	text := strings.ToLower(q.Get("text"))
+
+	if !useFacility && maxLevel == log.UNKNOWN && text == "" {
+		return nil
+	}
+
+	return func(ev *SSEEvent) bool {
+		e, ok := parseLogEntry(ev.Data)
+
+		if useFacility && (!ok || e.facility != facility) {
+			return false
+		}
+
+		if maxLevel != log.UNKNOWN && (!ok || e.level > maxLevel) {
+			return false
+		}
+
+		return text == "" || strings.Contains(strings.ToLower(ev.Data), text)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) showLog(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	facilities := make([]string, 0, 16)
+	for name := range log.CurrentLogLevelNamesOfAll() {
+		facilities = append(facilities, name)
+	}
+	sort.Strings(facilities)
+
+	params := struct {
+		Prefix     string
+		Nonce      string
+		Name       string
+		ErrMsg     string
+		Facilities []string
+		Levels     []string
+		LogFile    string
+	}{
+		Prefix:     prefix,
+		Nonce:      GetCSPNonce(r),
+		Name:       "Log",
+		ErrMsg:     r.URL.Query().Get("___err"),
+		Facilities: facilities,
+		Levels:     log.GetLogLevels(),
+		LogFile:    filepath.Base(log.FileName()),
+	}
+
+	if params.LogFile == "." {
+		params.LogFile = ""
+	}
+
+	tp, err := template.New("log").Parse(logPage)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = tp.Execute(buf, params)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	err = WriteReply(w, r, http.StatusOK, ContentTypeHTML, nil, buf.Bytes())
+	if err != nil {
+		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+	}
+}
+
+func (h *HTTP) streamLog(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		Error(id, false, w, r, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		return
+	}
+
+	h.getLogViewer().broker.ServeFiltered(id, w, r, logFilter(r))
+}
+
+func (h *HTTP) downloadLog(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	name := log.FileName()
+	if name == "" {
+		Error(id, false, w, r, http.StatusNotFound, "Log file is not used", nil)
+		return
+	}
+
+	fd, err := os.Open(name)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, "Log file is not available", err)
+		return
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, "Log file is not available", err)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", contentTypes[ContentTypeText])
+	hdr.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name)}))
+	hdr.Set(HTTPheaderCacheControl, "no-cache")
+
+	http.ServeContent(w, r, "", fi.ModTime(), fd)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -46,9 +46,13 @@ func (d dblStrArray) Swap(i, j int) {
 
 func (h *HTTP) maintenance(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
 	cfg := config.GetCommon()
+	tracer := h.Tracer()
+	panics := h.getPanics()
 
 	params := struct {
 		Prefix          string
+		Nonce           string
+		CSRF            string
 		HeaderPrefix    string
 		ThisPath        string
 		Copyright       string
@@ -60,12 +64,21 @@ func (h *HTTP) maintenance(id uint64, prefix string, path string, w http.Respons
 		CurrentLogLevel string
 		LogLevelNames   []string
 		LogLevels       dblStrArray
+		LogReverts      []*LogLevelRevert
+		RevertDurations []string
 		ProfilerEnabled bool
+		User            string
+		FormLogin       bool
+		BruteForce      bool
+		Tracing         bool
+		Panics          bool
 		Extra           []template.HTML
 		LightOpen       template.HTML
 		LightClose      template.HTML
 	}{
 		Prefix:          prefix,
+		Nonce:           GetCSPNonce(r),
+		CSRF:            CSRFToken(w, r, prefix),
 		HeaderPrefix:    h.GetPrefixFromHeader(r),
 		ThisPath:        r.URL.Path,
 		Copyright:       misc.Copyright(),
@@ -76,10 +89,20 @@ func (h *HTTP) maintenance(id uint64, prefix string, path string, w http.Respons
 		Tags:            misc.AppTags(),
 		LogLevelNames:   log.GetLogLevels(),
 		ProfilerEnabled: h.commonConfig.ProfilerEnabled,
+		FormLogin:       h.formLogin,
+		BruteForce:      h.getBruteForce() != nil,
+		Tracing:         tracer != nil && tracer.memory != nil,
+		Panics:          panics != nil && panics.cfg.Keep > 0,
+		LogReverts:      h.LogLevelReverts(),
+		RevertDurations: []string{"5m", "15m", "1h", "4h", "1d"},
 	}
 	_, _, params.CurrentLogLevel = log.CurrentLogLevelEx()
 	params.LightOpen, params.LightClose = h.MenuHighlight()
 
+	if identity, _ := GetIdentityFromRequestContext(r); identity != nil {
+		params.User = identity.User
+	}
+
 	for _, f := range h.extraRootItemFuncs {
 		for _, t := range f(prefix) {
 			params.Extra = append(params.Extra, template.HTML(t))
@@ -8,7 +8,7 @@ var (
 	<head>
 		<title>{{$.Name}}</title>
 		<meta charset="UTF-8" />
-		<link rel="stylesheet" href="{{$.Prefix}}/___.css" />
+		<link rel="stylesheet" href="{{$.Prefix}}/___.css"{{if $.Nonce}} nonce="{{$.Nonce}}"{{end}} />
 	</head>
 
 	<body>
@@ -22,6 +22,18 @@ var (
 		<img src="{{$.HeaderPrefix}}/favicon.ico" style="width: 64px; height: 64px;" alt="" />
 		<h4 style="margin: 10px 0px;"><em>{{$.Name}} [{{$.App}} {{$.Version}}{{if $.Tags}}&nbsp;{{$.Tags}}{{end}}]</em></h4>
 
+		{{if $.User}}
+			<p>
+				Logged in as <strong>{{$.User}}</strong>
+				{{if $.FormLogin}}
+					<form class="inline" method="post" action="{{$.Prefix}}/maintenance/logout">
+						<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+						<button type="submit" class="link">logout</button>
+					</form>
+				{{end}}
+			</p>
+		{{end}}
+
 		{{if $.ErrMsg}}<p><strong class="attention">{{$.ErrMsg}}</strong></p>{{end}}
 
 		<h6>Logging levels</h6>
@@ -33,29 +45,104 @@ var (
 				</th>
 				{{range $_, $LevelName := $.LogLevelNames}}
 					<td>
-						<a href="{{$.Prefix}}/maintenance/set-log-level?facility={{index $CurrentLogLevel 0}}&amp;level={{$LevelName}}">
-							{{if eq $LevelName (index $CurrentLogLevel 1)}}{{$.LightOpen}}{{end}}
-							{{$LevelName}}
-							{{if eq $LevelName (index $CurrentLogLevel 1)}}{{$.LightClose}}{{end}}
-						</a>
+						<form class="inline" method="post" action="{{$.Prefix}}/maintenance/set-log-level">
+							<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+							<input type="hidden" name="facility" value="{{index $CurrentLogLevel 0}}" />
+							<input type="hidden" name="level" value="{{$LevelName}}" />
+							<button type="submit" class="link">
+								{{if eq $LevelName (index $CurrentLogLevel 1)}}{{$.LightOpen}}{{end}}
+								{{$LevelName}}
+								{{if eq $LevelName (index $CurrentLogLevel 1)}}{{$.LightClose}}{{end}}
+							</button>
+						</form>
 					</td>
 				{{end}}
 			</tr>
 		{{end}}
 		</table>
 
+		<form method="post" action="{{$.Prefix}}/maintenance/set-log-level" style="margin-top: 5px;">
+			<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+			<label for="tmp-facility">Set</label>
+			<select id="tmp-facility" name="facility">
+				{{range $_, $CurrentLogLevel := $.LogLevels}}
+					<option value="{{index $CurrentLogLevel 0}}">{{if index $CurrentLogLevel 0}}{{index $CurrentLogLevel 0}}{{else}}default{{end}}</option>
+				{{end}}
+			</select>
+			<label for="tmp-level">to</label>
+			<select id="tmp-level" name="level">
+				{{range $_, $LevelName := $.LogLevelNames}}
+					<option value="{{$LevelName}}">{{$LevelName}}</option>
+				{{end}}
+			</select>
+			<label for="tmp-duration">for</label>
+			<select id="tmp-duration" name="duration">
+				{{range $_, $d := $.RevertDurations}}
+					<option value="{{$d}}">{{$d}}</option>
+				{{end}}
+			</select>
+			<button type="submit" class="link">set temporarily</button>
+		</form>
+
+		{{if $.LogReverts}}
+			<h6>Pending log level reverts</h6>
+			<table class="grd">
+				<tr><th>Facility</th><th>Temporary level</th><th>Revert to</th><th>At</th><th>By</th><th></th></tr>
+				{{range $_, $rv := $.LogReverts}}
+					<tr>
+						<td>{{if $rv.Facility}}{{$rv.Facility}}{{else}}default{{end}}</td>
+						<td>{{$rv.Level}}</td>
+						<td>{{$rv.RevertTo}}</td>
+						<td class="nobr">{{$rv.At.Format "2006-01-02 15:04:05"}}</td>
+						<td>{{$rv.User}}</td>
+						<td>
+							<form class="inline" method="post" action="{{$.Prefix}}/maintenance/set-log-level">
+								<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+								<input type="hidden" name="facility" value="{{$rv.Facility}}" />
+								<input type="hidden" name="level" value="{{$rv.RevertTo}}" />
+								<button type="submit" class="link">revert now</button>
+							</form>
+						</td>
+					</tr>
+				{{end}}
+			</table>
+		{{end}}
+
 		<h6>Miscellaneous</h6>
 		<ul>
 			<li><a href="{{$.Prefix}}/maintenance/info" target="info">Application info [json]</a></li>
 			<li><a href="{{$.Prefix}}/maintenance/config" target="config">Prepared config [text]</a></li>
 			<li><a href="{{$.Prefix}}/maintenance/endpoints" target="endpoints">Known endpoints</a></li>
+			<li><a href="{{$.Prefix}}/maintenance/audit" target="audit">Audit log</a></li>
+			<li><a href="{{$.Prefix}}/maintenance/log" target="log">Live log</a></li>
+			{{if $.BruteForce}}
+				<li><a href="{{$.Prefix}}/maintenance/lockouts" target="lockouts">Authentication failures and lockouts</a></li>
+			{{end}}
+			{{if $.Tracing}}
+				<li><a href="{{$.Prefix}}/maintenance/traces" target="traces">Recent traces</a></li>
+			{{end}}
+			{{if $.Panics}}
+				<li><a href="{{$.Prefix}}/maintenance/panics" target="panics">Recent panics</a></li>
+			{{end}}
 			<li>Profiler is
-				<a href="{{$.Prefix}}/maintenance/profiler-enable">{{if $.ProfilerEnabled}}{{$.LightOpen}}{{end}}ENABLED{{if $.ProfilerEnabled}}{{$.LightClose}}{{end}}</a>
-				<a href="{{$.Prefix}}/maintenance/profiler-disable">{{if not $.ProfilerEnabled}}{{$.LightOpen}}{{end}}DISABLED{{if not $.ProfilerEnabled}}{{$.LightClose}}{{end}}</a>
+				<form class="inline" method="post" action="{{$.Prefix}}/maintenance/profiler-enable">
+					<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+					<button type="submit" class="link">{{if $.ProfilerEnabled}}{{$.LightOpen}}{{end}}ENABLED{{if $.ProfilerEnabled}}{{$.LightClose}}{{end}}</button>
+				</form>
+				<form class="inline" method="post" action="{{$.Prefix}}/maintenance/profiler-disable">
+					<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+					<button type="submit" class="link">{{if not $.ProfilerEnabled}}{{$.LightOpen}}{{end}}DISABLED{{if not $.ProfilerEnabled}}{{$.LightClose}}{{end}}</button>
+				</form>
 			</li>
 			{{if $.ProfilerEnabled}}
 				<li><a href="{{$.Prefix}}/debug/pprof/" target="pprof">Show profiler</a></li>
 			{{end}}
+			<li>
+				<form class="inline" method="post" action="{{$.Prefix}}/debug/free-os-memory">
+					<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+					<button type="submit" class="link">Free OS memory</button>
+				</form>
+			</li>
 			{{range $.Extra}}
 				<li>{{.}}</li>
 			{{end}}
@@ -65,6 +152,278 @@ var (
 		<p class="top"><small><em>{{$.Copyright}}</em></small></p>
 ` + htmlBottom
 
+	loginPage = htmlTop + `
+		<img src="{{$.Prefix}}/favicon.ico" style="width: 64px; height: 64px;" alt="" />
+		<h6>Login</h6>
+
+		{{if $.ErrMsg}}<p><strong class="attention">{{$.ErrMsg}}</strong></p>{{end}}
+
+		<form method="post" action="{{$.Prefix}}/maintenance/login">
+			<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+			<input type="hidden" name="back" value="{{$.Back}}" />
+			<table class="noborder" style="width: 1%;">
+				<tr>
+					<th class="left nobr"><label for="user">User</label></th>
+					<td><input type="text" id="user" name="user" autocomplete="username" autofocus required /></td>
+				</tr>
+				<tr>
+					<th class="left nobr"><label for="password">Password</label></th>
+					<td><input type="password" id="password" name="password" autocomplete="current-password" required /></td>
+				</tr>
+				<tr>
+					<td></td>
+					<td><button type="submit">Login</button></td>
+				</tr>
+			</table>
+		</form>
+` + htmlBottom
+
+	auditPage = htmlTop + `
+		{{if $.ErrMsg}}<p><strong class="attention">{{$.ErrMsg}}</strong></p>{{end}}
+
+		<h6>Audit log</h6>
+		<table class="grd">
+			<tr><th>Time</th><th>ID</th><th>User</th><th>IP</th><th>Action</th><th>Details</th><th>Outcome</th></tr>
+			{{range $_, $ev := $.List}}
+				<tr>
+					<td class="nobr">{{$ev.Time.Format "2006-01-02 15:04:05"}}</td>
+					<td>{{$ev.RequestID}}</td>
+					<td>{{$ev.User}}{{if $ev.AuthMethod}} ({{$ev.AuthMethod}}){{end}}</td>
+					<td>{{$ev.IP}}</td>
+					<td class="nobr">{{$ev.Action}}</td>
+					<td>{{$ev.Details}}</td>
+					<td>{{if $ev.Error}}<span class="attention">{{$ev.Outcome}}: {{$ev.Error}}</span>{{else}}{{$ev.Outcome}}{{end}}</td>
+				</tr>
+			{{end}}
+		</table>
+` + htmlBottom
+
+	lockoutsPage = htmlTop + `
+		{{if $.ErrMsg}}<p><strong class="attention">{{$.ErrMsg}}</strong></p>{{end}}
+
+		<h6>Authentication failures</h6>
+		<p>
+			Failures: {{$.Stat.Failures}}, lockouts: {{$.Stat.Lockouts}}, rejected: {{$.Stat.Rejected}}, locked now: {{$.Stat.Locked}}
+		</p>
+
+		<table class="grd">
+			<tr><th>Key</th><th>Failures</th><th>First</th><th>Last</th><th>Locked until</th><th></th></tr>
+			{{range $_, $e := $.List}}
+				<tr>
+					<td>{{$e.Key}}</td>
+					<td>{{$e.Failures}}</td>
+					<td class="nobr">{{$e.First.Format "2006-01-02 15:04:05"}}</td>
+					<td class="nobr">{{$e.Last.Format "2006-01-02 15:04:05"}}</td>
+					<td class="nobr">{{if $e.LockedUntil.After $.Now}}<span class="attention">{{$e.LockedUntil.Format "2006-01-02 15:04:05"}}</span>{{end}}</td>
+					<td>
+						<form class="inline" method="post" action="{{$.Prefix}}/maintenance/lockouts-clear">
+							<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+							<input type="hidden" name="key" value="{{$e.Key}}" />
+							<button type="submit" class="link">clear</button>
+						</form>
+					</td>
+				</tr>
+			{{end}}
+		</table>
+
+		{{if $.List}}
+			<form method="post" action="{{$.Prefix}}/maintenance/lockouts-clear">
+				<input type="hidden" name="___csrf" value="{{$.CSRF}}" />
+				<button type="submit" class="link">Clear all</button>
+			</form>
+		{{end}}
+` + htmlBottom
+
+	dirListingPage = htmlTop + `
+		<h6>Index of {{$.Path}}</h6>
+		<table class="grd">
+			<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+			{{if not $.IsRoot}}
+				<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+			{{end}}
+			{{range $_, $e := $.List}}
+				<tr>
+					<td><a href="{{$e.Href}}">{{$e.Name}}</a></td>
+					<td class="right">{{if not $e.IsDir}}{{$e.Size}}{{end}}</td>
+					<td class="nobr">{{$e.ModTime.Format "2006-01-02 15:04:05"}}</td>
+				</tr>
+			{{end}}
+		</table>
+` + htmlBottom
+
+	panicsPage = htmlTop + `
+		{{if $.ErrMsg}}<p><strong class="attention">{{$.ErrMsg}}</strong></p>{{end}}
+
+		<h6>Recent panics</h6>
+		<table class="grd">
+			<tr><th>Time</th><th>ID</th><th>Request</th><th>User</th><th>IP</th><th>Error</th></tr>
+			{{range $_, $p := $.List}}
+				<tr>
+					<td class="nobr">{{$p.Time.Format "2006-01-02 15:04:05"}}</td>
+					<td>{{$p.ID}}</td>
+					<td>{{$p.Method}} {{$p.URI}}<br />{{$p.RequestID}}</td>
+					<td>{{$p.User}}</td>
+					<td>{{$p.IP}}</td>
+					<td><span class="attention">{{$p.Error}}</span></td>
+				</tr>
+				<tr>
+					<td colspan="6"><pre>{{$p.Stack}}</pre></td>
+				</tr>
+			{{end}}
+		</table>
+` + htmlBottom
+
+	logPage = htmlTop + `
+		{{if $.ErrMsg}}<p><strong class="attention">{{$.ErrMsg}}</strong></p>{{end}}
+
+		<h6>Live log</h6>
+		<p>
+			<label for="facility">Facility</label>
+			<select id="facility">
+				<option value="*">all</option>
+				{{range $_, $f := $.Facilities}}
+					<option value="{{$f}}">{{if $f}}{{$f}}{{else}}default{{end}}</option>
+				{{end}}
+			</select>
+			<label for="level">Level</label>
+			<select id="level">
+				<option value="">all</option>
+				{{range $_, $l := $.Levels}}
+					<option value="{{$l}}">{{$l}}</option>
+				{{end}}
+			</select>
+			<label for="text">Text</label>
+			<input type="text" id="text" />
+			<button type="button" id="pause">Pause</button>
+			<button type="button" id="clear">Clear</button>
+			{{if $.LogFile}}<a href="{{$.Prefix}}/maintenance/log/download">Download {{$.LogFile}}</a>{{end}}
+			<small id="state"></small>
+		</p>
+		<pre id="log"></pre>
+
+		<script{{if $.Nonce}} nonce="{{$.Nonce}}"{{end}}>
+			(function() {
+				const maxLines = 2000;
+				const important = /^\[\d+\] (EM|AL|CR|ER) /;
+
+				const out = document.getElementById("log");
+				const state = document.getElementById("state");
+				const pause = document.getElementById("pause");
+				const facility = document.getElementById("facility");
+				const level = document.getElementById("level");
+				const text = document.getElementById("text");
+
+				let es = null;
+				let paused = false;
+				let queue = [];
+
+				function show(data) {
+					const atBottom = window.innerHeight + window.scrollY >= document.body.scrollHeight - 20;
+
+					const line = document.createElement("span");
+					if (important.test(data)) {
+						line.className = "attention";
+					}
+					line.textContent = data + "\n";
+					out.appendChild(line);
+
+					while (out.childNodes.length > maxLines) {
+						out.removeChild(out.firstChild);
+					}
+
+					if (atBottom) {
+						window.scrollTo(0, document.body.scrollHeight);
+					}
+				}
+
+				function connect() {
+					if (es) {
+						es.close();
+					}
+					out.textContent = "";
+					queue = [];
+
+					const q = new URLSearchParams();
+					if (facility.value !== "*") {
+						q.set("facility", facility.value);
+					}
+					if (level.value) {
+						q.set("level", level.value);
+					}
+					if (text.value) {
+						q.set("text", text.value);
+					}
+					q.set("lastEventId", "0");
+
+					es = new EventSource({{$.Prefix}} + "/maintenance/log/stream?" + q.toString());
+					es.onopen = function() { state.textContent = paused ? "paused" : "connected"; };
+					es.onerror = function() { state.textContent = "reconnecting..."; };
+					es.onmessage = function(e) {
+						if (!paused) {
+							show(e.data);
+							return;
+						}
+						queue.push(e.data);
+						if (queue.length > maxLines) {
+							queue.shift();
+						}
+						state.textContent = "paused, " + queue.length + " new";
+					};
+				}
+
+				pause.addEventListener("click", function() {
+					paused = !paused;
+					pause.textContent = paused ? "Resume" : "Pause";
+					state.textContent = paused ? "paused" : "connected";
+					if (!paused) {
+						queue.forEach(show);
+						queue = [];
+					}
+				});
+
+				document.getElementById("clear").addEventListener("click", function() {
+					out.textContent = "";
+					queue = [];
+				});
+
+				facility.addEventListener("change", connect);
+				level.addEventListener("change", connect);
+				text.addEventListener("change", connect);
+
+				connect();
+			})();
+		</script>
+` + htmlBottom
+
+	tracesPage = htmlTop + `
+		{{if $.ErrMsg}}<p><strong class="attention">{{$.ErrMsg}}</strong></p>{{end}}
+
+		<h6>Recent traces</h6>
+		<table class="grd">
+			<tr><th>Start</th><th>Trace</th><th>Root</th><th>Duration</th><th>Span</th><th>Parent</th><th>Name</th><th>Span duration</th><th>Attributes</th><th>Status</th></tr>
+			{{range $_, $t := $.List}}
+				{{range $i, $s := $t.Spans}}
+					<tr>
+						{{if eq $i 0}}
+							<td class="nobr">{{$t.Start.Format "2006-01-02 15:04:05.000"}}</td>
+							<td><a href="{{$.Prefix}}/maintenance/traces?trace={{$t.TraceID}}">{{$t.TraceID}}</a></td>
+							<td>{{if $t.Failed}}<span class="attention">{{$t.Root}}</span>{{else}}{{$t.Root}}{{end}}</td>
+							<td class="nobr">{{$t.Duration}}</td>
+						{{else}}
+							<td></td><td></td><td></td><td></td>
+						{{end}}
+						<td>{{$s.SpanID}}</td>
+						<td>{{if $s.ParentID.IsValid}}{{$s.ParentID}}{{end}}</td>
+						<td class="nobr">{{$s.Name}}</td>
+						<td class="nobr">{{$s.Duration}}</td>
+						<td>{{range $n, $v := $s.Attributes}}{{$n}}={{$v}}<br />{{end}}</td>
+						<td>{{if eq $s.Status 2}}<span class="attention">{{$s.StatusMessage}}</span>{{else if eq $s.Status 1}}OK{{end}}</td>
+					</tr>
+				{{end}}
+			{{end}}
+		</table>
+` + htmlBottom
+
 	endpointsPage = htmlTop + `
 		{{if $.ErrMsg}}<p><strong class="attention">{{$.ErrMsg}}</strong></p>{{end}}
 
@@ -73,8 +432,8 @@ var (
 			<tr><th>URL</th><th>Description</th></tr>
 			{{range $_, $info := $.List}}
 				<tr>
-					<td><a href="{{$.Prefix}}{{index $info 0}}">{{index $info 0}}</a></td>
-					<td>{{index $info 1}}</td>
+					<td>{{if $info.Link}}<a href="{{$.Prefix}}{{$info.Path}}">{{$info.Path}}</a>{{else}}{{$info.Path}} [POST]{{end}}</td>
+					<td>{{$info.Description}}</td>
 				</tr>
 			{{end}}
 ` + htmlBottom
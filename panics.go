@@ -0,0 +1,240 @@
+package stdhttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// PanicConfig --
+	PanicConfig struct {
+		StopApp bool `toml:"stop-app"` // pass the panic to the panic package (it stops the application) after the reply
+		Keep    int  `toml:"keep"`     // recent panics kept for the maintenance page, 0 -- 20, <0 -- don't keep
+	}
+
+	// PanicInfo --
+	PanicInfo struct {
+		Time      time.Time `json:"time"`
+		PanicID   uint64    `json:"panicID"`
+		ID        uint64    `json:"id"`
+		RequestID string    `json:"requestID"`
+		Method    string    `json:"method"`
+		URI       string    `json:"uri"`
+		Endpoint  string    `json:"endpoint"`
+		User      string    `json:"user,omitempty"`
+		IP        string    `json:"ip"`
+		Error     string    `json:"error"`
+		Stack     string    `json:"stack"`
+	}
+
+	panics struct {
+		mutex sync.Mutex
+		cfg   PanicConfig
+		list  []*PanicInfo
+	}
+)
+
+const (
+	defaultPanicsKeep = 20
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetPanicConfig --
+func (h *HTTP) SetPanicConfig(cfg *PanicConfig) {
+	p := &panics{}
+	if cfg != nil {
+		p.cfg = *cfg
+	}
+
+	if p.cfg.Keep == 0 {
+		p.cfg.Keep = defaultPanicsKeep
+	}
+
+	h.Lock()
+	h.panics = p
+	h.Unlock()
+
+	if p.cfg.Keep > 0 {
+		h.AddEndpointsInfo(misc.StringMap{
+			"/maintenance/panics": "Recent panics in handlers ([format=json])",
+		})
+	}
+}
+
+// getPanics --
+func (h *HTTP) getPanics() *panics {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.panics
+}
+
+func (p *panics) add(info *PanicInfo) {
+	if p.cfg.Keep < 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.list = append(p.list, info)
+	if len(p.list) > p.cfg.Keep {
+		p.list = p.list[len(p.list)-p.cfg.Keep:]
+	}
+}
+
+// recent -- the newest first
+func (p *panics) recent() (list []*PanicInfo) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	list = make([]*PanicInfo, 0, len(p.list))
+	for i := len(p.list) - 1; i >= 0; i-- {
+		list = append(list, p.list[i])
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// recoverPanic -- must be deferred directly in ServeHTTP
+func (h *HTTP) recoverPanic(id uint64, panicID uint64, path *string, w *ResponseRecorder, r **http.Request) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	if hp, ok := rec.(*handlerPanic); ok {
+		// from the handler goroutine
+		rec = hp.value
+		stack = hp.stack
+	}
+
+	if rec == http.ErrAbortHandler {
+		Log.Message(log.DEBUG, "[%d] Handler aborted", id)
+		return
+	}
+
+	req := *r
+	info := h.notePanic(id, panicID, *path, req, rec, stack)
+	p := h.getPanics()
+
+	SpanFromContext(req.Context()).SetError(errors.New(info.Error))
+
+	Error(id, w.HeaderSent(), w, req, http.StatusInternalServerError, "Internal server error", fmt.Errorf("panic: %s", info.Error))
+
+	if p != nil && p.cfg.StopApp {
+		// panic.SaveStackToLogEx deferred in ServeHTTP stops the application
+		panic(rec)
+	}
+}
+
+// lateHandlerPanic -- the panic in the handler goroutine after the timeout reply has been sent, nobody is waiting for it
+func (h *HTTP) lateHandlerPanic(id uint64, panicID uint64, path string, req *http.Request, rec any, stack []byte) {
+	if rec == http.ErrAbortHandler {
+		return
+	}
+
+	h.notePanic(id, panicID, path, req, rec, stack)
+
+	if p := h.getPanics(); p != nil && p.cfg.StopApp {
+		// as panic.SaveStackToLogEx does
+		misc.StopApp(misc.ExPanic)
+		misc.Exit()
+	}
+}
+
+// notePanic -- logs, counts and keeps the recovered panic
+func (h *HTTP) notePanic(id uint64, panicID uint64, path string, req *http.Request, rec any, stack []byte) *PanicInfo {
+	info := &PanicInfo{
+		Time:      misc.NowUTC(),
+		PanicID:   panicID,
+		ID:        id,
+		RequestID: GetRequestID(req),
+		Method:    req.Method,
+		URI:       req.RequestURI,
+		Endpoint:  path,
+		IP:        h.ClientAddr(req),
+		Error:     fmt.Sprint(rec),
+		Stack:     string(stack),
+	}
+
+	if identity, _ := GetIdentityFromRequestContext(req); identity != nil {
+		info.User = identity.User
+	}
+
+	Log.SecuredMessage(log.ALERT, logReplaceRequest, `[%d] [panicID %d] Panic in %s "%s" from %s, user "%s" {%s}: %s%s%s`,
+		id, panicID, info.Method, info.URI, info.IP, info.User, info.RequestID, info.Error, misc.EOS, info.Stack)
+
+	h.endpointPanic(info.Endpoint)
+
+	if p := h.getPanics(); p != nil {
+		p.add(info)
+	}
+
+	return info
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) showPanics(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	p := h.getPanics()
+	if p == nil || p.cfg.Keep < 0 {
+		Error(id, false, w, r, http.StatusNotImplemented, "Panics list is not enabled", nil)
+		return
+	}
+
+	list := p.recent()
+
+	if r.URL.Query().Get("format") == ContentTypeJSON {
+		SendJSON(w, r, http.StatusOK, list)
+		return
+	}
+
+	params := struct {
+		Prefix string
+		Nonce  string
+		Name   string
+		ErrMsg string
+		List   []*PanicInfo
+	}{
+		Prefix: prefix,
+		Nonce:  GetCSPNonce(r),
+		Name:   "Panics",
+		ErrMsg: r.URL.Query().Get("___err"),
+		List:   list,
+	}
+
+	t, err := template.New("panics").Parse(panicsPage)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = t.Execute(buf, params)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	err = WriteReply(w, r, http.StatusOK, ContentTypeHTML, nil, buf.Bytes())
+	if err != nil {
+		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+	}
+}
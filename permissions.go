@@ -0,0 +1,237 @@
+package stdhttp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/alrusov/auth"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// CheckPermissions -- the same rules as the auth package uses for Auth.Endpoints:
+// user name, then "@group" (any false denies), then "*"
+func CheckPermissions(identity *auth.Identity, permissions misc.BoolMap) bool {
+	if identity == nil {
+		return false
+	}
+
+	if identity.IsAdmin {
+		return true
+	}
+
+	if len(permissions) == 0 {
+		return false
+	}
+
+	p, exists := permissions[identity.User]
+	if exists {
+		return p
+	}
+
+	if len(identity.Groups) > 0 {
+		enabled := false
+
+		for _, g := range identity.Groups {
+			p, exists := permissions["@"+g]
+			if exists {
+				if !p {
+					return false
+				}
+				enabled = true
+			}
+		}
+
+		if enabled {
+			return true
+		}
+	}
+
+	p, exists = permissions["*"]
+	if exists {
+		return p
+	}
+
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// AuthzConfig --
+	AuthzConfig struct {
+		// role -> permissions. "+role" includes permissions of another role, "*" -- any permission, "reports.*" -- any from the group
+		Roles map[string][]string `toml:"roles"`
+		// "user", "@group" or "*" -> roles
+		Assign map[string][]string `toml:"assign"`
+		// endpoint pattern -> method ("*" -- any) -> permission
+		Endpoints map[string]misc.StringMap `toml:"endpoints"`
+	}
+
+	authz struct {
+		cfg          *AuthzConfig
+		endpointKeys misc.BoolMap
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetAuthz --
+func (h *HTTP) SetAuthz(cfg *AuthzConfig) {
+	h.Lock()
+	defer h.Unlock()
+
+	if cfg == nil {
+		h.authz = nil
+		return
+	}
+
+	a := &authz{
+		cfg:          cfg,
+		endpointKeys: make(misc.BoolMap, len(cfg.Endpoints)),
+	}
+
+	for pattern := range cfg.Endpoints {
+		a.endpointKeys[pattern] = true
+	}
+
+	h.authz = a
+}
+
+func (h *HTTP) getAuthz() *authz {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.authz
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Permissions -- all permissions of the identity after the role and group expansion
+func (h *HTTP) Permissions(identity *auth.Identity) misc.BoolMap {
+	list := misc.BoolMap{}
+
+	if identity == nil {
+		return list
+	}
+
+	// per key permissions of the API key clients
+	if info, ok := identity.Extra.(*APIKeyInfo); ok {
+		for p := range info.Permissions {
+			list[p] = true
+		}
+	}
+
+	a := h.getAuthz()
+	if a == nil {
+		return list
+	}
+
+	var roles []string
+	roles = append(roles, a.cfg.Assign[identity.User]...)
+	for _, g := range identity.Groups {
+		roles = append(roles, a.cfg.Assign["@"+g]...)
+	}
+	roles = append(roles, a.cfg.Assign["*"]...)
+
+	seen := misc.BoolMap{}
+	for len(roles) > 0 {
+		role := roles[0]
+		roles = roles[1:]
+
+		if seen[role] {
+			continue
+		}
+		seen[role] = true
+
+		for _, p := range a.cfg.Roles[role] {
+			if strings.HasPrefix(p, "+") {
+				roles = append(roles, p[1:])
+				continue
+			}
+			list[p] = true
+		}
+	}
+
+	return list
+}
+
+// HasPermission --
+func (h *HTTP) HasPermission(identity *auth.Identity, permission string) bool {
+	if identity == nil {
+		return false
+	}
+
+	if identity.IsAdmin {
+		return true
+	}
+
+	for p := range h.Permissions(identity) {
+		if p == "*" || p == permission {
+			return true
+		}
+
+		if strings.HasSuffix(p, ".*") && strings.HasPrefix(permission, p[:len(p)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authorize -- checks the permission for the identity stored in the request context
+func (h *HTTP) Authorize(r *http.Request, permission string) bool {
+	identity, _ := GetIdentityFromRequestContext(r)
+	return h.HasPermission(identity, permission)
+}
+
+// RequirePermission -- sends 401 or 403 reply if the permission is absent. Returns true if the request may be processed
+func (h *HTTP) RequirePermission(id uint64, w http.ResponseWriter, r *http.Request, permission string) bool {
+	identity, _ := GetIdentityFromRequestContext(r)
+	if identity == nil {
+		Error(id, false, w, r, http.StatusUnauthorized, "Unauthorised", nil)
+		return false
+	}
+
+	if !h.HasPermission(identity, permission) {
+		Error(id, false, w, r, http.StatusForbidden, "Forbidden", fmt.Errorf(`user "%s" has no "%s" permission`, identity.User, permission))
+		return false
+	}
+
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// authorizeEndpoint -- declarative check by the endpoint and method
+func (h *HTTP) authorizeEndpoint(id uint64, path string, w http.ResponseWriter, r *http.Request) bool {
+	a := h.getAuthz()
+	if a == nil || h.isACMEChallenge(path) {
+		return true
+	}
+
+	pattern, exists := isPathInList(path, a.endpointKeys)
+	if !exists {
+		return true
+	}
+
+	methods := a.cfg.Endpoints[pattern]
+
+	permission, exists := methods[r.Method]
+	if !exists {
+		permission, exists = methods["*"]
+		if !exists {
+			return true
+		}
+	}
+
+	if permission == "" {
+		return true
+	}
+
+	return h.RequirePermission(id, w, r, permission)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -2,6 +2,7 @@ package stdhttp
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -25,6 +26,7 @@ const (
 	RequestOptionSkipTLSVerification = ".skip-tls-verification"
 	RequestOptionBasicAuthUser       = ".user"
 	RequestOptionBasicAuthPassword   = ".password"
+	RequestOptionRequestID           = ".request-id" // the ID to forward by Request and RequestEx (GetRequestID(r)), the *Ctx variants take it from the context
 )
 
 func parseBoolOption(opt string) bool {
@@ -55,8 +57,13 @@ func (d *unixSocketDialer) Dial(_ string, path string) (net.Conn, error) {
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
-// Request --
+// Request -- the request ID is forwarded only if RequestOptionRequestID is set, use RequestCtx with r.Context() inside handlers
 func Request(method string, uri string, timeout time.Duration, opts misc.StringMap, extraHeaders misc.StringMap, data []byte) (*bytes.Buffer, *http.Response, error) {
+	return RequestCtx(context.Background(), method, uri, timeout, opts, extraHeaders, data)
+}
+
+// RequestCtx -- the request ID from the context (if any) is forwarded
+func RequestCtx(ctx context.Context, method string, uri string, timeout time.Duration, opts misc.StringMap, extraHeaders misc.StringMap, data []byte) (*bytes.Buffer, *http.Response, error) {
 	optsEx := make(url.Values, len(opts))
 	for k, v := range opts {
 		optsEx[k] = []string{v}
@@ -67,13 +74,24 @@ func Request(method string, uri string, timeout time.Duration, opts misc.StringM
 		extraHeadersEx[k] = []string{v}
 	}
 
-	return RequestEx(method, uri, timeout, optsEx, extraHeadersEx, data)
+	return RequestExCtx(ctx, method, uri, timeout, optsEx, extraHeadersEx, data)
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
-// RequestEx --
+// RequestEx -- the request ID is forwarded only if RequestOptionRequestID is set, use RequestExCtx with r.Context() inside handlers
 func RequestEx(method string, uri string, timeout time.Duration, opts url.Values, extraHeaders http.Header, data []byte) (*bytes.Buffer, *http.Response, error) {
+	return RequestExCtx(context.Background(), method, uri, timeout, opts, extraHeaders, data)
+}
+
+// RequestExCtx -- the request ID and the trace context from the context (if any) are forwarded. Use r.Context() of the incoming request inside handlers
+func RequestExCtx(ctx context.Context, method string, uri string, timeout time.Duration, opts url.Values, extraHeaders http.Header, data []byte) (_ *bytes.Buffer, _ *http.Response, err error) {
+	ctx, span := StartSpan(ctx, method, SpanKindClient)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
 	if data == nil {
 		data = make([]byte, 0)
 	}
@@ -82,6 +100,7 @@ func RequestEx(method string, uri string, timeout time.Duration, opts url.Values
 	skipTLSverification := false
 	user := ""
 	password := ""
+	rid := GetRequestIDFromContext(ctx)
 
 	for k, values := range opts {
 		if strings.HasPrefix(k, ".") {
@@ -99,6 +118,11 @@ func RequestEx(method string, uri string, timeout time.Duration, opts url.Values
 			case RequestOptionBasicAuthPassword:
 				password = v
 				delete(opts, k)
+			case RequestOptionRequestID:
+				if validRequestID(v) {
+					rid = v
+				}
+				delete(opts, k)
 			}
 		}
 	}
@@ -111,7 +135,7 @@ func RequestEx(method string, uri string, timeout time.Duration, opts url.Values
 		data = b.Bytes()
 	}
 
-	req, err := http.NewRequest(method, uri, bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(data))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -126,6 +150,21 @@ func RequestEx(method string, uri string, timeout time.Duration, opts url.Values
 		}
 	}
 
+	if rid != "" {
+		if name := requestIDheaderFromContext(ctx); req.Header.Get(name) == "" {
+			req.Header.Set(name, rid)
+		}
+	}
+
+	if span != nil {
+		span.SetAttribute("http.request.method", method)
+		span.SetAttribute("url.full", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+		req.Header.Set(HTTPheaderTraceParent, span.TraceParent())
+		if span.TraceState != "" {
+			req.Header.Set(HTTPheaderTraceState, span.TraceState)
+		}
+	}
+
 	if _, exists := extraHeaders[HTTPheaderAcceptEncoding]; !exists {
 		req.Header.Set(HTTPheaderAcceptEncoding, ContentEncodingGzip)
 	}
@@ -170,6 +209,10 @@ func RequestEx(method string, uri string, timeout time.Duration, opts url.Values
 	resp, err := c.Do(req)
 	tr.CloseIdleConnections()
 
+	if resp != nil {
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+	}
+
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -0,0 +1,164 @@
+package stdhttp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// RequestIDConfig --
+	RequestIDConfig struct {
+		Header         string   `toml:"header"`          // empty -- X-Request-ID
+		TrustIncoming  bool     `toml:"trust-incoming"`  // use the ID from the incoming header
+		TrustedProxies []string `toml:"trusted-proxies"` // CIDRs the incoming ID is accepted from, empty -- from anywhere
+	}
+
+	requestIDcfg struct {
+		header        string
+		trustIncoming bool
+		trusted       []*net.IPNet
+	}
+)
+
+const (
+	CtxRequestID = ContextKey("request-id")
+
+	ctxRequestIDheader = ContextKey("request-id-header")
+
+	HTTPheaderRequestID = "X-Request-ID"
+
+	maxRequestIDlen = 128
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetRequestIDConfig --
+func (h *HTTP) SetRequestIDConfig(cfg *RequestIDConfig) (err error) {
+	c := &requestIDcfg{
+		header:        cfg.Header,
+		trustIncoming: cfg.TrustIncoming,
+	}
+
+	if c.header == "" {
+		c.header = HTTPheaderRequestID
+	}
+
+	c.trusted, err = parseTrustedNets(cfg.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf(`request id: %s`, err)
+	}
+
+	h.Lock()
+	h.requestID = c
+	h.Unlock()
+	return
+}
+
+// getRequestIDConfig --
+func (h *HTTP) getRequestIDConfig() *requestIDcfg {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.requestID
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// NewRequestID --
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(rid string) bool {
+	if rid == "" || len(rid) > maxRequestIDlen {
+		return false
+	}
+
+	for _, c := range rid {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *requestIDcfg) trustedSource(r *http.Request) bool {
+	if !c.trustIncoming {
+		return false
+	}
+
+	if len(c.trusted) == 0 {
+		return true
+	}
+
+	return ipInNets(remoteHost(r), c.trusted)
+}
+
+// assignRequestID -- takes the trusted incoming ID or generates the new one, stores it in the context and in the response header
+func (h *HTTP) assignRequestID(w http.ResponseWriter, r *http.Request) (rid string, newR *http.Request) {
+	c := h.getRequestIDConfig()
+	if c == nil {
+		c = &requestIDcfg{header: HTTPheaderRequestID}
+	}
+
+	if c.trustedSource(r) {
+		if s := r.Header.Get(c.header); validRequestID(s) {
+			rid = s
+		}
+	}
+
+	if rid == "" {
+		rid = NewRequestID()
+	}
+
+	w.Header().Set(c.header, rid)
+	newR = AddValueToRequestContext(r, CtxRequestID, rid)
+	if c.header != HTTPheaderRequestID {
+		// for the outgoing requests
+		newR = AddValueToRequestContext(newR, ctxRequestIDheader, c.header)
+	}
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// GetRequestID -- request ID from the request context
+func GetRequestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+
+	return GetRequestIDFromContext(r.Context())
+}
+
+// GetRequestIDFromContext --
+func GetRequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	rid, _ := ctx.Value(CtxRequestID).(string)
+	return rid
+}
+
+// requestIDheaderFromContext -- the header name configured for the listener the request came to
+func requestIDheaderFromContext(ctx context.Context) string {
+	if ctx != nil {
+		if name, _ := ctx.Value(ctxRequestIDheader).(string); name != "" {
+			return name
+		}
+	}
+
+	return HTTPheaderRequestID
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,169 @@
+package stdhttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// ResponseRecorder -- wraps the http.ResponseWriter and records what has been sent to the client
+type ResponseRecorder struct {
+	http.ResponseWriter
+	start      time.Time
+	firstByte  time.Time
+	status     int
+	bytes      int64
+	headerSent bool
+	hijacked   bool
+}
+
+const (
+	CtxResponseRecorder = ContextKey("response-recorder")
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// NewResponseRecorder --
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{
+		ResponseWriter: w,
+		start:          time.Now(),
+	}
+}
+
+// GetResponseRecorder -- the recorder of the current request, nil if absent
+func GetResponseRecorder(r *http.Request) *ResponseRecorder {
+	rr, _ := GetValueFromRequestContext(r, CtxResponseRecorder).(*ResponseRecorder)
+	return rr
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Status -- 0 if nothing has been sent yet
+func (rr *ResponseRecorder) Status() int {
+	return rr.status
+}
+
+// Bytes -- body bytes written
+func (rr *ResponseRecorder) Bytes() int64 {
+	return rr.bytes
+}
+
+// HeaderSent --
+func (rr *ResponseRecorder) HeaderSent() bool {
+	return rr.headerSent
+}
+
+// Hijacked --
+func (rr *ResponseRecorder) Hijacked() bool {
+	return rr.hijacked
+}
+
+// FirstByte -- time from the start of processing to the first byte of the reply, 0 if nothing has been sent yet
+func (rr *ResponseRecorder) FirstByte() time.Duration {
+	if rr.firstByte.IsZero() {
+		return 0
+	}
+
+	return rr.firstByte.Sub(rr.start)
+}
+
+// Elapsed -- time from the start of processing
+func (rr *ResponseRecorder) Elapsed() time.Duration {
+	return time.Since(rr.start)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (rr *ResponseRecorder) sent(code int) {
+	if rr.headerSent {
+		return
+	}
+
+	rr.headerSent = true
+	rr.status = code
+	rr.firstByte = time.Now()
+}
+
+// WriteHeader --
+func (rr *ResponseRecorder) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// informational, the final status will follow
+		rr.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	rr.sent(code)
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+// Write --
+func (rr *ResponseRecorder) Write(b []byte) (n int, err error) {
+	rr.sent(http.StatusOK)
+	n, err = rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return
+}
+
+// ReadFrom -- keeps the sendfile fast path of the underlying writer
+func (rr *ResponseRecorder) ReadFrom(src io.Reader) (n int64, err error) {
+	rr.sent(http.StatusOK)
+
+	if rf, ok := rr.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(rr.ResponseWriter, src)
+	}
+
+	rr.bytes += n
+	return
+}
+
+// Flush --
+func (rr *ResponseRecorder) Flush() {
+	f, ok := rr.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+
+	rr.sent(http.StatusOK)
+	f.Flush()
+}
+
+// Hijack --
+func (rr *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rr.ResponseWriter)
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		rr.sent(http.StatusSwitchingProtocols)
+		rr.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+// Push -- HTTP/2 server push
+func (rr *ResponseRecorder) Push(target string, opts *http.PushOptions) error {
+	p, ok := rr.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	return p.Push(target, opts)
+}
+
+// Unwrap -- for http.ResponseController
+func (rr *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
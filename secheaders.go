@@ -0,0 +1,193 @@
+package stdhttp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// SecurityHeaders -- empty field means "inherit from the global set", "-" means "do not send"
+	SecurityHeaders struct {
+		HSTS                  config.Duration `toml:"hsts"` // max-age, sent on TLS listeners only
+		HSTSIncludeSubdomains bool            `toml:"hsts-include-subdomains"`
+		HSTSPreload           bool            `toml:"hsts-preload"`
+		CSP                   string          `toml:"csp"` // {nonce} is replaced by the per request nonce
+		ContentTypeOptions    string          `toml:"content-type-options"`
+		FrameOptions          string          `toml:"frame-options"`
+		ReferrerPolicy        string          `toml:"referrer-policy"`
+		PermissionsPolicy     string          `toml:"permissions-policy"`
+		Extra                 misc.StringMap  `toml:"extra"`
+	}
+
+	// SecurityHeadersConfig --
+	SecurityHeadersConfig struct {
+		Global    *SecurityHeaders            `toml:"global"`
+		Endpoints map[string]*SecurityHeaders `toml:"endpoints"` // by endpoint pattern
+	}
+)
+
+const (
+	CtxCSPNonce = ContextKey("csp-nonce")
+
+	HTTPheaderStrictTransportSecurity = "Strict-Transport-Security"
+	HTTPheaderContentSecurityPolicy   = "Content-Security-Policy"
+	HTTPheaderContentTypeOptions      = "X-Content-Type-Options"
+	HTTPheaderFrameOptions            = "X-Frame-Options"
+	HTTPheaderReferrerPolicy          = "Referrer-Policy"
+	HTTPheaderPermissionsPolicy       = "Permissions-Policy"
+
+	cspNoncePlaceholder = "{nonce}"
+	secHeaderDisabled   = "-"
+)
+
+// DefaultSecurityHeaders -- reasonable set for the maintenance pages
+func DefaultSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		HSTS:               config.Duration(365 * 24 * time.Hour),
+		CSP:                "default-src 'self'; style-src 'self' 'unsafe-inline'; script-src 'self' 'nonce-{nonce}'; img-src 'self' data:; frame-ancestors 'none'",
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "DENY",
+		ReferrerPolicy:     "same-origin",
+		PermissionsPolicy:  "camera=(), microphone=(), geolocation=()",
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetSecurityHeaders --
+func (h *HTTP) SetSecurityHeaders(cfg *SecurityHeadersConfig) {
+	h.Lock()
+	defer h.Unlock()
+
+	if cfg == nil {
+		h.secHeaders = nil
+		h.secHeadersKeys = nil
+		return
+	}
+
+	h.secHeaders = cfg
+	h.secHeadersKeys = make(misc.BoolMap, len(cfg.Endpoints))
+	for pattern := range cfg.Endpoints {
+		h.secHeadersKeys[pattern] = true
+	}
+}
+
+func (h *HTTP) securityHeadersFor(path string) (global *SecurityHeaders, local *SecurityHeaders) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.secHeaders == nil {
+		return
+	}
+
+	global = h.secHeaders.Global
+
+	pattern, exists := isPathInList(path, h.secHeadersKeys)
+	if exists {
+		local = h.secHeaders.Endpoints[pattern]
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// applySecurityHeaders -- adds configured headers to the response, stores CSP nonce (if used) in the request context
+func (h *HTTP) applySecurityHeaders(path string, w http.ResponseWriter, r *http.Request) *http.Request {
+	global, local := h.securityHeadersFor(path)
+	if global == nil && local == nil {
+		return r
+	}
+
+	hdr := w.Header()
+
+	set := func(name string, g string, l string) string {
+		v := l
+		if v == "" {
+			v = g
+		}
+
+		if v == "" || v == secHeaderDisabled {
+			return ""
+		}
+
+		hdr.Set(name, v)
+		return v
+	}
+
+	var g, l SecurityHeaders
+	if global != nil {
+		g = *global
+	}
+	if local != nil {
+		l = *local
+	}
+
+	if r.TLS != nil {
+		hsts := l
+		if hsts.HSTS == 0 {
+			hsts = g
+		}
+
+		if hsts.HSTS > 0 {
+			v := "max-age=" + strconv.FormatInt(int64(hsts.HSTS.D().Seconds()), 10)
+			if hsts.HSTSIncludeSubdomains {
+				v += "; includeSubDomains"
+			}
+			if hsts.HSTSPreload {
+				v += "; preload"
+			}
+			hdr.Set(HTTPheaderStrictTransportSecurity, v)
+		}
+	}
+
+	set(HTTPheaderContentTypeOptions, g.ContentTypeOptions, l.ContentTypeOptions)
+	set(HTTPheaderFrameOptions, g.FrameOptions, l.FrameOptions)
+	set(HTTPheaderReferrerPolicy, g.ReferrerPolicy, l.ReferrerPolicy)
+	set(HTTPheaderPermissionsPolicy, g.PermissionsPolicy, l.PermissionsPolicy)
+
+	for n, v := range g.Extra {
+		if _, exists := l.Extra[n]; !exists && v != secHeaderDisabled {
+			hdr.Set(n, v)
+		}
+	}
+	for n, v := range l.Extra {
+		if v != secHeaderDisabled {
+			hdr.Set(n, v)
+		}
+	}
+
+	csp := set(HTTPheaderContentSecurityPolicy, g.CSP, l.CSP)
+	if strings.Contains(csp, cspNoncePlaceholder) {
+		nonce := newCSPNonce()
+		hdr.Set(HTTPheaderContentSecurityPolicy, strings.ReplaceAll(csp, cspNoncePlaceholder, nonce))
+		r = AddValueToRequestContext(r, CtxCSPNonce, nonce)
+	}
+
+	return r
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func newCSPNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// GetCSPNonce -- nonce for inline scripts and styles, empty if CSP with nonce is not used
+func GetCSPNonce(r *http.Request) string {
+	nonce, _ := GetValueFromRequestContext(r, CtxCSPNonce).(string)
+	return nonce
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,385 @@
+package stdhttp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alrusov/auth"
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Session --
+	Session struct {
+		mutex    sync.Mutex
+		ID       string         `json:"id"`
+		Created  time.Time      `json:"created"`
+		Accessed time.Time      `json:"accessed"`
+		Values   map[string]any `json:"values"`   // values must be JSON serializable for the file and cookie stores
+		Identity *auth.Identity `json:"identity"` // logged in user
+	}
+
+	// SessionStore --
+	SessionStore interface {
+		// Load -- value is the cookie value. Returns nil without error if session not found
+		Load(value string) (s *Session, err error)
+		// Save -- returns new cookie value
+		Save(s *Session) (value string, err error)
+		Delete(s *Session) error
+	}
+
+	// SessionConfig --
+	SessionConfig struct {
+		CookieName      string          `toml:"cookie-name"`
+		Store           string          `toml:"store"`            // memory (default), file, cookie
+		Dir             string          `toml:"dir"`              // for the file store
+		Key             string          `toml:"key"`              // for the cookie store
+		IdleTimeout     config.Duration `toml:"idle-timeout"`     // 0 -- 30 minutes
+		AbsoluteTimeout config.Duration `toml:"absolute-timeout"` // 0 -- 12 hours
+	}
+
+	// SessionManager --
+	SessionManager struct {
+		cfg   SessionConfig
+		store SessionStore
+	}
+)
+
+const (
+	CtxSession = ContextKey("session")
+
+	ctxSessionAuth = ContextKey("session-auth")
+
+	SessionStoreMemory = "memory"
+	SessionStoreFile   = "file"
+	SessionStoreCookie = "cookie"
+
+	defaultSessionCookieName      = "___session"
+	defaultSessionIdleTimeout     = 30 * time.Minute
+	defaultSessionAbsoluteTimeout = 12 * time.Hour
+
+	// don't update the access time (and don't save the session) more often
+	sessionTouchPeriod = time.Minute
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// NewSessionManager --
+func NewSessionManager(cfg *SessionConfig) (sm *SessionManager, err error) {
+	sm = &SessionManager{
+		cfg: *cfg,
+	}
+
+	if sm.cfg.CookieName == "" {
+		sm.cfg.CookieName = defaultSessionCookieName
+	}
+
+	if sm.cfg.IdleTimeout <= 0 {
+		sm.cfg.IdleTimeout = config.Duration(defaultSessionIdleTimeout)
+	}
+
+	if sm.cfg.AbsoluteTimeout <= 0 {
+		sm.cfg.AbsoluteTimeout = config.Duration(defaultSessionAbsoluteTimeout)
+	}
+
+	ttl := sm.cfg.AbsoluteTimeout.D()
+
+	switch sm.cfg.Store {
+	case "", SessionStoreMemory:
+		sm.store = NewMemorySessionStore(ttl)
+	case SessionStoreFile:
+		sm.store, err = NewFileSessionStore(sm.cfg.Dir, ttl)
+	case SessionStoreCookie:
+		sm.store, err = NewCookieSessionStore([]byte(sm.cfg.Key), ttl)
+	default:
+		err = fmt.Errorf(`unknown session store "%s"`, sm.cfg.Store)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// NewSessionManagerWithStore -- for the custom stores
+func NewSessionManagerWithStore(cfg *SessionConfig, store SessionStore) (sm *SessionManager, err error) {
+	c := *cfg
+	c.Store = SessionStoreMemory
+
+	sm, err = NewSessionManager(&c)
+	if err != nil {
+		return
+	}
+
+	sm.store = store
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetSessionManager --
+func (h *HTTP) SetSessionManager(sm *SessionManager) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.sessions = sm
+}
+
+// Sessions --
+func (h *HTTP) Sessions() *SessionManager {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.sessions
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (sm *SessionManager) cookiePath(prefix string) string {
+	if prefix == "" {
+		return "/"
+	}
+	return prefix
+}
+
+func (sm *SessionManager) setCookie(w http.ResponseWriter, r *http.Request, prefix string, value string, maxAge int) {
+	http.SetCookie(w,
+		&http.Cookie{
+			Name:     sm.cfg.CookieName,
+			Value:    value,
+			Path:     sm.cookiePath(prefix),
+			MaxAge:   maxAge,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		},
+	)
+}
+
+func (sm *SessionManager) expired(s *Session, now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return now.Sub(s.Accessed) > sm.cfg.IdleTimeout.D() || now.Sub(s.Created) > sm.cfg.AbsoluteTimeout.D()
+}
+
+// touch -- updates the access time if it is too old, returns true if the session has to be saved
+func (s *Session) touch(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if now.Sub(s.Accessed) <= sessionTouchPeriod {
+		return false
+	}
+
+	s.Accessed = now
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// load -- called by the listener before dispatching, stores the existing session in the request context
+func (sm *SessionManager) load(id uint64, prefix string, w http.ResponseWriter, r *http.Request) *http.Request {
+	c, err := r.Cookie(sm.cfg.CookieName)
+	if err != nil || c.Value == "" {
+		return r
+	}
+
+	s, err := sm.store.Load(c.Value)
+	if err != nil {
+		Log.Message(log.DEBUG, `[%d] Session load: %s`, id, err)
+	}
+
+	if s == nil {
+		sm.setCookie(w, r, prefix, "", -1)
+		return r
+	}
+
+	now := time.Now()
+
+	if sm.expired(s, now) {
+		Log.Message(log.DEBUG, `[%d] Session %s expired`, id, s.ID)
+		sm.store.Delete(s)
+		sm.setCookie(w, r, prefix, "", -1)
+		return r
+	}
+
+	if s.touch(now) {
+		value, err := sm.store.Save(s)
+		if err != nil {
+			Log.Message(log.WARNING, `[%d] Session save: %s`, id, err)
+		} else if value != c.Value {
+			sm.setCookie(w, r, prefix, value, 0)
+		}
+	}
+
+	return AddValueToRequestContext(r, CtxSession, s)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Start -- returns the current session or creates the new one. The new request with the session in the context is returned too
+func (sm *SessionManager) Start(w http.ResponseWriter, r *http.Request, prefix string) (s *Session, newR *http.Request, err error) {
+	newR = r
+
+	s, err = GetSessionFromRequestContext(r)
+	if err != nil || s != nil {
+		return
+	}
+
+	now := time.Now()
+	s = &Session{
+		ID:       newSessionID(),
+		Created:  now,
+		Accessed: now,
+		Values:   make(map[string]any),
+	}
+
+	err = sm.Save(w, r, prefix, s)
+	if err != nil {
+		return nil, r, err
+	}
+
+	newR = AddValueToRequestContext(r, CtxSession, s)
+	return
+}
+
+// Save -- stores the session and updates the cookie. Must be called before writing the reply header
+func (sm *SessionManager) Save(w http.ResponseWriter, r *http.Request, prefix string, s *Session) (err error) {
+	value, err := sm.store.Save(s)
+	if err != nil {
+		return
+	}
+
+	sm.setCookie(w, r, prefix, value, 0)
+	return
+}
+
+// Rotate -- changes the session ID keeping values and the creation time (use it on login and on privileges change)
+func (sm *SessionManager) Rotate(w http.ResponseWriter, r *http.Request, prefix string, s *Session) (err error) {
+	s.mutex.Lock()
+	old := &Session{ID: s.ID, Created: s.Created}
+	s.ID = newSessionID()
+	s.Accessed = time.Now()
+	s.mutex.Unlock()
+
+	err = sm.Save(w, r, prefix, s)
+	if err != nil {
+		return
+	}
+
+	sm.store.Delete(old)
+	return
+}
+
+// Destroy -- removes the session and the cookie (logout)
+func (sm *SessionManager) Destroy(w http.ResponseWriter, r *http.Request, prefix string, s *Session) (err error) {
+	sm.setCookie(w, r, prefix, "", -1)
+
+	if s == nil {
+		return
+	}
+
+	return sm.store.Delete(s)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// GetSessionFromRequestContext --
+func GetSessionFromRequestContext(r *http.Request) (s *Session, err error) {
+	iface := GetValueFromRequestContext(r, CtxSession)
+	if iface == nil {
+		return
+	}
+
+	s, ok := iface.(*Session)
+	if !ok {
+		err = fmt.Errorf(`value of the "%s" in context is %T, expected %T`, CtxSession, iface, s)
+		return
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Get --
+func (s *Session) Get(name string) (v any, exists bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	v, exists = s.Values[name]
+	return
+}
+
+// Set --
+func (s *Session) Set(name string, v any) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Values == nil {
+		s.Values = make(map[string]any)
+	}
+	s.Values[name] = v
+}
+
+// Delete --
+func (s *Session) Delete(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.Values, name)
+}
+
+// SetIdentity --
+func (s *Session) SetIdentity(identity *auth.Identity) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Identity = identity
+}
+
+// GetIdentity --
+func (s *Session) GetIdentity() *auth.Identity {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.Identity
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+var errBadSessionID = errors.New("bad session ID")
+
+func checkSessionID(id string) error {
+	if len(id) < 16 || len(id) > 128 {
+		return errBadSessionID
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return errBadSessionID
+		}
+	}
+
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
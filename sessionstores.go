@@ -0,0 +1,355 @@
+package stdhttp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alrusov/jsonw"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// MemorySessionStore --
+	MemorySessionStore struct {
+		mutex     sync.Mutex
+		ttl       time.Duration
+		lastPurge time.Time
+		list      map[string]*Session
+	}
+
+	// FileSessionStore --
+	FileSessionStore struct {
+		mutex     sync.Mutex
+		dir       string
+		ttl       time.Duration
+		lastPurge time.Time
+	}
+
+	// CookieSessionStore -- all session data is stored in the encrypted cookie (keep it small, browsers limit cookies by 4K).
+	// Deleted sessions are revoked in the memory of this process only, they are valid again after restart and on other instances
+	CookieSessionStore struct {
+		aead      cipher.AEAD
+		mutex     sync.Mutex
+		ttl       time.Duration
+		lastPurge time.Time
+		revoked   map[string]time.Time // session ID -> session creation time
+	}
+)
+
+const (
+	sessionFileExt = ".session"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// NewMemorySessionStore --
+func NewMemorySessionStore(ttl time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{
+		ttl:       ttl,
+		lastPurge: time.Now(),
+		list:      make(map[string]*Session),
+	}
+}
+
+// Load --
+func (store *MemorySessionStore) Load(value string) (s *Session, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.list[value], nil
+}
+
+// Save --
+func (store *MemorySessionStore) Save(s *Session) (value string, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(store.lastPurge) > store.ttl/10 {
+		store.lastPurge = now
+		for id, s := range store.list {
+			if now.Sub(s.Created) > store.ttl {
+				delete(store.list, id)
+			}
+		}
+	}
+
+	store.list[s.ID] = s
+	return s.ID, nil
+}
+
+// Delete --
+func (store *MemorySessionStore) Delete(s *Session) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.list, s.ID)
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// NewFileSessionStore --
+func NewFileSessionStore(dir string, ttl time.Duration) (store *FileSessionStore, err error) {
+	if dir == "" {
+		return nil, fmt.Errorf("sessions directory is not defined")
+	}
+
+	dir, err = misc.AbsPath(dir)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+
+	store = &FileSessionStore{
+		dir: dir,
+		ttl: ttl,
+	}
+
+	return
+}
+
+func (store *FileSessionStore) fileName(id string) (string, error) {
+	err := checkSessionID(id)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(store.dir, id+sessionFileExt), nil
+}
+
+// Load --
+func (store *FileSessionStore) Load(value string) (s *Session, err error) {
+	fn, err := store.fileName(value)
+	if err != nil {
+		return
+	}
+
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	s = &Session{}
+	err = jsonw.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Save --
+func (store *FileSessionStore) Save(s *Session) (value string, err error) {
+	fn, err := store.fileName(s.ID)
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	data, err := jsonw.Marshal(s)
+	s.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	// the unique temporary name -- the concurrent saves of the same session don't clobber each other
+	fd, err := os.CreateTemp(store.dir, s.ID+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmp := fd.Name()
+
+	_, err = fd.Write(data)
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	store.purge()
+	return s.ID, nil
+}
+
+// Delete --
+func (store *FileSessionStore) Delete(s *Session) (err error) {
+	fn, err := store.fileName(s.ID)
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+func (store *FileSessionStore) purge() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(store.lastPurge) < store.ttl/10 {
+		return
+	}
+	store.lastPurge = now
+
+	list, err := os.ReadDir(store.dir)
+	if err != nil {
+		Log.Message(log.WARNING, "Session purge: %s", err)
+		return
+	}
+
+	for _, e := range list {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), sessionFileExt) {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil || now.Sub(fi.ModTime()) <= store.ttl {
+			continue
+		}
+
+		os.Remove(filepath.Join(store.dir, e.Name()))
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// NewCookieSessionStore --
+func NewCookieSessionStore(key []byte, ttl time.Duration) (store *CookieSessionStore, err error) {
+	if len(key) < 16 {
+		return nil, fmt.Errorf("session key is too short (16 bytes at least)")
+	}
+
+	k := sha256.Sum256(key)
+
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+
+	store = &CookieSessionStore{
+		aead:      aead,
+		ttl:       ttl,
+		lastPurge: time.Now(),
+		revoked:   make(map[string]time.Time),
+	}
+
+	return
+}
+
+// Load --
+func (store *CookieSessionStore) Load(value string) (s *Session, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return
+	}
+
+	ns := store.aead.NonceSize()
+	if len(data) < ns {
+		return nil, fmt.Errorf("session cookie is too short")
+	}
+
+	data, err = store.aead.Open(nil, data[:ns], data[ns:], nil)
+	if err != nil {
+		return
+	}
+
+	s = &Session{}
+	err = jsonw.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if store.isRevoked(s.ID) {
+		return nil, nil
+	}
+
+	return
+}
+
+// Save --
+func (store *CookieSessionStore) Save(s *Session) (value string, err error) {
+	s.mutex.Lock()
+	data, err := jsonw.Marshal(s)
+	s.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, store.aead.NonceSize())
+	rand.Read(nonce)
+
+	return base64.RawURLEncoding.EncodeToString(store.aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+// Delete -- the cookie is removed by the manager, the session ID is revoked until the session lifetime is over
+func (store *CookieSessionStore) Delete(s *Session) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(store.lastPurge) > store.ttl/10 {
+		store.lastPurge = now
+		for id, created := range store.revoked {
+			if now.Sub(created) > store.ttl {
+				delete(store.revoked, id)
+			}
+		}
+	}
+
+	created := s.Created
+	if created.IsZero() {
+		// the session data is unknown, keep the full lifetime
+		created = now
+	}
+
+	store.revoked[s.ID] = created
+	return
+}
+
+func (store *CookieSessionStore) isRevoked(id string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	_, exists := store.revoked[id]
+	return exists
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
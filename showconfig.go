@@ -12,6 +12,8 @@ import (
 // showConfig --
 func (h *HTTP) showConfig(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
 	d := []byte(config.GetSecuredText())
+	h.Audit(id, r, "show-config", "", nil)
+
 	err := WriteReply(w, r, http.StatusOK, ContentTypeText, nil, d)
 	if err != nil {
 		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
@@ -0,0 +1,479 @@
+package stdhttp
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// SSEConfig --
+	SSEConfig struct {
+		BufferSize   int             `toml:"buffer-size"`   // events kept for the Last-Event-ID replay, 0 -- 100, <0 -- no replay
+		KeepAlive    config.Duration `toml:"keep-alive"`    // comment sent to idle clients, 0 -- 15s, <0 -- disabled
+		Retry        config.Duration `toml:"retry"`         // reconnection time sent to clients, 0 -- not sent
+		ClientBuffer int             `toml:"client-buffer"` // events queued for the client, the slow client is disconnected on overflow, 0 -- 64
+	}
+
+	// SSEEvent --
+	SSEEvent struct {
+		ID    string    `json:"id"`
+		Topic string    `json:"topic,omitempty"` // empty -- for all clients
+		Event string    `json:"event,omitempty"` // empty -- "message"
+		Data  string    `json:"data"`
+		Time  time.Time `json:"time"`
+		seq   uint64
+	}
+
+	// SSEBroker -- fans the events out to the clients attached by Serve
+	SSEBroker struct {
+		name      string
+		cfg       SSEConfig
+		mutex     sync.Mutex
+		seq       uint64
+		history   []*SSEEvent // ring buffer
+		head      int
+		clients   map[*sseClient]bool
+		closed    bool
+		published uint64
+		dropped   uint64
+	}
+
+	// SSEFilter -- additional selection of the client events, must be fast
+	SSEFilter func(e *SSEEvent) bool
+
+	// SSEStat --
+	SSEStat struct {
+		Clients   int            `json:"clients" comment:"Connected clients"`
+		Topics    map[string]int `json:"topics,omitempty" comment:"Clients by topic"`
+		Published uint64         `json:"published" comment:"Published events"`
+		Dropped   uint64         `json:"dropped" comment:"Slow clients disconnected"`
+	}
+
+	sseClient struct {
+		topics misc.BoolMap // empty -- all
+		filter SSEFilter
+		ch     chan *SSEEvent
+		done   chan struct{}
+		once   sync.Once
+	}
+
+	sseEndpoint struct {
+		path   string
+		broker *SSEBroker
+	}
+)
+
+const (
+	defaultSSEBufferSize   = 100
+	defaultSSEKeepAlive    = 15 * time.Second
+	defaultSSEClientBuffer = 64
+
+	HTTPheaderLastEventID = "Last-Event-ID"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// NewSSEBroker -- the broker is shown in /maintenance/info and closed with the listener
+func (h *HTTP) NewSSEBroker(name string, cfg *SSEConfig) *SSEBroker {
+	b := &SSEBroker{
+		name:    name,
+		clients: make(map[*sseClient]bool),
+	}
+
+	if cfg != nil {
+		b.cfg = *cfg
+	}
+
+	if b.cfg.BufferSize == 0 {
+		b.cfg.BufferSize = defaultSSEBufferSize
+	}
+	if b.cfg.BufferSize > 0 {
+		b.history = make([]*SSEEvent, 0, b.cfg.BufferSize)
+	}
+
+	if b.cfg.KeepAlive == 0 {
+		b.cfg.KeepAlive = config.Duration(defaultSSEKeepAlive)
+	}
+
+	if b.cfg.ClientBuffer <= 0 {
+		b.cfg.ClientBuffer = defaultSSEClientBuffer
+	}
+
+	h.Lock()
+	if h.sseBrokers == nil {
+		h.sseBrokers = make(map[string]*SSEBroker)
+	}
+	if old, exists := h.sseBrokers[name]; exists {
+		defer old.Close()
+	}
+	h.sseBrokers[name] = b
+	h.Unlock()
+
+	return b
+}
+
+// AddSSEEndpoint -- clients are attached at the path, topics are taken from the "topic" query parameters. The request timeout is disabled for the path
+func (h *HTTP) AddSSEEndpoint(path string, b *SSEBroker, description string) {
+	if description == "" {
+		description = "Server-Sent Events ([topic=...])"
+	}
+
+	h.AddHandlerEx(&sseEndpoint{path: path, broker: b}, false)
+	h.AddEndpointsInfo(misc.StringMap{path: description})
+	h.SetEndpointTimeout(path, 0)
+}
+
+// Handler --
+func (e *sseEndpoint) Handler(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (processed bool, basePath string) {
+	if path != e.path {
+		return false, ""
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		Error(id, false, w, r, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		return true, path
+	}
+
+	e.broker.Serve(id, w, r, r.URL.Query()["topic"]...)
+	return true, path
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Publish -- returns the event ID
+func (b *SSEBroker) Publish(topic string, event string, data string) string {
+	return b.PublishEvent(&SSEEvent{Topic: topic, Event: event, Data: data})
+}
+
+// PublishEvent -- ID and Time are assigned by the broker
+func (b *SSEBroker) PublishEvent(ev *SSEEvent) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ""
+	}
+
+	b.seq++
+	e := *ev
+	e.seq = b.seq
+	e.ID = strconv.FormatUint(b.seq, 10)
+	e.Time = misc.NowUTC()
+
+	b.published++
+
+	if b.cfg.BufferSize > 0 {
+		if len(b.history) < b.cfg.BufferSize {
+			b.history = append(b.history, &e)
+		} else {
+			b.history[b.head] = &e
+			b.head = (b.head + 1) % b.cfg.BufferSize
+		}
+	}
+
+	for c := range b.clients {
+		if !c.wants(&e) {
+			continue
+		}
+
+		select {
+		case c.ch <- &e:
+		default:
+			// too slow
+			b.dropped++
+			delete(b.clients, c)
+			c.close()
+		}
+	}
+
+	return e.ID
+}
+
+// sseLastEventID -- the replay is requested by the numeric ID, 0 means all kept events.
+// No replay if the ID is absent or it is not a number (it was not issued by the broker)
+func sseLastEventID(r *http.Request) (after uint64, withReplay bool) {
+	lastID := r.Header.Get(HTTPheaderLastEventID)
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	if lastID == "" {
+		return 0, false
+	}
+
+	after, err := strconv.ParseUint(lastID, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return after, true
+}
+
+// replay -- must be called under lock
+func (b *SSEBroker) replay(c *sseClient, after uint64) (list []*SSEEvent) {
+	n := len(b.history)
+	for i := 0; i < n; i++ {
+		e := b.history[(b.head+i)%n]
+		if e.seq > after && c.wants(e) {
+			list = append(list, e)
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Serve -- streams the events of the topics (none -- all) to the client until it disconnects or the broker is closed.
+// Disable the request timeout for the endpoint (SetEndpointTimeout(path, 0)) if the handler is not added by AddSSEEndpoint.
+// The kept events after Last-Event-ID (or lastEventId parameter) are sent first, see sseLastEventID
+func (b *SSEBroker) Serve(id uint64, w http.ResponseWriter, r *http.Request, topics ...string) (err error) {
+	return b.ServeFiltered(id, w, r, nil, topics...)
+}
+
+// ServeFiltered -- Serve with the additional filter (nil -- none)
+func (b *SSEBroker) ServeFiltered(id uint64, w http.ResponseWriter, r *http.Request, filter SSEFilter, topics ...string) (err error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		err = fmt.Errorf("%T does not support flushing", w)
+		Error(id, false, w, r, http.StatusInternalServerError, "Streaming is not supported", err)
+		return
+	}
+
+	c := &sseClient{
+		topics: make(misc.BoolMap, len(topics)),
+		ch:     make(chan *SSEEvent, b.cfg.ClientBuffer),
+		done:   make(chan struct{}),
+		filter: filter,
+	}
+	for _, t := range topics {
+		c.topics[t] = true
+	}
+
+	after, withReplay := sseLastEventID(r)
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		err = fmt.Errorf(`broker "%s" is closed`, b.name)
+		Error(id, false, w, r, http.StatusServiceUnavailable, "Stream is closed", err)
+		return
+	}
+	var replay []*SSEEvent
+	if withReplay {
+		replay = b.replay(c, after)
+	}
+	b.clients[c] = true
+	b.mutex.Unlock()
+
+	defer b.detach(c)
+
+	Log.Message(log.DEBUG, `[%d] SSE client attached to "%s", topics %v, %d events replayed`, id, b.name, topics, len(replay))
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream; charset=utf-8")
+	hdr.Set(HTTPheaderCacheControl, "no-cache")
+	hdr.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if b.cfg.Retry > 0 {
+		_, err = fmt.Fprintf(w, "retry: %d\n\n", b.cfg.Retry.D().Milliseconds())
+		if err != nil {
+			return
+		}
+	}
+
+	for _, e := range replay {
+		err = writeSSEEvent(w, e)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	var keepAlive <-chan time.Time
+	if b.cfg.KeepAlive > 0 {
+		ticker := time.NewTicker(b.cfg.KeepAlive.D())
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			Log.Message(log.DEBUG, `[%d] SSE client of "%s" has gone`, id, b.name)
+			return nil
+
+		case <-c.done:
+			Log.Message(log.DEBUG, `[%d] SSE client of "%s" disconnected by the broker`, id, b.name)
+			return nil
+
+		case e := <-c.ch:
+			err = writeSSEEvent(w, e)
+
+		case <-keepAlive:
+			_, err = w.Write([]byte(": keep-alive\n\n"))
+		}
+
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (b *SSEBroker) detach(c *sseClient) {
+	b.mutex.Lock()
+	delete(b.clients, c)
+	b.mutex.Unlock()
+
+	c.close()
+}
+
+func writeSSEEvent(w http.ResponseWriter, e *SSEEvent) (err error) {
+	var sb strings.Builder
+
+	sb.WriteString("id: ")
+	sb.WriteString(sseField(e.ID))
+	sb.WriteByte('\n')
+
+	if e.Event != "" {
+		sb.WriteString("event: ")
+		sb.WriteString(sseField(e.Event))
+		sb.WriteByte('\n')
+	}
+
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	for line := range strings.SplitSeq(data, "\n") {
+		sb.WriteString("data: ")
+		sb.WriteString(strings.TrimSuffix(line, "\r"))
+		sb.WriteByte('\n')
+	}
+
+	sb.WriteByte('\n')
+
+	_, err = w.Write([]byte(sb.String()))
+	return
+}
+
+// sseField -- line breaks are not allowed in id and event
+func sseField(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (c *sseClient) wants(e *SSEEvent) bool {
+	if e.Topic != "" && len(c.topics) != 0 && !c.topics[e.Topic] {
+		return false
+	}
+
+	return c.filter == nil || c.filter(e)
+}
+
+func (c *sseClient) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Clients --
+func (b *SSEBroker) Clients() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.clients)
+}
+
+// Stat --
+func (b *SSEBroker) Stat() *SSEStat {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stat := &SSEStat{
+		Clients:   len(b.clients),
+		Published: b.published,
+		Dropped:   b.dropped,
+	}
+
+	for c := range b.clients {
+		for t := range c.topics {
+			if stat.Topics == nil {
+				stat.Topics = make(map[string]int)
+			}
+			stat.Topics[t]++
+		}
+	}
+
+	return stat
+}
+
+func (b *SSEBroker) isClosed() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.closed
+}
+
+// Close -- disconnects all clients, the following Publish and Serve calls do nothing
+func (b *SSEBroker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+
+	for c := range b.clients {
+		c.close()
+	}
+	b.clients = make(map[*sseClient]bool)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SSEStat -- nil if there are no brokers
+func (h *HTTP) SSEStat() map[string]*SSEStat {
+	h.Lock()
+	brokers := make([]*SSEBroker, 0, len(h.sseBrokers))
+	for _, b := range h.sseBrokers {
+		brokers = append(brokers, b)
+	}
+	h.Unlock()
+
+	if len(brokers) == 0 {
+		return nil
+	}
+
+	stat := make(map[string]*SSEStat, len(brokers))
+	for _, b := range brokers {
+		stat[b.name] = b.Stat()
+	}
+
+	return stat
+}
+
+func (h *HTTP) closeSSEBrokers() {
+	h.Lock()
+	brokers := h.sseBrokers
+	h.sseBrokers = nil
+	h.Unlock()
+
+	for _, b := range brokers {
+		b.Close()
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
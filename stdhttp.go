@@ -131,13 +131,16 @@ func SendJSON(w http.ResponseWriter, r *http.Request, statusCode int, data any)
 //-----------------------------------------------------------------------------s-----------------------------------------------//
 
 type ErrorResponse struct {
-	Message string `json:"error"`
+	Message   string `json:"error"`
+	RequestID string `json:"requestID,omitempty"`
 }
 
 // Error --
 func Error(id uint64, answerSent bool, w http.ResponseWriter, r *http.Request, httpCode int, message string, err error) {
+	rid := GetRequestID(r)
+
 	if w != nil && !answerSent {
-		msg := ErrorResponse{Message: message}
+		msg := ErrorResponse{Message: message, RequestID: rid}
 		SendJSON(w, r, httpCode, msg)
 	}
 
@@ -145,6 +148,9 @@ func Error(id uint64, answerSent bool, w http.ResponseWriter, r *http.Request, h
 	if err != nil {
 		s = " (" + err.Error() + ")"
 	}
+	if rid != "" {
+		s += " {" + rid + "}"
+	}
 	Log.Message(log.DEBUG, `[%d] Reply: %d - "%s"%s`, id, httpCode, message, s)
 }
 
@@ -205,12 +211,18 @@ func ReturnRefresh(id uint64, w http.ResponseWriter, r *http.Request, httpCode i
 
 // BodyReader -- get body reader with gz (if needed), buffering and stripped BOM
 type bodyReader struct {
-	body io.ReadCloser
-	gzip io.ReadCloser
-	buf  *bufio.Reader
+	body       io.ReadCloser
+	gzip       io.ReadCloser
+	buf        *bufio.Reader
+	bomChecked bool
 }
 
 func BodyReader(header http.Header, body io.ReadCloser) (br io.ReadCloser, err error) {
+	return newBodyReader(header, body, false)
+}
+
+// newBodyReader -- keepBOM is decided by the endpoint before the body is read by anybody
+func newBodyReader(header http.Header, body io.ReadCloser, keepBOM bool) (br io.ReadCloser, err error) {
 	reader := &bodyReader{
 		body: body,
 	}
@@ -231,24 +243,61 @@ func BodyReader(header http.Header, body io.ReadCloser) (br io.ReadCloser, err e
 	}
 
 	reader.buf = bufio.NewReader(rd)
-	r, _, e := reader.buf.ReadRune()
-	eof := e != nil && e.Error() == io.EOF.Error()
-	if e != nil && !eof {
-		err = e
-		return
-	}
-	if !eof && r != '\uFEFF' {
-		reader.buf.UnreadRune() // Not a BOM -- put the rune back
-	}
+
+	// the endpoints registered by SetRawBodyEndpoint (uploads and so on) get the data as is
+	reader.bomChecked = keepBOM
 
 	return
 }
 
+func isBinaryContent(contentType string) bool {
+	ct, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	ct = strings.TrimSpace(ct)
+
+	return ct == "application/octet-stream" || ct == mimeOffsetOctetStream
+}
+
+// SetRawBodyEndpoint -- the request body of the endpoint is passed to the handler as is: the BOM is not stripped and the body is not logged at TRACE4
+func (h *HTTP) SetRawBodyEndpoint(pattern string) {
+	h.Lock()
+	defer h.Unlock()
+
+	// copy on write, the old one may be in use
+	list := make(misc.BoolMap, len(h.rawBodyEndpoints)+1)
+	for p := range h.rawBodyEndpoints {
+		list[p] = true
+	}
+	list[pattern] = true
+
+	h.rawBodyEndpoints = list
+}
+
+func (h *HTTP) isRawBodyEndpoint(path string) bool {
+	h.Lock()
+	list := h.rawBodyEndpoints
+	h.Unlock()
+
+	_, exists := isPathInList(path, list)
+	return exists
+}
+
 func (reader *bodyReader) Read(p []byte) (n int, err error) {
 	if reader == nil {
 		return
 	}
 
+	if !reader.bomChecked {
+		reader.bomChecked = true
+
+		bom, e := reader.buf.Peek(3)
+		if e != nil && e != io.EOF {
+			return 0, e
+		}
+		if string(bom) == "\uFEFF" {
+			reader.buf.Discard(len(bom))
+		}
+	}
+
 	return reader.buf.Read(p)
 }
 
@@ -1,11 +1,139 @@
 package stdhttp
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/alrusov/auth"
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+type testHandler struct{}
+
+func (testHandler) Handler(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (bool, string) {
+	return false, ""
+}
+
+// testFuncHandler -- handlers by path
+type testFuncHandler map[string]http.HandlerFunc
+
+func (th testFuncHandler) Handler(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) bool {
+	f, exists := th[path]
+	if !exists {
+		return false
+	}
+
+	f(w, r)
+	return true
+}
+
+func newTestListener(t *testing.T) *HTTP {
+	config.SetCommon(&config.Common{LoadAvgPeriod: config.Duration(60e9)})
+
+	cfg := &config.Listener{}
+	cfg.Auth.Endpoints = map[string]misc.BoolMap{}
+
+	h, err := NewListenerEx(cfg, testHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+func testRequest(h http.Handler, method string, target string, body io.Reader, headers misc.StringMap) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for n, v := range headers {
+		r.Header.Set(n, v)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestACMEChallenge(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "token1+http-01"), []byte("token1.thumbprint"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestListener(t)
+	h.AddAuthEndpoint("*", misc.BoolMap{"admin": true})
+	h.authEndpointsKeys["*"] = true
+
+	err = h.SetACME(&ACMEConfig{Enabled: true, Domains: []string{"example.com"}, CacheDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := h.acmeChallengeHandler()
+
+	type testData struct {
+		path   string
+		code   int
+		result string // body or Location
+	}
+
+	data := []testData{
+		{"/.well-known/acme-challenge/token1", http.StatusOK, "token1.thumbprint"},
+		{"/.well-known/acme-challenge/unknown", http.StatusNotFound, ""},
+		{"/maintenance", http.StatusFound, "https://example.com/maintenance"},
+	}
+
+	for i, p := range data {
+		i++
+
+		w := testRequest(handler, http.MethodGet, "http://example.com"+p.path, nil, nil)
+
+		result := w.Header().Get("Location")
+		if result == "" && w.Code == http.StatusOK {
+			result = w.Body.String()
+		}
+
+		if w.Code != p.code || (p.result != "" && result != p.result) {
+			t.Errorf(`[%d] failed: path "%s", result %d "%s", expected %d "%s"`, i, p.path, w.Code, result, p.code, p.result)
+		}
+
+		// the challenges go through the listener
+		throughListener := w.Header().Get(HTTPheaderRequestID) != ""
+		if throughListener != strings.HasPrefix(p.path, acmeChallengePrefix) {
+			t.Errorf(`[%d] failed: path "%s", processed by the listener "%v"`, i, p.path, throughListener)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func TestIsPathInList(t *testing.T) {
 	type testData struct {
 		config map[string]bool
@@ -57,3 +185,2584 @@ func TestIsPathInList(t *testing.T) {
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCORSOriginAllowed(t *testing.T) {
+	type testData struct {
+		origins []string
+		origin  string
+		allowed bool
+	}
+
+	data := []testData{
+		{[]string{}, "https://example.com", false},
+		{[]string{"*"}, "https://example.com", true},
+		{[]string{"https://example.com"}, "https://example.com", true},
+		{[]string{"https://example.com"}, "HTTPS://EXAMPLE.COM", true},
+		{[]string{"https://example.com"}, "http://example.com", false},
+		{[]string{"https://*.example.com"}, "https://www.example.com", true},
+		{[]string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "https://www.example.org", false},
+		{[]string{"http://localhost:*"}, "http://localhost:8080", true},
+	}
+
+	for i, p := range data {
+		i++
+
+		policy := &CORSPolicy{AllowedOrigins: p.origins}
+		allowed := policy.originAllowed(p.origin)
+		if allowed != p.allowed {
+			t.Errorf(`[%d] failed: origins "%v", origin "%s", result "%v", expected "%v"`, i, p.origins, p.origin, allowed, p.allowed)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCORSCredentials(t *testing.T) {
+	type testData struct {
+		origins     []string
+		origin      string
+		allowOrigin string
+		credentials bool
+	}
+
+	data := []testData{
+		{[]string{"*"}, "https://evil.example", "*", false},
+		{[]string{"https://*.example.com"}, "https://www.example.com", "https://www.example.com", false},
+		{[]string{"https://app.example.com"}, "https://app.example.com", "https://app.example.com", true},
+		{[]string{"https://APP.example.com", "*"}, "https://app.example.com", "https://app.example.com", true},
+		{[]string{"https://app.example.com", "*"}, "https://evil.example", "*", false},
+		{[]string{"https://app.example.com"}, "https://evil.example", "", false},
+	}
+
+	for i, p := range data {
+		i++
+
+		h := newTestListener(t)
+		h.AddCORSPolicy("/maintenance/csrf-token", &CORSPolicy{AllowedOrigins: p.origins, AllowCredentials: true})
+
+		w := testRequest(h, http.MethodGet, "/maintenance/csrf-token", nil, misc.StringMap{HTTPheaderOrigin: p.origin})
+
+		allowOrigin := w.Header().Get(HTTPheaderAccessControlAllowOrigin)
+		credentials := w.Header().Get(HTTPheaderAccessControlAllowCredentials) == "true"
+		if allowOrigin != p.allowOrigin || credentials != p.credentials {
+			t.Errorf(`[%d] failed: origins %v, origin "%s": got "%s" %t, expected "%s" %t`, i, p.origins, p.origin, allowOrigin, credentials, p.allowOrigin, p.credentials)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestHasPermission(t *testing.T) {
+	h := &HTTP{}
+	h.SetAuthz(&AuthzConfig{
+		Roles: map[string][]string{
+			"viewer":  {"reports.read"},
+			"editor":  {"+viewer", "reports.write"},
+			"auditor": {"audit.*"},
+			"loop":    {"+loop", "loop.x"},
+		},
+		Assign: map[string][]string{
+			"john":     {"editor"},
+			"@audit":   {"auditor"},
+			"@looping": {"loop"},
+		},
+	})
+
+	type testData struct {
+		identity   *auth.Identity
+		permission string
+		allowed    bool
+	}
+
+	data := []testData{
+		{nil, "reports.read", false},
+		{&auth.Identity{User: "admin", IsAdmin: true}, "anything", true},
+		{&auth.Identity{User: "john"}, "reports.read", true},
+		{&auth.Identity{User: "john"}, "reports.write", true},
+		{&auth.Identity{User: "john"}, "audit.read", false},
+		{&auth.Identity{User: "mary", Groups: []string{"audit"}}, "audit.read", true},
+		{&auth.Identity{User: "mary", Groups: []string{"audit"}}, "auditx", false},
+		{&auth.Identity{User: "mary", Groups: []string{"audit"}}, "reports.read", false},
+		{&auth.Identity{User: "bob", Groups: []string{"looping"}}, "loop.x", true},
+		{&auth.Identity{User: "nobody"}, "reports.read", false},
+	}
+
+	for i, p := range data {
+		i++
+
+		allowed := h.HasPermission(p.identity, p.permission)
+		if allowed != p.allowed {
+			t.Errorf(`[%d] failed: identity "%v", permission "%s", result "%v", expected "%v"`, i, p.identity, p.permission, allowed, p.allowed)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCSRF(t *testing.T) {
+	h := newTestListener(t)
+
+	token := csrfNewToken()
+	other := csrfNewToken()
+
+	type testData struct {
+		method string
+		cookie string
+		field  string
+		header string
+		code   int
+	}
+
+	data := []testData{
+		{http.MethodGet, token, token, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "", "", "", http.StatusForbidden},
+		{http.MethodPost, "", token, "", http.StatusForbidden},
+		{http.MethodPost, token, "", "", http.StatusForbidden},
+		{http.MethodPost, token, other, "", http.StatusForbidden},
+		{http.MethodPost, "abc.def", "abc.def", "", http.StatusForbidden},
+		{http.MethodPost, token, token, "", http.StatusNoContent},
+		{http.MethodPost, token, "", token, http.StatusNoContent},
+	}
+
+	for i, p := range data {
+		i++
+
+		r := httptest.NewRequest(p.method, "/maintenance/profiler-disable", strings.NewReader(CSRFFieldName+"="+p.field))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if p.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: p.cookie})
+		}
+		if p.header != "" {
+			r.Header.Set(CSRFHeaderName, p.header)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != p.code {
+			t.Errorf(`[%d] failed: %s cookie "%s", field "%s", header "%s", result %d, expected %d`, i, p.method, p.cookie, p.field, p.header, w.Code, p.code)
+		}
+	}
+}
+
+func TestEndpointsPageLinks(t *testing.T) {
+	h := newTestListener(t)
+	h.AddPostEndpointsInfo(misc.StringMap{"/app/post": "Application action"})
+
+	w := testRequest(h, http.MethodGet, "/maintenance/endpoints", nil, nil)
+	body := w.Body.String()
+
+	type testData struct {
+		path string
+		link bool
+	}
+
+	data := []testData{
+		{"/maintenance/info", true},
+		{"/maintenance/exit", false},
+		{"/maintenance/profiler-enable", false},
+		{"/maintenance/set-log-level", false},
+		{"/app/post", false},
+	}
+
+	for i, p := range data {
+		i++
+
+		link := strings.Contains(body, `href="`+p.path+`"`)
+		if link != p.link || !strings.Contains(body, p.path) {
+			t.Errorf(`[%d] failed: path "%s", link "%v", expected "%v"`, i, p.path, link, p.link)
+		}
+
+		h.Lock()
+		info := h.info.Endpoints[p.path]
+		h.Unlock()
+		if info == nil || info.PostOnly == p.link || strings.Contains(info.Description, "[POST]") {
+			t.Errorf(`[%d] failed: path "%s", unexpected endpoint info %#v`, i, p.path, info)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSessions(t *testing.T) {
+	type testData struct {
+		store string
+		dir   string
+		key   string
+	}
+
+	data := []testData{
+		{SessionStoreMemory, "", ""},
+		{SessionStoreFile, t.TempDir(), ""},
+		{SessionStoreCookie, "", "0123456789abcdef0123"},
+	}
+
+	cookieOf := func(w *httptest.ResponseRecorder, name string) string {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == name && c.MaxAge >= 0 {
+				return c.Value
+			}
+		}
+		return ""
+	}
+
+	for i, p := range data {
+		i++
+
+		sm, err := NewSessionManager(&SessionConfig{Store: p.store, Dir: p.dir, Key: p.key, AbsoluteTimeout: config.Duration(time.Hour)})
+		if err != nil {
+			t.Fatalf(`[%d] failed: %s`, i, err)
+		}
+
+		load := func(value string) *Session {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: value})
+			s, _ := GetSessionFromRequestContext(sm.load(0, "", httptest.NewRecorder(), r))
+			return s
+		}
+
+		w := httptest.NewRecorder()
+		s, _, err := sm.Start(w, httptest.NewRequest(http.MethodGet, "/", nil), "")
+		if err != nil {
+			t.Fatalf(`[%d] failed: %s`, i, err)
+		}
+		s.Set("v", "value")
+		w = httptest.NewRecorder()
+		sm.Save(w, httptest.NewRequest(http.MethodGet, "/", nil), "", s)
+
+		first := cookieOf(w, defaultSessionCookieName)
+		if ls := load(first); ls == nil || ls.ID != s.ID {
+			t.Errorf(`[%d] failed: %s store, session is not loaded`, i, p.store)
+			continue
+		} else if v, _ := ls.Get("v"); v != "value" {
+			t.Errorf(`[%d] failed: %s store, value "%v", expected "value"`, i, p.store, v)
+		}
+
+		w = httptest.NewRecorder()
+		sm.Rotate(w, httptest.NewRequest(http.MethodGet, "/", nil), "", s)
+		second := cookieOf(w, defaultSessionCookieName)
+
+		if load(first) != nil {
+			t.Errorf(`[%d] failed: %s store, the cookie before rotation is still valid`, i, p.store)
+		}
+		if ls := load(second); ls == nil || ls.ID != s.ID {
+			t.Errorf(`[%d] failed: %s store, the rotated session is not loaded`, i, p.store)
+		}
+
+		sm.Destroy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), "", s)
+		if load(second) != nil {
+			t.Errorf(`[%d] failed: %s store, the destroyed session is still valid`, i, p.store)
+		}
+
+		old := &Session{ID: newSessionID(), Created: time.Now().Add(-time.Hour), Accessed: time.Now().Add(-time.Hour)}
+		w = httptest.NewRecorder()
+		sm.Save(w, httptest.NewRequest(http.MethodGet, "/", nil), "", old)
+		if load(cookieOf(w, defaultSessionCookieName)) != nil {
+			t.Errorf(`[%d] failed: %s store, the idle session is still valid`, i, p.store)
+		}
+
+		created := time.Now().Add(-2 * time.Hour)
+		aged := &Session{ID: newSessionID(), Created: created, Accessed: time.Now(), Values: make(map[string]any)}
+		w = httptest.NewRecorder()
+		sm.Rotate(w, httptest.NewRequest(http.MethodGet, "/", nil), "", aged)
+		if !aged.Created.Equal(created) {
+			t.Errorf(`[%d] failed: %s store, the creation time is changed by rotation`, i, p.store)
+		}
+		if load(cookieOf(w, defaultSessionCookieName)) != nil {
+			t.Errorf(`[%d] failed: %s store, the rotated session outlived the absolute timeout`, i, p.store)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSafeBackPath(t *testing.T) {
+	type testData struct {
+		back     string
+		expected string
+	}
+
+	def := "/pfx/maintenance"
+
+	data := []testData{
+		{"", def},
+		{"/pfx/maintenance/info?x=1", "/pfx/maintenance/info?x=1"},
+		{"/", "/"},
+		{"maintenance", def},
+		{"//evil.com", def},
+		{"/\\evil.com", def},
+		{"\\\\evil.com", def},
+		{"/\t/evil.com", def},
+		{"/\n/evil.com", def},
+		{"\t//evil.com", def},
+		{"/\r\\evil.com", def},
+		{"/%2F/evil.com", def},
+		{"https://evil.com/", def},
+		{"javascript:alert(1)", def},
+		{"/ok\x00/x", "/ok/x"},
+	}
+
+	for i, p := range data {
+		i++
+
+		back := safeBackPath(p.back, "/pfx")
+		if back != p.expected {
+			t.Errorf(`[%d] failed: back %q, result "%s", expected "%s"`, i, p.back, back, p.expected)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestAudit(t *testing.T) {
+	h := newTestListener(t)
+
+	fn := filepath.Join(t.TempDir(), "audit.log")
+
+	err := h.SetAudit(&AuditConfig{File: fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 20 {
+			h.Audit(0, nil, "concurrent", "", nil)
+		}
+	}()
+	for range 5 {
+		h.SetAudit(&AuditConfig{File: fn})
+	}
+	<-done
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("X-Real-IP", "198.51.100.1") // not from the trusted proxy
+	h.Audit(1, r, "first", "details", nil)
+	h.Audit(2, r, "second", "", os.ErrNotExist)
+
+	// reloaded from the file
+	err = h.SetAudit(&AuditConfig{File: fn, BufferSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testData struct {
+		action  string
+		outcome string
+		ip      string
+	}
+
+	data := []testData{
+		{"second", AuditOutcomeError, "192.0.2.1"},
+		{"first", AuditOutcomeOK, "192.0.2.1"},
+	}
+
+	list := h.getAudit().list()
+	if len(list) != len(data) {
+		t.Fatalf(`got %d events, expected %d`, len(list), len(data))
+	}
+
+	for i, p := range data {
+		ev := list[i]
+		i++
+
+		if ev.Action != p.action || ev.Outcome != p.outcome || ev.IP != p.ip {
+			t.Errorf(`[%d] failed: got "%s/%s/%s", expected "%s/%s/%s"`, i, ev.Action, ev.Outcome, ev.IP, p.action, p.outcome, p.ip)
+		}
+	}
+
+	w := testRequest(h, http.MethodGet, "/maintenance/audit?format=json", nil, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"second"`) {
+		t.Errorf(`audit page failed: %d %s`, w.Code, w.Body.String())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestAPIKeyAuth(t *testing.T) {
+	hash := func(key string) string {
+		return string(auth.Hash([]byte(key), []byte("salt")))
+	}
+
+	ah := NewAPIKeyAuthHandler(
+		&APIKeyAuthConfig{
+			Enabled: true,
+			Salt:    "salt",
+			Clients: map[string]*APIKeyClient{
+				"svc": {
+					Groups: []string{"g1"},
+					Keys: []*APIKey{
+						{Name: "lower", Hash: hash("key1")},
+						{Name: "upper", Hash: " " + strings.ToUpper(hash("key2")) + " "},
+						{Name: "expired", Hash: hash("key3"), Expires: time.Now().Add(-time.Hour)},
+					},
+				},
+			},
+		},
+	)
+
+	err := ah.Init(&config.Listener{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testData struct {
+		header string
+		query  string
+		user   string
+		next   bool
+		err    bool
+	}
+
+	data := []testData{
+		{"", "", "", true, false},
+		{"key1", "", "svc", false, false},
+		{"", "key1", "svc", false, false},
+		{"key2", "", "svc", false, false},
+		{"key3", "", "", false, true},
+		{"bad", "", "", false, true},
+	}
+
+	for i, p := range data {
+		i++
+
+		r := httptest.NewRequest(http.MethodGet, "/?api_key="+p.query, nil)
+		if p.header != "" {
+			r.Header.Set(defaultAPIKeyHeader, p.header)
+		}
+
+		identity, next, err := ah.Check(0, "", "/", httptest.NewRecorder(), r)
+
+		user := ""
+		if identity != nil {
+			user = identity.User
+		}
+
+		if user != p.user || next != p.next || (err != nil) != p.err {
+			t.Errorf(`[%d] failed: got "%s", %v, %v; expected "%s", %v, %v`, i, user, next, err, p.user, p.next, p.err)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestClientAddr(t *testing.T) {
+	h := newTestListener(t)
+
+	err := h.SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testData struct {
+		remote   string
+		xff      string
+		realIP   string
+		expected string
+	}
+
+	data := []testData{
+		{"203.0.113.1:1000", "", "", "203.0.113.1"},
+		{"203.0.113.1:1000", "198.51.100.1", "198.51.100.2", "203.0.113.1"},
+		{"192.0.2.10:1000", "198.51.100.1", "", "198.51.100.1"},
+		{"192.0.2.10:1000", "1.1.1.1, 198.51.100.1, 10.1.1.1", "", "198.51.100.1"},
+		{"10.1.1.1:1000", "", "198.51.100.2", "198.51.100.2"},
+		{"10.1.1.1:1000", "garbage", "", "10.1.1.1"},
+		{"10.1.1.1:1000", "10.2.2.2", "", "10.1.1.1"},
+		{"[2001:db8::1]:1000", "198.51.100.1", "", "2001:db8::1"},
+	}
+
+	for i, p := range data {
+		i++
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = p.remote
+		if p.xff != "" {
+			r.Header.Set("X-Forwarded-For", p.xff)
+		}
+		if p.realIP != "" {
+			r.Header.Set("X-Real-IP", p.realIP)
+		}
+
+		ip := h.ClientAddr(r)
+		if ip != p.expected {
+			t.Errorf(`[%d] failed: got "%s", expected "%s"`, i, ip, p.expected)
+		}
+	}
+
+	if h.SetTrustedProxies([]string{"bad"}) == nil {
+		t.Errorf(`bad CIDR accepted`)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestBruteForce(t *testing.T) {
+	type testData struct {
+		lockUsers bool
+		remote    string
+		xff       string
+		user      string
+		allowed   bool
+	}
+
+	// 2 failures of "admin" from 203.0.113.1 with different forged X-Forwarded-For
+	data := []testData{
+		{false, "203.0.113.1:1", "", "", false},
+		{false, "203.0.113.1:2", "198.51.100.9", "other", false},
+		{false, "203.0.113.2:1", "", "", true},
+		{false, "203.0.113.2:1", "", "admin", true},
+		{true, "203.0.113.2:1", "", "admin", false},
+		{true, "203.0.113.2:1", "", "other", true},
+	}
+
+	for i, p := range data {
+		i++
+
+		h := newTestListener(t)
+		h.SetBruteForceProtection(&BruteForceConfig{Enabled: true, MaxFailures: 2, DelayStep: 1, MaxDelay: 1, LockUsers: p.lockUsers})
+
+		for j := range 2 {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "203.0.113.1:1234"
+			r.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(j))
+			h.authFailed(0, "admin", r)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = p.remote
+		if p.xff != "" {
+			r.Header.Set("X-Forwarded-For", p.xff)
+		}
+
+		w := httptest.NewRecorder()
+		allowed := h.checkLockout(0, p.user, w, r)
+		if allowed != p.allowed {
+			t.Errorf(`[%d] failed: got %v, expected %v`, i, allowed, p.allowed)
+		}
+		if !allowed && (w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "") {
+			t.Errorf(`[%d] failed: code %d, Retry-After "%s"`, i, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestAuthRejectedCounted(t *testing.T) {
+	h := newTestListener(t)
+	h.SetBruteForceProtection(&BruteForceConfig{Enabled: true, MaxFailures: 10, DelayStep: 1, MaxDelay: 1})
+
+	ah := NewAPIKeyAuthHandler(
+		&APIKeyAuthConfig{
+			Enabled: true,
+			Salt:    "salt",
+			Clients: map[string]*APIKeyClient{
+				"svc": {Keys: []*APIKey{{Name: "k", Hash: string(auth.Hash([]byte("key1"), []byte("salt")))}}},
+			},
+		},
+	)
+	if err := h.AddAuthHandler(ah); err != nil {
+		t.Fatal(err)
+	}
+	h.AddAuthEndpoint("/maintenance/info", misc.BoolMap{"svc": true})
+	h.authEndpointsKeys["/maintenance/info"] = true
+
+	type testData struct {
+		headers  misc.StringMap
+		code     int
+		failures uint64
+	}
+
+	data := []testData{
+		{nil, http.StatusUnauthorized, 0},
+		{misc.StringMap{"X-API-Key": "key1"}, http.StatusOK, 0},
+		{misc.StringMap{"X-API-Key": "wrong"}, http.StatusUnauthorized, 1},
+		{nil, http.StatusUnauthorized, 1},
+		{misc.StringMap{"X-API-Key": "wrong"}, http.StatusUnauthorized, 2},
+	}
+
+	for i, p := range data {
+		i++
+
+		w := testRequest(h, http.MethodGet, "/maintenance/info", nil, p.headers)
+		_, stat := h.bruteForce.list()
+		failures := stat.Failures
+		if w.Code != p.code || failures != p.failures {
+			t.Errorf(`[%d] failed: code %d, failures %d, expected %d, %d`, i, w.Code, failures, p.code, p.failures)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestRequestIDForwarding(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(HTTPheaderRequestID) + "|" + r.Header.Get("X-Corr-ID")))
+	}))
+	defer srv.Close()
+
+	incoming := func(header string) *http.Request {
+		h := newTestListener(t)
+		err := h.SetRequestIDConfig(&RequestIDConfig{Header: header, TrustIncoming: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(HTTPheaderRequestID, "rid-default")
+		r.Header.Set("X-Corr-ID", "rid-custom")
+		_, r = h.assignRequestID(httptest.NewRecorder(), r)
+		return r
+	}
+
+	type testData struct {
+		call     func() (*bytes.Buffer, *http.Response, error)
+		expected string
+	}
+
+	data := []testData{
+		{
+			func() (*bytes.Buffer, *http.Response, error) {
+				return Request(http.MethodGet, srv.URL, 0, nil, nil, nil)
+			},
+			"|",
+		},
+		{
+			func() (*bytes.Buffer, *http.Response, error) {
+				return Request(http.MethodGet, srv.URL, 0, misc.StringMap{RequestOptionRequestID: "rid-opt"}, nil, nil)
+			},
+			"rid-opt|",
+		},
+		{
+			func() (*bytes.Buffer, *http.Response, error) {
+				return RequestEx(http.MethodGet, srv.URL, 0, url.Values{RequestOptionRequestID: {"rid-opt"}}, nil, nil)
+			},
+			"rid-opt|",
+		},
+		{
+			func() (*bytes.Buffer, *http.Response, error) {
+				return RequestCtx(incoming("").Context(), http.MethodGet, srv.URL, 0, nil, nil, nil)
+			},
+			"rid-default|",
+		},
+		{
+			func() (*bytes.Buffer, *http.Response, error) {
+				return RequestCtx(incoming("X-Corr-ID").Context(), http.MethodGet, srv.URL, 0, nil, nil, nil)
+			},
+			"|rid-custom",
+		},
+		{
+			func() (*bytes.Buffer, *http.Response, error) {
+				return RequestCtx(incoming("").Context(), http.MethodGet, srv.URL, 0, nil, misc.StringMap{HTTPheaderRequestID: "explicit"}, nil)
+			},
+			"explicit|",
+		},
+	}
+
+	for i, p := range data {
+		i++
+
+		buf, _, err := p.call()
+		if err != nil {
+			t.Errorf(`[%d] failed: %s`, i, err)
+			continue
+		}
+
+		if buf.String() != p.expected {
+			t.Errorf(`[%d] failed: got "%s", expected "%s"`, i, buf.String(), p.expected)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestPanics(t *testing.T) {
+	h := newTestListener(t)
+	h.SetPanicConfig(&PanicConfig{Keep: 2})
+
+	h.AddHandler(
+		testFuncHandler{
+			"/panic": func(w http.ResponseWriter, r *http.Request) {
+				panic("test panic")
+			},
+			"/panic-after-write": func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				panic("late panic")
+			},
+			"/abort": func(w http.ResponseWriter, r *http.Request) {
+				panic(http.ErrAbortHandler)
+			},
+		},
+		false,
+	)
+
+	type testData struct {
+		path  string
+		code  int
+		count int // panics in the list after the request
+	}
+
+	data := []testData{
+		{"/panic", http.StatusInternalServerError, 1},
+		{"/panic-after-write", http.StatusAccepted, 2},
+		{"/abort", http.StatusOK, 2},
+		{"/panic", http.StatusInternalServerError, 2}, // the oldest one is dropped
+	}
+
+	for i, p := range data {
+		i++
+
+		w := testRequest(h, http.MethodGet, p.path, nil, nil)
+		if w.Code != p.code {
+			t.Errorf(`[%d] failed: code %d, expected %d`, i, w.Code, p.code)
+		}
+
+		list := h.panics.recent()
+		if len(list) != p.count {
+			t.Errorf(`[%d] failed: %d panics, expected %d`, i, len(list), p.count)
+		}
+	}
+
+	list := h.panics.recent()
+	if len(list) != 2 || list[0].Error != "test panic" || list[1].Error != "late panic" || list[0].Endpoint != "/panic" || list[0].Stack == "" {
+		t.Errorf(`bad panics list: %#v`, list)
+	}
+
+	w := testRequest(h, http.MethodGet, "/maintenance/panics?format=json", nil, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"test panic"`) {
+		t.Errorf(`panics page failed: %d %s`, w.Code, w.Body.String())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTimeouts(t *testing.T) {
+	h := newTestListener(t)
+	h.SetPanicConfig(&PanicConfig{})
+
+	err := h.SetTimeouts(&TimeoutConfig{Default: config.Duration(50 * time.Millisecond), StatusCode: http.StatusGatewayTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetEndpointTimeout("/exempt", 0)
+
+	latePanic := make(chan struct{})
+
+	h.AddHandler(
+		testFuncHandler{
+			"/fast": func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("fast"))
+			},
+			"/slow": func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				w.Write([]byte("slow"))
+			},
+			"/header-only": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Test", "value")
+			},
+			"/truncated": func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("partial"))
+				<-r.Context().Done()
+				w.Write([]byte(" rest"))
+			},
+			"/panic": func(w http.ResponseWriter, r *http.Request) {
+				panic("early panic")
+			},
+			"/late-panic": func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				time.Sleep(10 * time.Millisecond)
+				defer close(latePanic)
+				panic("late panic")
+			},
+			"/exempt": func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+				w.Write([]byte("exempt"))
+			},
+		},
+		false,
+	)
+
+	type testData struct {
+		path   string
+		code   int
+		body   string
+		header string
+	}
+
+	data := []testData{
+		{"/fast", http.StatusOK, "fast", ""},
+		{"/slow", http.StatusGatewayTimeout, "", ""},
+		{"/header-only", http.StatusOK, "", "value"},
+		{"/truncated", http.StatusOK, "partial", ""},
+		{"/panic", http.StatusInternalServerError, "", ""},
+		{"/late-panic", http.StatusGatewayTimeout, "", ""},
+		{"/exempt", http.StatusOK, "exempt", ""},
+	}
+
+	for i, p := range data {
+		i++
+
+		w := testRequest(h, http.MethodGet, p.path, nil, nil)
+
+		if w.Code != p.code {
+			t.Errorf(`[%d] failed: %s code %d, expected %d`, i, p.path, w.Code, p.code)
+		}
+		if p.body != "" && w.Body.String() != p.body {
+			t.Errorf(`[%d] failed: %s body "%s", expected "%s"`, i, p.path, w.Body.String(), p.body)
+		}
+		if w.Header().Get("X-Test") != p.header {
+			t.Errorf(`[%d] failed: %s X-Test "%s", expected "%s"`, i, p.path, w.Header().Get("X-Test"), p.header)
+		}
+	}
+
+	<-latePanic
+
+	var list []*PanicInfo
+	for range 100 {
+		list = h.panics.recent()
+		if len(list) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(list) != 2 || list[0].Error != "late panic" || list[0].Endpoint != "/late-panic" || list[1].Error != "early panic" {
+		t.Errorf(`bad panics list: %#v`, list)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestEndpointStatPanic(t *testing.T) {
+	h := newTestListener(t)
+	h.AddEndpointsInfo(misc.StringMap{"/panic": "Panics"})
+
+	h.AddHandler(
+		testFuncHandler{
+			"/panic": func(w http.ResponseWriter, r *http.Request) {
+				panic("test panic")
+			},
+		},
+		false,
+	)
+
+	w := testRequest(h, http.MethodGet, "/panic", nil, nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf(`got %d, expected %d`, w.Code, http.StatusInternalServerError)
+	}
+
+	type stat struct {
+		Total  uint64 `json:"total"`
+		Errors uint64 `json:"errors"`
+		Panics uint64 `json:"panics"`
+	}
+
+	var info struct {
+		Endpoints map[string]struct {
+			Stat stat `json:"stat"`
+		} `json:"endpoints"`
+	}
+
+	// the stat is updated asynchronously
+	var s stat
+	for range 100 {
+		w = testRequest(h, http.MethodGet, "/maintenance/info", nil, nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatalf(`info: %s`, err)
+		}
+
+		s = info.Endpoints["/panic"].Stat
+		if s.Total != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if s != (stat{Total: 1, Errors: 1, Panics: 1}) {
+		t.Errorf(`got %+v, expected 1 request with 1 error and 1 panic`, s)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// newTestFileListener -- the listener with the root directory filled by files (name -> content, "name/" -- directory)
+func newTestFileListener(t *testing.T, files misc.StringMap, cfg *FileServerConfig) (h *HTTP, root string) {
+	root = t.TempDir()
+
+	for name, content := range files {
+		fn := filepath.Join(root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			os.MkdirAll(fn, 0755)
+			continue
+		}
+
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		err := os.WriteFile(fn, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h = newTestListener(t)
+	h.listenerCfg.Root = root
+
+	if cfg != nil {
+		err := h.SetFileServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return
+}
+
+func TestFileServing(t *testing.T) {
+	h, root := newTestFileListener(t,
+		misc.StringMap{
+			"a.txt":     "hello world",
+			"dir/b.txt": "b",
+			"empty/":    "",
+		},
+		&FileServerConfig{Listing: true},
+	)
+
+	w := testRequest(h, http.MethodGet, "/a.txt", nil, nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf(`got %d, ETag "%s", Last-Modified "%s"`, w.Code, etag, w.Header().Get("Last-Modified"))
+	}
+
+	fi, _ := os.Stat(filepath.Join(root, "a.txt"))
+	modTime := fi.ModTime().UTC().Format(http.TimeFormat)
+
+	type testData struct {
+		method  string
+		path    string
+		headers misc.StringMap
+		code    int
+		body    string
+		header  string // name=value
+	}
+
+	data := []testData{
+		{http.MethodGet, "/a.txt", nil, http.StatusOK, "hello world", "Content-Type=text/plain; charset=utf-8"},
+		{http.MethodHead, "/a.txt", nil, http.StatusOK, "", "Content-Length=11"},
+		{http.MethodGet, "/a.txt", misc.StringMap{"Range": "bytes=0-4"}, http.StatusPartialContent, "hello", "Content-Range=bytes 0-4/11"},
+		{http.MethodGet, "/a.txt", misc.StringMap{"Range": "bytes=-5"}, http.StatusPartialContent, "world", ""},
+		{http.MethodGet, "/a.txt", misc.StringMap{"Range": "bytes=20-30"}, http.StatusRequestedRangeNotSatisfiable, "", ""},
+		{http.MethodGet, "/a.txt", misc.StringMap{"If-None-Match": etag}, http.StatusNotModified, "", ""},
+		{http.MethodGet, "/a.txt", misc.StringMap{"If-None-Match": `"other"`}, http.StatusOK, "hello world", ""},
+		{http.MethodGet, "/a.txt", misc.StringMap{"If-Modified-Since": modTime}, http.StatusNotModified, "", ""},
+		{http.MethodGet, "/a.txt", misc.StringMap{"Range": "bytes=0-4", "If-Range": `"other"`}, http.StatusOK, "hello world", ""},
+		{http.MethodPost, "/a.txt", nil, http.StatusMethodNotAllowed, "", "Allow=GET, HEAD"},
+		{http.MethodGet, "/dir", nil, http.StatusMovedPermanently, "", "Location=/dir/"},
+		{http.MethodGet, "/dir/", nil, http.StatusOK, "b.txt", ""},
+		{http.MethodGet, "/dir/?format=json", nil, http.StatusOK, `"name":"b.txt"`, ""},
+		{http.MethodGet, "/missing.txt", nil, http.StatusNotFound, "", ""},
+	}
+
+	for i, p := range data {
+		i++
+
+		w := testRequest(h, p.method, p.path, nil, p.headers)
+
+		if w.Code != p.code {
+			t.Errorf(`[%d] failed: %s %s code %d, expected %d`, i, p.method, p.path, w.Code, p.code)
+		}
+
+		if p.body != "" && !strings.Contains(w.Body.String(), p.body) {
+			t.Errorf(`[%d] failed: %s %s body "%s", expected "%s"`, i, p.method, p.path, w.Body.String(), p.body)
+		}
+
+		if p.header != "" {
+			n, v, _ := strings.Cut(p.header, "=")
+			if w.Header().Get(n) != v {
+				t.Errorf(`[%d] failed: %s %s header %s "%s", expected "%s"`, i, p.method, p.path, n, w.Header().Get(n), v)
+			}
+		}
+	}
+
+	// the root is opened once for all requests and closed with the listener
+	rt := h.fileRoot
+	testRequest(h, http.MethodGet, "/dir/b.txt", nil, nil)
+	if rt == nil || h.fileRoot != rt {
+		t.Errorf(`the root is reopened`)
+	}
+
+	h.Close()
+	if h.fileRoot != nil {
+		t.Errorf(`the root is not closed`)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestFilePrecompressedAndCache(t *testing.T) {
+	h, root := newTestFileListener(t,
+		misc.StringMap{
+			"app.css":    "body{}",
+			"app.css.gz": "GZ",
+			"app.css.br": "BR",
+			"big.txt":    strings.Repeat("x", 100),
+		},
+		&FileServerConfig{
+			Precompressed:    true,
+			CacheSize:        1000,
+			CacheMaxFileSize: 50,
+			CacheControl:     []CacheControlRule{{Pattern: `\.css$`, Value: "max-age=60"}},
+		},
+	)
+
+	type testData struct {
+		path     string
+		accept   string
+		body     string
+		encoding string
+		cc       string
+	}
+
+	data := []testData{
+		{"/app.css", "", "body{}", "", "max-age=60"},
+		{"/app.css", "gzip", "GZ", "gzip", "max-age=60"},
+		{"/app.css", "gzip, br", "BR", "br", "max-age=60"},
+		{"/app.css", "br;q=0, gzip", "GZ", "gzip", "max-age=60"},
+		{"/app.css", "*", "BR", "br", "max-age=60"},
+		{"/app.css", "identity", "body{}", "", "max-age=60"},
+		{"/big.txt", "gzip", strings.Repeat("x", 100), "", ""},
+	}
+
+	for i, p := range data {
+		i++
+
+		w := testRequest(h, http.MethodGet, p.path, nil, misc.StringMap{HTTPheaderAcceptEncoding: p.accept})
+
+		if w.Code != http.StatusOK || w.Body.String() != p.body {
+			t.Errorf(`[%d] failed: %s "%s" got %d "%s", expected "%s"`, i, p.path, p.accept, w.Code, w.Body.String(), p.body)
+		}
+
+		if e := w.Header().Get(HTTPheaderContentEncoding); e != p.encoding {
+			t.Errorf(`[%d] failed: %s "%s" encoding "%s", expected "%s"`, i, p.path, p.accept, e, p.encoding)
+		}
+
+		if ct := w.Header().Get("Content-Type"); p.path == "/app.css" && !strings.HasPrefix(ct, "text/css") {
+			t.Errorf(`[%d] failed: %s "%s" content type "%s"`, i, p.path, p.accept, ct)
+		}
+
+		if cc := w.Header().Get(HTTPheaderCacheControl); cc != p.cc {
+			t.Errorf(`[%d] failed: %s "%s" Cache-Control "%s", expected "%s"`, i, p.path, p.accept, cc, p.cc)
+		}
+
+		if w.Header().Get(HTTPheaderVary) != HTTPheaderAcceptEncoding {
+			t.Errorf(`[%d] failed: %s "%s" Vary "%s"`, i, p.path, p.accept, w.Header().Get(HTTPheaderVary))
+		}
+	}
+
+	// small files only are cached, the changed file is reread
+	stat := h.FileCacheStat()
+	if stat == nil || stat.Files != 3 || stat.Hits == 0 {
+		t.Fatalf(`bad cache stat %+v`, stat)
+	}
+
+	fn := filepath.Join(root, "app.css")
+	os.WriteFile(fn, []byte("body{color:red}"), 0644)
+	os.Chtimes(fn, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+
+	w := testRequest(h, http.MethodGet, "/app.css", nil, nil)
+	if w.Body.String() != "body{color:red}" {
+		t.Errorf(`the changed file: got "%s"`, w.Body.String())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestMountFS(t *testing.T) {
+	h := newTestListener(t)
+
+	app := fstest.MapFS{
+		"index.html":    {Data: []byte("spa index")},
+		"assets/app.js": {Data: []byte("js")},
+	}
+	docs := fstest.MapFS{
+		"index.html": {Data: []byte("docs index")},
+		"page.html":  {Data: []byte("docs page")},
+	}
+
+	err := h.MountFS("/app", app, &MountOptions{SPA: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.MountFS("/app/docs/", docs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.MountFS("/bad", app, &MountOptions{SPA: true, SPAIndex: "../index.html"}) == nil {
+		t.Errorf(`bad SPA index accepted`)
+	}
+
+	type testData struct {
+		path string
+		code int
+		body string
+	}
+
+	data := []testData{
+		{"/app/", http.StatusOK, "spa index"},
+		{"/app/assets/app.js", http.StatusOK, "js"},
+		{"/app/some/route", http.StatusOK, "spa index"},
+		{"/app/docs/page.html", http.StatusOK, "docs page"},
+		{"/app/docs/", http.StatusOK, "docs index"},
+		{"/app/docs/missing", http.StatusNotFound, ""},
+		{"/app/assets/../../etc/passwd", http.StatusNotFound, ""},
+		{"/other", http.StatusNotFound, ""},
+	}
+
+	for i, p := range data {
+		i++
+
+		w := testRequest(h, http.MethodGet, p.path, nil, nil)
+		if w.Code != p.code || (p.body != "" && w.Body.String() != p.body) {
+			t.Errorf(`[%d] failed: %s got %d "%s", expected %d "%s"`, i, p.path, w.Code, w.Body.String(), p.code, p.body)
+		}
+	}
+
+	// no modification time in MapFS, the ETag is by the content
+	w := testRequest(h, http.MethodGet, "/app/assets/app.js", nil, nil)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf(`no ETag`)
+	}
+
+	w = testRequest(h, http.MethodGet, "/app/assets/app.js", nil, misc.StringMap{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf(`If-None-Match: got %d, expected %d`, w.Code, http.StatusNotModified)
+	}
+
+	h.UnmountFS("/app/docs")
+	w = testRequest(h, http.MethodGet, "/app/docs/page.html", nil, nil)
+	if w.Body.String() != "spa index" {
+		t.Errorf(`after unmount: got %d "%s"`, w.Code, w.Body.String())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestFileGuard(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	os.WriteFile(outside, []byte("outside"), 0644)
+
+	files := misc.StringMap{
+		"a.txt":              "a",
+		".env":               "secret",
+		".git/config":        "git",
+		".well-known/x":      "wk",
+		"secret.bak":         "bak",
+		"private/x.txt":      "private",
+		"public/private.txt": "public",
+	}
+
+	links := func(root string) {
+		os.Symlink("a.txt", filepath.Join(root, "link-in"))
+		os.Symlink(outside, filepath.Join(root, "link-out"))
+		os.Symlink(filepath.Dir(outside), filepath.Join(root, "dir-out"))
+	}
+
+	type testData struct {
+		cfg        *FileServerConfig
+		path       string
+		code       int
+		rejections FileRejections // after the request
+	}
+
+	deny := []string{"*.bak", "/private/*"}
+
+	data := []testData{
+		{&FileServerConfig{}, "/a.txt", http.StatusOK, nil},
+		{&FileServerConfig{}, "/.env", http.StatusNotFound, FileRejections{RejectDotfile: 1}},
+		{&FileServerConfig{}, "/.git/config", http.StatusNotFound, FileRejections{RejectDotfile: 1}},
+		{&FileServerConfig{}, "/.well-known/x", http.StatusOK, nil},
+		{&FileServerConfig{Dotfiles: DotfilesDeny}, "/.env", http.StatusForbidden, FileRejections{RejectDotfile: 1}},
+		{&FileServerConfig{Dotfiles: DotfilesAllow}, "/.env", http.StatusOK, nil},
+		{&FileServerConfig{}, "/link-in", http.StatusOK, nil},
+		{&FileServerConfig{}, "/link-out", http.StatusNotFound, FileRejections{RejectSymlink: 1}},
+		{&FileServerConfig{}, "/dir-out/outside.txt", http.StatusNotFound, FileRejections{RejectSymlink: 1}},
+		{&FileServerConfig{}, "/a.txt/x", http.StatusNotFound, nil},
+		{&FileServerConfig{}, "/missing/x", http.StatusNotFound, nil},
+		{&FileServerConfig{Symlinks: SymlinksDeny}, "/link-in", http.StatusNotFound, FileRejections{RejectSymlink: 1}},
+		{&FileServerConfig{Symlinks: SymlinksDeny}, "/a.txt/x", http.StatusNotFound, nil},
+		{&FileServerConfig{Symlinks: SymlinksAll}, "/link-out", http.StatusOK, nil},
+		{&FileServerConfig{Deny: deny}, "/secret.bak", http.StatusNotFound, FileRejections{RejectDenied: 1}},
+		{&FileServerConfig{Deny: deny}, "/private/x.txt", http.StatusNotFound, FileRejections{RejectDenied: 1}},
+		{&FileServerConfig{Deny: deny}, "/public/private.txt", http.StatusOK, nil},
+	}
+
+	for i, p := range data {
+		i++
+
+		h, root := newTestFileListener(t, files, p.cfg)
+		links(root)
+
+		w := testRequest(h, http.MethodGet, p.path, nil, nil)
+		if w.Code != p.code {
+			t.Errorf(`[%d] failed: %s code %d, expected %d`, i, p.path, w.Code, p.code)
+		}
+
+		rejections := h.FileRejections()
+		if fmt.Sprint(rejections) != fmt.Sprint(p.rejections) {
+			t.Errorf(`[%d] failed: %s rejections %v, expected %v`, i, p.path, rejections, p.rejections)
+		}
+	}
+
+	h := newTestListener(t)
+	if h.SetFileServer(&FileServerConfig{Symlinks: "bad"}) == nil || h.SetFileServer(&FileServerConfig{Deny: []string{"["}}) == nil {
+		t.Errorf(`bad config accepted`)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestResumableUploads(t *testing.T) {
+	h := newTestListener(t)
+	dir := t.TempDir()
+
+	_, err := h.AddResumableUploads("/files", &ResumableConfig{Dir: dir})
+	if err == nil {
+		t.Errorf(`OnComplete is not checked`)
+	}
+
+	var completed *ResumableUpload
+	var completedData string
+
+	_, err = h.AddResumableUploads("/files",
+		&ResumableConfig{
+			Dir:       dir,
+			MaxSize:   100,
+			Checksums: []string{ChecksumMD5},
+			OnComplete: func(id uint64, r *http.Request, u *ResumableUpload) error {
+				completed = u
+				data, _ := os.ReadFile(u.Path)
+				completedData = string(data)
+				return os.Remove(u.Path)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := func(s string) string {
+		h := md5.Sum([]byte(s))
+		return ChecksumMD5 + " " + base64.StdEncoding.EncodeToString(h[:])
+	}
+
+	type testData struct {
+		method  string
+		headers misc.StringMap
+		body    string
+		code    int
+		offset  string
+	}
+
+	tus := func(headers misc.StringMap) misc.StringMap {
+		m := misc.StringMap{HTTPheaderTusResumable: tusVersion, "Content-Type": mimeOffsetOctetStream}
+		for n, v := range headers {
+			m[n] = v
+		}
+		return m
+	}
+
+	data := []testData{
+		{http.MethodHead, tus(nil), "", http.StatusOK, "0"},
+		{http.MethodPatch, tus(misc.StringMap{HTTPheaderUploadOffset: "0"}), "hello", http.StatusNoContent, "5"},
+		{http.MethodPatch, tus(misc.StringMap{HTTPheaderUploadOffset: "0"}), "again", http.StatusConflict, ""},
+		{http.MethodPatch, tus(misc.StringMap{HTTPheaderUploadOffset: "5", "Content-Type": "text/plain"}), " ", http.StatusUnsupportedMediaType, ""},
+		{http.MethodPatch, tus(misc.StringMap{HTTPheaderUploadOffset: "5", HTTPheaderUploadChecksum: sum("other")}), " wor", StatusChecksumMismatch, ""},
+		{http.MethodHead, tus(nil), "", http.StatusOK, "5"},
+		{http.MethodPatch, tus(misc.StringMap{HTTPheaderUploadOffset: "5", HTTPheaderUploadChecksum: sum(" wor")}), " wor", http.StatusNoContent, "9"},
+		{http.MethodPatch, tus(misc.StringMap{HTTPheaderUploadOffset: "9"}), "ld!!", http.StatusRequestEntityTooLarge, ""},
+		{http.MethodHead, tus(misc.StringMap{HTTPheaderTusResumable: "0.2.0"}), "", http.StatusPreconditionFailed, ""},
+		{http.MethodPatch, tus(misc.StringMap{HTTPheaderUploadOffset: "9"}), "ld", http.StatusNoContent, "11"},
+		{http.MethodHead, tus(nil), "", http.StatusNotFound, ""},
+	}
+
+	w := testRequest(h, http.MethodPost, "/files", nil, tus(misc.StringMap{HTTPheaderUploadLength: "11", HTTPheaderUploadMetadata: "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))}))
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || !strings.HasPrefix(location, "/files/") {
+		t.Fatalf(`create: got %d, Location "%s"`, w.Code, location)
+	}
+
+	for i, p := range data {
+		i++
+
+		w := testRequest(h, p.method, location, strings.NewReader(p.body), p.headers)
+
+		if w.Code != p.code {
+			t.Errorf(`[%d] failed: %s code %d, expected %d`, i, p.method, w.Code, p.code)
+		}
+
+		if p.offset != "" && w.Header().Get(HTTPheaderUploadOffset) != p.offset {
+			t.Errorf(`[%d] failed: %s offset "%s", expected "%s"`, i, p.method, w.Header().Get(HTTPheaderUploadOffset), p.offset)
+		}
+	}
+
+	if completed == nil || completedData != "hello world" || completed.Metadata["filename"] != "a.txt" || completed.Checksums[ChecksumMD5] != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+		t.Errorf(`bad completed upload %#v "%s"`, completed, completedData)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf(`%d files are left in the uploads directory`, len(entries))
+	}
+
+	w = testRequest(h, http.MethodPost, "/files", nil, tus(misc.StringMap{HTTPheaderUploadLength: "101"}))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf(`too large: got %d`, w.Code)
+	}
+
+	// the uploaded data is stored as is, the BOM is not stripped
+	const bom = "\xEF\xBB\xBF"
+	w = testRequest(h, http.MethodPost, "/files", nil, tus(misc.StringMap{HTTPheaderUploadLength: "4"}))
+	w = testRequest(h, http.MethodPatch, w.Header().Get("Location"), strings.NewReader(bom+"a"), tus(misc.StringMap{HTTPheaderUploadOffset: "0"}))
+	if w.Code != http.StatusNoContent || completedData != bom+"a" {
+		t.Errorf(`BOM: got %d, data %q`, w.Code, completedData)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestMultipartUpload(t *testing.T) {
+	type file struct {
+		field string
+		name  string
+		ct    string
+		data  string
+	}
+
+	type testData struct {
+		cfg    UploadConfig
+		values misc.StringMap
+		files  []file
+		code   int
+	}
+
+	data := []testData{
+		{UploadConfig{Checksums: []string{ChecksumSHA256}}, misc.StringMap{"a": "1"}, []file{{"f", "a.txt", "text/plain", "hello world"}}, 0},
+		{UploadConfig{MaxFileSize: 5}, nil, []file{{"f", "a.txt", "text/plain", "hello world"}}, http.StatusRequestEntityTooLarge},
+		{UploadConfig{MaxTotalSize: 15}, misc.StringMap{"a": "1234567890"}, []file{{"f", "a.txt", "text/plain", "hello world"}}, http.StatusRequestEntityTooLarge},
+		{UploadConfig{MaxFiles: 1}, nil, []file{{"f", "a.txt", "text/plain", "a"}, {"f", "b.txt", "text/plain", "b"}}, http.StatusRequestEntityTooLarge},
+		{UploadConfig{MaxValueSize: 3}, misc.StringMap{"a": "1234"}, nil, http.StatusRequestEntityTooLarge},
+		{UploadConfig{ContentTypes: []string{"image/*"}}, nil, []file{{"f", "a.txt", "text/plain", "a"}}, http.StatusUnsupportedMediaType},
+		{UploadConfig{ContentTypes: []string{"image/*"}}, nil, []file{{"f", "a.png", "image/png", "\x89PNG\r\n\x1a\n"}}, 0},
+		{UploadConfig{ContentTypes: []string{"image/*"}}, nil, []file{{"f", "a.png", "image/png", "<html><script>alert(1)</script></html>"}}, http.StatusUnsupportedMediaType},
+		{UploadConfig{ContentTypes: []string{"image/*"}}, nil, []file{{"f", "a.png", "", "<html></html>"}}, http.StatusUnsupportedMediaType},
+		{UploadConfig{ContentTypes: []string{"application/json"}}, nil, []file{{"f", "a.json", "application/json", `{"a":1}`}}, 0},
+		{UploadConfig{Checksums: []string{"md4"}}, nil, nil, http.StatusInternalServerError},
+	}
+
+	for i, p := range data {
+		i++
+
+		dir := t.TempDir()
+		p.cfg.Dir = dir
+
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		for n, v := range p.values {
+			mw.WriteField(n, v)
+		}
+		for _, f := range p.files {
+			hdr := textproto.MIMEHeader{}
+			hdr.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, f.field, f.name))
+			hdr.Set("Content-Type", f.ct)
+			pw, _ := mw.CreatePart(hdr)
+			pw.Write([]byte(f.data))
+		}
+		mw.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/upload", body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+
+		result, err := ReceiveUpload(r, &p.cfg, nil)
+
+		if p.code != 0 {
+			if err == nil || UploadErrorCode(err) != p.code {
+				t.Errorf(`[%d] failed: got error "%v", expected code %d`, i, err, p.code)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf(`[%d] failed: %d files are left after the error`, i, len(entries))
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf(`[%d] failed: %s`, i, err)
+			continue
+		}
+
+		for n, v := range p.values {
+			if result.Values.Get(n) != v {
+				t.Errorf(`[%d] failed: value "%s" is "%s", expected "%s"`, i, n, result.Values.Get(n), v)
+			}
+		}
+
+		if len(result.Files) != len(p.files) {
+			t.Errorf(`[%d] failed: got %d files, expected %d`, i, len(result.Files), len(p.files))
+			continue
+		}
+
+		for j, f := range result.Files {
+			content, _ := os.ReadFile(f.Path)
+			if f.FileName != p.files[j].name || f.Size != int64(len(p.files[j].data)) || string(content) != p.files[j].data {
+				t.Errorf(`[%d] failed: bad file %#v "%s"`, i, f, content)
+			}
+			for _, alg := range p.cfg.Checksums {
+				if f.Checksums[alg] == "" {
+					t.Errorf(`[%d] failed: no %s checksum`, i, alg)
+				}
+			}
+		}
+
+		result.Cleanup()
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf(`[%d] failed: %d files are left after Cleanup`, i, len(entries))
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestBodyReaderBOM(t *testing.T) {
+	const bom = "\xEF\xBB\xBF"
+
+	type testData struct {
+		ct      string
+		keepBOM bool
+		body    string
+		result  string
+	}
+
+	data := []testData{
+		{"application/json", false, bom + `{"a":1}`, `{"a":1}`},
+		{"application/json", true, bom + `{"a":1}`, bom + `{"a":1}`},
+		{"application/octet-stream", false, bom + "data", "data"},
+		{"application/octet-stream", true, bom + "data", bom + "data"},
+		{mimeOffsetOctetStream, true, bom + "data", bom + "data"},
+		{"text/plain", false, "no bom", "no bom"},
+	}
+
+	for i, p := range data {
+		i++
+
+		header := http.Header{}
+		header.Set("Content-Type", p.ct)
+
+		br, err := newBodyReader(header, io.NopCloser(strings.NewReader(p.body)), p.keepBOM)
+		if err != nil {
+			t.Errorf(`[%d] failed: %s`, i, err)
+			continue
+		}
+
+		b, _ := io.ReadAll(br)
+		if string(b) != p.result {
+			t.Errorf(`[%d] failed: got %q, expected %q`, i, b, p.result)
+		}
+
+		if p.keepBOM {
+			continue
+		}
+
+		// the public reader strips the BOM for any content type
+		br, _ = BodyReader(header, io.NopCloser(strings.NewReader(p.body)))
+		b, _ = io.ReadAll(br)
+		if string(b) != p.result {
+			t.Errorf(`[%d] failed: BodyReader got %q, expected %q`, i, b, p.result)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTraceBody(t *testing.T) {
+	h := newTestListener(t)
+	h.SetRawBodyEndpoint("/raw")
+	h.SetEndpointTimeout("/stream", 0)
+
+	big := strings.Repeat("x", maxTraceBodySize+100)
+
+	type testData struct {
+		path string
+		ct   string
+		body string
+		read bool
+	}
+
+	data := []testData{
+		{"/text", "text/plain", "hello", true},
+		{"/text", "text/plain", big, true},
+		{"/text", "application/octet-stream", "hello", false},
+		{"/text", "multipart/form-data; boundary=x", "hello", false},
+		{"/raw", "text/plain", "hello", false},
+		{"/stream", "text/plain", "hello", false},
+	}
+
+	for i, p := range data {
+		i++
+
+		src := &countingReader{r: strings.NewReader(p.body)}
+		r := httptest.NewRequest(http.MethodPost, p.path, nil)
+		r.Body = io.NopCloser(src)
+		r.Header.Set("Content-Type", p.ct)
+
+		h.traceBody(uint64(i), p.path, h.isRawBodyEndpoint(p.path), r)
+
+		if (src.n != 0) != p.read {
+			t.Errorf(`[%d] failed: %d bytes are read before the handler`, i, src.n)
+		}
+
+		if src.n > maxTraceBodySize+1 {
+			t.Errorf(`[%d] failed: %d bytes are read, more than the limit`, i, src.n)
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		if string(b) != p.body {
+			t.Errorf(`[%d] failed: the handler got %d bytes, expected %d`, i, len(b), len(p.body))
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += n
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestWebDAV(t *testing.T) {
+	const bom = "\xEF\xBB\xBF"
+
+	files := misc.StringMap{
+		"a.txt":          "A",
+		".secret":        "S",
+		"private/p.txt":  "P",
+		"incoming/":      "",
+		"incoming/x.bak": "B",
+	}
+
+	type step struct {
+		user    string
+		method  string
+		path    string
+		body    string
+		headers misc.StringMap
+		code    int
+	}
+
+	type testData struct {
+		cfg     WebDAVConfig
+		fileCfg *FileServerConfig
+		steps   []step
+	}
+
+	data := []testData{
+		// read only by default
+		{
+			WebDAVConfig{Prefix: "/dav"},
+			nil,
+			[]step{
+				{"", "GET", "/dav/a.txt", "", nil, http.StatusOK},
+				{"admin", "PUT", "/dav/b.txt", "X", nil, http.StatusForbidden},
+				{"admin", "DELETE", "/dav/a.txt", "", nil, http.StatusForbidden},
+				{"admin", "MKCOL", "/dav/new", "", nil, http.StatusForbidden},
+			},
+		},
+		// write by the pattern and the user
+		{
+			WebDAVConfig{Prefix: "/dav", Write: map[string]misc.BoolMap{"/incoming/*": {"bob": true}}},
+			nil,
+			[]step{
+				{"bob", "PUT", "/dav/a.txt", "X", nil, http.StatusForbidden},
+				{"alice", "PUT", "/dav/incoming/b.txt", "X", nil, http.StatusForbidden},
+				{"", "PUT", "/dav/incoming/b.txt", "X", nil, http.StatusForbidden},
+				{"bob", "PUT", "/dav/incoming/b.txt", bom + "X", misc.StringMap{"Content-Type": "text/plain"}, http.StatusCreated},
+				{"bob", "GET", "/dav/incoming/b.txt", "", nil, http.StatusOK},
+				{"bob", "MOVE", "/dav/incoming/b.txt", "", misc.StringMap{"Destination": "/dav/c.txt"}, http.StatusForbidden},
+				{"bob", "MOVE", "/dav/incoming/b.txt", "", misc.StringMap{"Destination": "http://example.com/dav/incoming/c.txt"}, http.StatusCreated},
+				{"bob", "DELETE", "/dav/incoming/c.txt", "", nil, http.StatusNoContent},
+				{"bob", "PUT", "/dav/incoming/d.txt", bom + "Y", misc.StringMap{"Content-Type": "application/json"}, http.StatusCreated},
+			},
+		},
+		// read only overrides write
+		{
+			WebDAVConfig{Prefix: "/dav", ReadOnly: true, Write: map[string]misc.BoolMap{"/*": {"*": true}}},
+			nil,
+			[]step{
+				{"bob", "PUT", "/dav/incoming/b.txt", "X", nil, http.StatusForbidden},
+			},
+		},
+		// the file server rules
+		{
+			WebDAVConfig{Prefix: "/dav", Write: map[string]misc.BoolMap{"/*": {"bob": true}}},
+			&FileServerConfig{Deny: []string{"/private/*", "*.bak"}},
+			[]step{
+				{"", "GET", "/dav/.secret", "", nil, http.StatusNotFound},
+				{"bob", "PUT", "/dav/.secret", "X", nil, http.StatusNotFound},
+				{"bob", "PUT", "/dav/.hidden", "X", nil, http.StatusNotFound},
+				{"", "GET", "/dav/private/p.txt", "", nil, http.StatusForbidden},
+				{"", "GET", "/dav/incoming/x.bak", "", nil, http.StatusForbidden},
+				{"bob", "DELETE", "/dav/incoming/x.bak", "", nil, http.StatusForbidden},
+				{"bob", "MOVE", "/dav/a.txt", "", misc.StringMap{"Destination": "/dav/a.bak"}, http.StatusForbidden},
+				{"", "GET", "/dav/../../etc/passwd", "", nil, http.StatusNotFound},
+			},
+		},
+		{
+			WebDAVConfig{Prefix: "/dav"},
+			&FileServerConfig{Dotfiles: DotfilesDeny},
+			[]step{
+				{"", "GET", "/dav/.secret", "", nil, http.StatusForbidden},
+			},
+		},
+	}
+
+	for i, p := range data {
+		i++
+
+		h, root := newTestFileListener(t, files, p.fileCfg)
+
+		err := h.SetWebDAV(&p.cfg)
+		if err != nil {
+			t.Fatalf(`[%d] failed: %s`, i, err)
+		}
+
+		for j, s := range p.steps {
+			j++
+
+			r := httptest.NewRequest(s.method, s.path, strings.NewReader(s.body))
+			for n, v := range s.headers {
+				r.Header.Set(n, v)
+			}
+			if s.user != "" {
+				r = AddValueToRequestContext(r, CtxIdentity, &auth.Identity{User: s.user, IsAdmin: s.user == "admin"})
+			}
+			r.Body, _ = newBodyReader(r.Header, r.Body, h.isRawBodyEndpoint(r.URL.Path))
+
+			w := httptest.NewRecorder()
+			h.webdav.Handler(uint64(j), "", r.URL.Path, w, r)
+
+			if w.Code != s.code {
+				t.Errorf(`[%d.%d] failed: %s %s returned %d, expected %d`, i, j, s.method, s.path, w.Code, s.code)
+			}
+		}
+
+		if i == 2 {
+			// the BOM is kept in the stored file
+			if data, _ := os.ReadFile(filepath.Join(root, "incoming", "d.txt")); string(data) != bom+"Y" {
+				t.Errorf(`[%d] failed: the stored file is %q`, i, data)
+			}
+		}
+
+		listing := ""
+		for _, dir := range []string{"/dav/", "/dav/incoming/"} {
+			r := httptest.NewRequest("PROPFIND", dir, nil)
+			r.Header.Set("Depth", "1")
+			w := httptest.NewRecorder()
+			h.webdav.Handler(0, "", r.URL.Path, w, r)
+
+			if w.Code != http.StatusMultiStatus {
+				t.Errorf(`[%d] failed: PROPFIND %s returned %d`, i, dir, w.Code)
+			}
+			listing += w.Body.String()
+		}
+
+		if !strings.Contains(listing, "a.txt") {
+			t.Errorf(`[%d] failed: a.txt is not listed`, i)
+		}
+		if strings.Contains(listing, ".secret") || (p.fileCfg != nil && len(p.fileCfg.Deny) != 0 && strings.Contains(listing, "x.bak")) {
+			t.Errorf(`[%d] failed: the rejected names are listed: %s`, i, listing)
+		}
+
+		h.Close()
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSSEReplay(t *testing.T) {
+	h := newTestListener(t)
+	b := h.NewSSEBroker("test", &SSEConfig{BufferSize: 3, KeepAlive: -1})
+	defer b.Close()
+
+	for i := 1; i <= 4; i++ {
+		topic := "a"
+		if i%2 == 0 {
+			topic = "b"
+		}
+		b.Publish(topic, "", strconv.Itoa(i))
+	}
+
+	type testData struct {
+		header string
+		query  string
+		topics []string
+		ids    []string
+	}
+
+	data := []testData{
+		{"", "", nil, nil},
+		{"0", "", nil, []string{"2", "3", "4"}},
+		{"2", "", nil, []string{"3", "4"}},
+		{"4", "", nil, nil},
+		{"", "3", nil, []string{"4"}},
+		{"bad", "", nil, nil},
+		{"-1", "", nil, nil},
+		{"0", "", []string{"a"}, []string{"3"}},
+	}
+
+	for i, p := range data {
+		i++
+
+		target := "/events"
+		if p.query != "" {
+			target += "?lastEventId=" + p.query
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel() // Serve returns after the replay
+
+		r := httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx)
+		if p.header != "" {
+			r.Header.Set(HTTPheaderLastEventID, p.header)
+		}
+		w := httptest.NewRecorder()
+
+		err := b.Serve(uint64(i), w, r, p.topics...)
+		if err != nil {
+			t.Errorf(`[%d] failed: %s`, i, err)
+			continue
+		}
+
+		var ids []string
+		for line := range strings.SplitSeq(w.Body.String(), "\n") {
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				ids = append(ids, id)
+			}
+		}
+
+		if strings.Join(ids, ",") != strings.Join(p.ids, ",") {
+			t.Errorf(`[%d] failed: replayed %v, expected %v`, i, ids, p.ids)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestWebSocket(t *testing.T) {
+	h := newTestListener(t)
+	h.AddWebSocketEndpoint("/ws",
+		&WebSocketConfig{MaxMessageSize: 64, Compression: true, PingInterval: -1},
+		func(id uint64, c *WebSocketConn, r *http.Request) {
+			for {
+				mt, data, err := c.ReadMessage()
+				if err != nil || string(data) == "quit" {
+					return
+				}
+				c.WriteMessage(mt, data)
+			}
+		},
+		"",
+	)
+
+	if !h.timeoutExempt("/ws") {
+		t.Errorf(`the timeout is not disabled for the endpoint`)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	type frame struct {
+		fin     bool
+		rsv1    bool
+		opcode  byte
+		payload string
+	}
+
+	closeFrame := func(code int, reason string) frame {
+		return frame{true, false, wsClose, string(binary.BigEndian.AppendUint16(nil, uint16(code))) + reason}
+	}
+
+	deflated := func(s string) string {
+		b, _ := deflateMessage([]byte(s))
+		return string(b)
+	}
+
+	type testData struct {
+		unmasked bool
+		send     []frame
+		expect   []frame // the connection must be closed by the server after them
+	}
+
+	data := []testData{
+		// close handshake initiated by the client
+		{false, []frame{{true, false, WebSocketText, "hello"}, closeFrame(WebSocketCloseNormal, "bye")},
+			[]frame{{true, false, WebSocketText, "hello"}, closeFrame(WebSocketCloseNormal, "")}},
+		// close handshake initiated by the server when the handler returns
+		{false, []frame{{true, false, WebSocketBinary, "\x00\x01"}, {true, false, WebSocketText, "quit"}},
+			[]frame{{true, false, WebSocketBinary, "\x00\x01"}, closeFrame(WebSocketCloseNormal, "")}},
+		// fragmentation with the control frame inside
+		{false, []frame{{false, false, WebSocketText, "hel"}, {true, false, wsPing, "p"}, {true, false, wsContinuation, "lo"}, {true, false, WebSocketText, "quit"}},
+			[]frame{{true, false, wsPong, "p"}, {true, false, WebSocketText, "hello"}, closeFrame(WebSocketCloseNormal, "")}},
+		{false, []frame{{true, false, wsContinuation, "lo"}},
+			[]frame{closeFrame(WebSocketCloseProtocolError, "")}},
+		{false, []frame{{false, false, WebSocketText, "hel"}, {true, false, WebSocketText, "lo"}},
+			[]frame{closeFrame(WebSocketCloseProtocolError, "")}},
+		{false, []frame{{false, false, wsPing, "p"}},
+			[]frame{closeFrame(WebSocketCloseProtocolError, "")}},
+		// masking is required
+		{true, []frame{{true, false, WebSocketText, "hello"}},
+			[]frame{closeFrame(WebSocketCloseProtocolError, "")}},
+		// sizes
+		{false, []frame{{true, false, WebSocketText, strings.Repeat("x", 65)}},
+			[]frame{closeFrame(WebSocketCloseMessageTooBig, "")}},
+		{false, []frame{{false, false, WebSocketText, strings.Repeat("x", 40)}, {true, false, wsContinuation, strings.Repeat("x", 40)}},
+			[]frame{closeFrame(WebSocketCloseMessageTooBig, "")}},
+		// compression
+		{false, []frame{{true, true, WebSocketText, deflated("compressed")}, {true, false, WebSocketText, "quit"}},
+			[]frame{{true, false, WebSocketText, "compressed"}, closeFrame(WebSocketCloseNormal, "")}},
+		{false, []frame{{true, true, WebSocketText, deflated(strings.Repeat("x", 1000))}},
+			[]frame{closeFrame(WebSocketCloseMessageTooBig, "")}},
+		// payload validation
+		{false, []frame{{true, false, WebSocketText, "\xff"}},
+			[]frame{closeFrame(WebSocketCloseInvalidPayload, "")}},
+		{false, []frame{closeFrame(999, "")},
+			[]frame{closeFrame(WebSocketCloseProtocolError, "")}},
+	}
+
+	for i, p := range data {
+		i++
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+		fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n",
+			srv.Listener.Addr(), key)
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf(`[%d] failed: %s`, i, err)
+		}
+
+		sum := sha1.Sum([]byte(key + wsGUID))
+		if resp.StatusCode != http.StatusSwitchingProtocols ||
+			resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) ||
+			!strings.HasPrefix(resp.Header.Get("Sec-WebSocket-Extensions"), wsDeflate) {
+			t.Fatalf(`[%d] failed: bad handshake %d %v`, i, resp.StatusCode, resp.Header)
+		}
+
+		for _, f := range p.send {
+			b0 := f.opcode
+			if f.fin {
+				b0 |= 0x80
+			}
+			if f.rsv1 {
+				b0 |= 0x40
+			}
+
+			buf := []byte{b0}
+			n := len(f.payload)
+			switch {
+			case n <= 125:
+				buf = append(buf, byte(n))
+			default:
+				buf = binary.BigEndian.AppendUint16(append(buf, 126), uint16(n))
+			}
+
+			payload := []byte(f.payload)
+			if !p.unmasked {
+				mask := []byte{1, 2, 3, 4}
+				buf[1] |= 0x80
+				buf = append(buf, mask...)
+				for j := range payload {
+					payload[j] ^= mask[j&3]
+				}
+			}
+
+			conn.Write(append(buf, payload...))
+		}
+
+		for j, exp := range p.expect {
+			j++
+
+			var hdr [2]byte
+			if _, err := io.ReadFull(br, hdr[:]); err != nil {
+				t.Errorf(`[%d.%d] failed: %s`, i, j, err)
+				break
+			}
+
+			n := int(hdr[1] & 0x7f)
+			if n == 126 {
+				var b [2]byte
+				io.ReadFull(br, b[:])
+				n = int(binary.BigEndian.Uint16(b[:]))
+			}
+
+			payload := make([]byte, n)
+			io.ReadFull(br, payload)
+
+			got := frame{hdr[0]&0x80 != 0, hdr[0]&0x40 != 0, hdr[0] & 0x0f, string(payload)}
+			if hdr[1]&0x80 != 0 || got != exp {
+				t.Errorf(`[%d.%d] failed: got %#v, expected %#v`, i, j, got, exp)
+			}
+		}
+
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Errorf(`[%d] failed: the connection is not closed (%v)`, i, err)
+		}
+
+		conn.Close()
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestLogViewer(t *testing.T) {
+	h := newTestListener(t)
+	h.AddSSEEndpoint("/events", h.NewSSEBroker("events", nil), "")
+
+	err := h.SetTimeouts(&TimeoutConfig{Default: config.Duration(10 * time.Millisecond), Endpoints: map[string]config.Duration{"/slow": config.Duration(time.Second)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type timeoutData struct {
+		path string
+		d    time.Duration
+	}
+
+	timeouts := []timeoutData{
+		{logViewerStreamPath, 0},
+		{"/events", 0},
+		{"/slow", time.Second},
+		{"/maintenance/log", 10 * time.Millisecond},
+	}
+
+	for i, p := range timeouts {
+		i++
+		if d, _ := h.endpointTimeout(p.path); d != p.d {
+			t.Errorf(`[%d] failed: timeout of "%s" is %s, expected %s`, i, p.path, d, p.d)
+		}
+	}
+
+	// the config wins
+	h.SetTimeouts(&TimeoutConfig{Endpoints: map[string]config.Duration{logViewerStreamPath: config.Duration(time.Minute)}})
+	if d, _ := h.endpointTimeout(logViewerStreamPath); d != time.Minute {
+		t.Errorf(`the configured timeout of the log stream is %s, expected %s`, d, time.Minute)
+	}
+
+	short := func(level log.Level) string {
+		s, _ := log.GetLogLevelName(level)
+		return s
+	}
+
+	infoLine := "[1] " + short(log.INFO) + " 2026-10-19 10:00:00 <http> Request OK"
+	errLine := "[1] " + short(log.ERR) + " 2026-10-19 10:00:01 Something failed"
+
+	v := &logViewer{broker: h.NewSSEBroker("test-log", nil)}
+	v.publish([]string{infoLine, errLine, "  continuation", "", infoLine})
+
+	b := v.broker
+	b.mutex.Lock()
+	events := b.replay(&sseClient{}, 0)
+	b.mutex.Unlock()
+
+	if len(events) != 3 || events[1].Data != errLine+"\n  continuation" {
+		t.Fatalf(`bad published events %#v`, events)
+	}
+
+	type filterData struct {
+		query  string
+		result []bool // by events
+	}
+
+	filters := []filterData{
+		{"", []bool{true, true, true}},
+		{"facility=http", []bool{true, false, true}},
+		{"facility=", []bool{false, true, false}},
+		{"level=" + log.GetLogLevels()[log.WARNING], []bool{false, true, false}},
+		{"level=bad", []bool{true, true, true}},
+		{"text=CONTINUATION", []bool{false, true, false}},
+		{"facility=http&text=failed", []bool{false, false, false}},
+	}
+
+	for i, p := range filters {
+		i++
+
+		f := logFilter(httptest.NewRequest(http.MethodGet, logViewerStreamPath+"?"+p.query, nil))
+
+		for j, e := range events {
+			got := f == nil || f(e)
+			if got != p.result[j] {
+				t.Errorf(`[%d.%d] failed: "%s" got %t, expected %t`, i, j+1, p.query, got, p.result[j])
+			}
+		}
+	}
+
+	w := testRequest(h, http.MethodPost, logViewerStreamPath, nil, nil)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf(`POST to the log stream returned %d`, w.Code)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCSRFCredentials(t *testing.T) {
+	h := newTestListener(t)
+
+	ah := NewAPIKeyAuthHandler(
+		&APIKeyAuthConfig{
+			Enabled: true,
+			Salt:    "salt",
+			Clients: map[string]*APIKeyClient{
+				"svc": {Keys: []*APIKey{{Name: "k", Hash: string(auth.Hash([]byte("key1"), []byte("salt")))}}},
+			},
+		},
+	)
+	if err := ah.Init(h.listenerCfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddAuthHandler(ah); err != nil {
+		t.Fatal(err)
+	}
+	h.AddAuthEndpoint("/maintenance/set-log-level", misc.BoolMap{"svc": true})
+	h.authEndpointsKeys["/maintenance/set-log-level"] = true
+
+	log.NewFacility("csrf-test")
+
+	type testData struct {
+		headers misc.StringMap
+		code    int
+	}
+
+	data := []testData{
+		{nil, http.StatusUnauthorized},
+		{misc.StringMap{"X-API-Key": "key1"}, http.StatusOK},
+		{misc.StringMap{"X-API-Key": "key1", "Origin": "http://example.com"}, http.StatusOK},
+		{misc.StringMap{"X-API-Key": "key1", "Origin": "http://evil.example"}, http.StatusForbidden},
+		{misc.StringMap{"X-API-Key": "key1", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{misc.StringMap{"X-API-Key": "key1", "Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+	}
+
+	for i, p := range data {
+		i++
+
+		headers := misc.StringMap{"Content-Type": "application/x-www-form-urlencoded"}
+		for n, v := range p.headers {
+			headers[n] = v
+		}
+
+		w := testRequest(h, http.MethodPost, "/maintenance/set-log-level", strings.NewReader("facility=csrf-test&level=INFO&format=json"), headers)
+		if w.Code != p.code {
+			t.Errorf(`[%d] failed: %v returned %d, expected %d`, i, p.headers, w.Code, p.code)
+		}
+	}
+
+	// the session cookie is not enough
+	identity := &auth.Identity{User: "svc", Method: "form"}
+
+	r := httptest.NewRequest(http.MethodPost, "/maintenance/set-log-level", nil)
+	r = AddValueToRequestContext(r, CtxIdentity, identity)
+	if CheckCSRF(r) != nil {
+		t.Errorf(`the request with own credentials is not exempted`)
+	}
+
+	r = AddValueToRequestContext(r, ctxSessionAuth, true)
+	if CheckCSRF(r) != ErrCSRFMissing {
+		t.Errorf(`the session authenticated request is exempted`)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestLogLevelRevert(t *testing.T) {
+	h := newTestListener(t)
+
+	f := log.NewFacility("revert-test")
+	f.SetLogLevel("INFO", "")
+
+	level := func() string {
+		_, _, long := f.CurrentLogLevelEx()
+		return long
+	}
+
+	// the level is reverted under the lock of the pending list, so it is set when the list is seen empty
+	waitReverts := func() {
+		for deadline := time.Now().Add(5 * time.Second); len(h.LogLevelReverts()) != 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf(`the revert is not done`)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	call := func(values string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/maintenance/set-log-level", strings.NewReader("facility=revert-test&format=json&"+values))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.changeLogLevel(1, "", "/maintenance/set-log-level", w, r)
+		return w
+	}
+
+	w := call("level=TRACE4&duration=100ms")
+	var reply logLevelReply
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	if w.Code != http.StatusOK || reply.Previous != "INFO" || reply.RevertTo != "INFO" || reply.RevertAt == nil {
+		t.Fatalf(`bad reply %d %s`, w.Code, w.Body.String())
+	}
+
+	// the repeated temporary change keeps the original level
+	call("level=DEBUG&duration=100ms")
+	list := h.LogLevelReverts()
+	if len(list) != 1 || list[0].Level != "DEBUG" || list[0].RevertTo != "INFO" {
+		t.Fatalf(`bad pending reverts %#v`, list)
+	}
+
+	if level() != "DEBUG" {
+		t.Errorf(`level is %s, expected DEBUG`, level())
+	}
+
+	waitReverts()
+
+	if level() != "INFO" {
+		t.Errorf(`level is %s after the revert, expected INFO`, level())
+	}
+
+	// the permanent change cancels the pending revert
+	call("level=TRACE1&duration=100ms")
+	call("level=ERR")
+
+	// the stopped timer (or the late one finding nothing to revert) doesn't change the level
+	time.Sleep(200 * time.Millisecond)
+
+	if level() != "ERR" || len(h.LogLevelReverts()) != 0 {
+		t.Errorf(`level is %s after the cancelled revert, expected ERR`, level())
+	}
+
+	w = call("level=INFO&duration=bad")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf(`bad duration returned %d`, w.Code)
+	}
+
+	// Close reverts now
+	call("level=DEBUG&duration=1h")
+	h.Close()
+
+	if level() != "ERR" || len(h.LogLevelReverts()) != 0 {
+		t.Errorf(`level is %s after Close, expected ERR`, level())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSecurityHeaders(t *testing.T) {
+	h := newTestListener(t)
+
+	global := DefaultSecurityHeaders()
+	global.Extra = misc.StringMap{"X-Global": "g", "X-Both": "g"}
+
+	h.SetSecurityHeaders(&SecurityHeadersConfig{
+		Global: global,
+		Endpoints: map[string]*SecurityHeaders{
+			"/embed/*": {FrameOptions: "SAMEORIGIN", CSP: secHeaderDisabled, Extra: misc.StringMap{"X-Both": "l", "X-Global": secHeaderDisabled}},
+			"/no-hsts": {HSTS: -1},
+			"/preload": {HSTS: config.Duration(time.Hour), HSTSIncludeSubdomains: true, HSTSPreload: true},
+		},
+	})
+
+	type testData struct {
+		path    string
+		tls     bool
+		headers misc.StringMap // "" -- must be absent
+	}
+
+	data := []testData{
+		{"/", false, misc.StringMap{
+			HTTPheaderContentTypeOptions:      "nosniff",
+			HTTPheaderFrameOptions:            "DENY",
+			HTTPheaderReferrerPolicy:          "same-origin",
+			HTTPheaderPermissionsPolicy:       "camera=(), microphone=(), geolocation=()",
+			HTTPheaderStrictTransportSecurity: "",
+			"X-Global":                        "g",
+			"X-Both":                          "g",
+		}},
+		{"/", true, misc.StringMap{HTTPheaderStrictTransportSecurity: "max-age=31536000"}},
+		{"/embed/page", true, misc.StringMap{
+			HTTPheaderFrameOptions:            "SAMEORIGIN",
+			HTTPheaderContentSecurityPolicy:   "",
+			HTTPheaderContentTypeOptions:      "nosniff",
+			HTTPheaderStrictTransportSecurity: "max-age=31536000",
+			"X-Global":                        "",
+			"X-Both":                          "l",
+		}},
+		{"/no-hsts", true, misc.StringMap{HTTPheaderStrictTransportSecurity: "", HTTPheaderFrameOptions: "DENY"}},
+		{"/preload", true, misc.StringMap{HTTPheaderStrictTransportSecurity: "max-age=3600; includeSubDomains; preload"}},
+	}
+
+	for i, p := range data {
+		i++
+
+		r := httptest.NewRequest(http.MethodGet, p.path, nil)
+		if p.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		h.applySecurityHeaders(p.path, w, r)
+
+		for n, v := range p.headers {
+			if got := w.Header().Get(n); got != v {
+				t.Errorf(`[%d] failed: %s "%s" is "%s", expected "%s"`, i, p.path, n, got, v)
+			}
+		}
+	}
+
+	// the nonce
+	nonces := misc.BoolMap{}
+	for i := 1; i <= 3; i++ {
+		w := httptest.NewRecorder()
+		r := h.applySecurityHeaders("/", w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		nonce := GetCSPNonce(r)
+		csp := w.Header().Get(HTTPheaderContentSecurityPolicy)
+		if nonce == "" || nonces[nonce] || !strings.Contains(csp, "'nonce-"+nonce+"'") || strings.Contains(csp, cspNoncePlaceholder) {
+			t.Errorf(`[%d] failed: bad nonce "%s" in "%s"`, i, nonce, csp)
+		}
+		nonces[nonce] = true
+	}
+
+	if nonce := GetCSPNonce(httptest.NewRequest(http.MethodGet, "/", nil)); nonce != "" {
+		t.Errorf(`nonce "%s" without CSP`, nonce)
+	}
+
+	h.SetSecurityHeaders(nil)
+	w := httptest.NewRecorder()
+	h.applySecurityHeaders("/", w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(w.Header()) != 0 {
+		t.Errorf(`headers are sent after reset: %v`, w.Header())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestParseTraceParent(t *testing.T) {
+	type testData struct {
+		s       string
+		traceID string
+		spanID  string
+		sampled bool
+		ok      bool
+	}
+
+	data := []testData{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true, true},
+		{" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", false, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03-future", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true, true},
+		{"", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", "", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b-01", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", "", "", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", "", false, false},
+	}
+
+	for i, p := range data {
+		i++
+
+		traceID, spanID, sampled, err := ParseTraceParent(p.s)
+		if (err == nil) != p.ok {
+			t.Errorf(`[%d] failed: "%s", error "%v", expected ok "%v"`, i, p.s, err, p.ok)
+			continue
+		}
+		if !p.ok {
+			continue
+		}
+
+		if traceID.String() != p.traceID || spanID.String() != p.spanID || sampled != p.sampled {
+			t.Errorf(`[%d] failed: "%s", got %s-%s-%v, expected %s-%s-%v`, i, p.s, traceID, spanID, sampled, p.traceID, p.spanID, p.sampled)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTracingServerSpan(t *testing.T) {
+	h := newTestListener(t)
+	err := h.SetTracing(&TracingConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.SetTracing(nil)
+
+	type testData struct {
+		traceParent string
+		exported    bool
+		child       bool
+	}
+
+	data := []testData{
+		{"", true, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false, true},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", true, false},
+	}
+
+	for i, p := range data {
+		i++
+
+		before := len(h.Tracer().memory.Spans())
+
+		headers := misc.StringMap{}
+		if p.traceParent != "" {
+			headers[HTTPheaderTraceParent] = p.traceParent
+		}
+		testRequest(h, http.MethodGet, "/status/ping", nil, headers)
+
+		spans := h.Tracer().memory.Spans()
+		if (len(spans) > before) != p.exported {
+			t.Errorf(`[%d] failed: exported %v, expected %v`, i, len(spans) > before, p.exported)
+			continue
+		}
+		if !p.exported {
+			continue
+		}
+
+		span := spans[len(spans)-1]
+		if span.Kind != SpanKindServer || span.Name != "GET /status/ping" || span.Attributes["client.address"] != "192.0.2.1" {
+			t.Errorf(`[%d] failed: unexpected span %#v`, i, span)
+		}
+
+		child := span.TraceID.String() == "4bf92f3577b34da6a3ce929d0e0e4736" && span.ParentID.String() == "00f067aa0ba902b7"
+		if child != p.child || (!p.child && span.ParentID.IsValid()) {
+			t.Errorf(`[%d] failed: trace %s, parent %s, expected child "%v"`, i, span.TraceID, span.ParentID, p.child)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTracingSample(t *testing.T) {
+	type testData struct {
+		ratio   float64
+		low     bool
+		high    bool
+		allSame bool
+	}
+
+	data := []testData{
+		{0, true, true, true},
+		{1, true, true, true},
+		{0.5, true, false, false},
+	}
+
+	low := TraceID{}
+	high := TraceID{}
+	for j := 8; j < len(high); j++ {
+		high[j] = 0xff
+	}
+
+	for i, p := range data {
+		i++
+
+		h := newTestListener(t)
+		err := h.SetTracing(&TracingConfig{Enabled: true, SampleRatio: p.ratio, MemorySpans: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tr := h.Tracer()
+		if tr.memory != nil {
+			t.Errorf(`[%d] failed: memory exporter is created`, i)
+		}
+		if tr.sample(low) != p.low || tr.sample(high) != p.high {
+			t.Errorf(`[%d] failed: ratio %v, got %v/%v, expected %v/%v`, i, p.ratio, tr.sample(low), tr.sample(high), p.low, p.high)
+		}
+
+		// the sampling decision of the parent is inherited
+		parent := &Span{TraceID: high, SpanID: newSpanID(), Sampled: true}
+		if span := tr.newSpan(parent, "child", SpanKindInternal); !span.Sampled || span.TraceID != high || span.ParentID != parent.SpanID {
+			t.Errorf(`[%d] failed: the parent decision is not inherited`, i)
+		}
+
+		h.SetTracing(nil)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTracingPropagation(t *testing.T) {
+	h := newTestListener(t)
+	err := h.SetTracing(&TracingConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.SetTracing(nil)
+
+	received := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(HTTPheaderTraceParent)
+	}))
+	defer srv.Close()
+
+	// no span in the context -- nothing is propagated
+	_, _, err = RequestExCtx(context.Background(), http.MethodGet, srv.URL, 0, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != "" {
+		t.Errorf(`traceparent "%s" is sent without the span`, received)
+	}
+
+	root := h.Tracer().newSpan(nil, "root", SpanKindServer)
+	_, _, err = RequestExCtx(ContextWithSpan(context.Background(), root), http.MethodGet, srv.URL, 0, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceID, parentID, sampled, err := ParseTraceParent(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traceID != root.TraceID || parentID == root.SpanID || !sampled {
+		t.Errorf(`traceparent "%s" does not continue the trace %s`, received, root.TraceID)
+	}
+
+	spans := h.Tracer().memory.Spans()
+	client := spans[len(spans)-1]
+	if client.Kind != SpanKindClient || client.SpanID != parentID || client.ParentID != root.SpanID {
+		t.Errorf(`unexpected client span %#v`, client)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestMemorySpanExporter(t *testing.T) {
+	e := NewMemorySpanExporter(3)
+
+	t0 := time.Now()
+	trace1 := newTraceID()
+	trace2 := newTraceID()
+
+	spans := []*Span{
+		{TraceID: trace1, SpanID: newSpanID(), Name: "dropped", Kind: SpanKindServer, Start: t0, End: t0.Add(time.Second)},
+		{TraceID: trace1, SpanID: newSpanID(), Name: "GET /a", Kind: SpanKindServer, Start: t0.Add(time.Second), End: t0.Add(4 * time.Second)},
+		{TraceID: trace2, SpanID: newSpanID(), Name: "GET /b", Kind: SpanKindServer, Start: t0.Add(5 * time.Second), End: t0.Add(6 * time.Second), Status: SpanStatusError},
+		{TraceID: trace1, SpanID: newSpanID(), Name: "db", Kind: SpanKindClient, Start: t0.Add(2 * time.Second), End: t0.Add(3 * time.Second)},
+	}
+
+	for _, span := range spans {
+		e.ExportSpan(span)
+	}
+
+	list := e.Spans()
+	if len(list) != 3 || list[0] != spans[1] || list[2] != spans[3] {
+		t.Fatalf(`unexpected spans %v`, list)
+	}
+
+	type testData struct {
+		traceID  TraceID
+		root     string
+		spans    int
+		duration time.Duration
+		failed   bool
+	}
+
+	data := []testData{
+		{trace2, "GET /b", 1, time.Second, true},
+		{trace1, "GET /a", 2, 3 * time.Second, false},
+	}
+
+	traces := e.Traces()
+	if len(traces) != len(data) {
+		t.Fatalf(`got %d traces, expected %d`, len(traces), len(data))
+	}
+
+	for i, p := range data {
+		tr := traces[i]
+		i++
+
+		if tr.TraceID != p.traceID || tr.Root != p.root || len(tr.Spans) != p.spans || tr.Duration != p.duration || tr.Failed != p.failed {
+			t.Errorf(`[%d] failed: got %s "%s" %d %s %v, expected %s "%s" %d %s %v`,
+				i, tr.TraceID, tr.Root, len(tr.Spans), tr.Duration, tr.Failed, p.traceID, p.root, p.spans, p.duration, p.failed)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	SendJSON(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, traces)
+	if !strings.Contains(w.Body.String(), `"traceID":"`+trace2.String()+`"`) {
+		t.Errorf(`trace ID is not in JSON: %s`, w.Body.String())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// readerFromRecorder -- the writer with the fast path as the http.response has
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	called bool
+}
+
+func (w *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.called = true
+	return io.Copy(w.ResponseRecorder.Body, src)
+}
+
+func TestResponseRecorderReadFrom(t *testing.T) {
+	type testData struct {
+		readerFrom bool
+		body       string
+	}
+
+	data := []testData{
+		{true, "sendfile body"},
+		{false, "copied body"},
+		{true, ""},
+	}
+
+	for i, p := range data {
+		i++
+
+		base := httptest.NewRecorder()
+		var w http.ResponseWriter = base
+		rf := &readerFromRecorder{ResponseRecorder: base}
+		if p.readerFrom {
+			w = rf
+		}
+
+		rr := NewResponseRecorder(w)
+		// strings.Reader is io.WriterTo, io.Copy would not call ReadFrom
+		n, err := io.Copy(rr, &countingReader{r: strings.NewReader(p.body)})
+		if err != nil {
+			t.Fatalf(`[%d] failed: %s`, i, err)
+		}
+
+		if n != int64(len(p.body)) || rr.Bytes() != n || rr.Status() != http.StatusOK || base.Body.String() != p.body || rf.called != p.readerFrom {
+			t.Errorf(`[%d] failed: n %d, bytes %d, status %d, body "%s", fast path %v`, i, n, rr.Bytes(), rr.Status(), base.Body.String(), rf.called)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
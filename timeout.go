@@ -0,0 +1,379 @@
+package stdhttp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// TimeoutConfig --
+	TimeoutConfig struct {
+		Default    config.Duration            `toml:"default"`     // 0 -- no limit
+		Endpoints  map[string]config.Duration `toml:"endpoints"`   // endpoint pattern -> timeout, <=0 -- no limit (use it for streaming endpoints)
+		StatusCode int                        `toml:"status-code"` // 503 or 504, 0 -- 503
+	}
+
+	timeouts struct {
+		cfg    TimeoutConfig
+		keys   misc.BoolMap
+		manual map[string]config.Duration // set by SetEndpointTimeout, kept by SetTimeouts
+	}
+
+	// timeoutWriter -- stops writes to the client after the deadline
+	timeoutWriter struct {
+		mutex    sync.Mutex
+		ctx      context.Context
+		w        http.ResponseWriter
+		header   http.Header
+		started  bool
+		timedOut bool
+	}
+
+	// handlerPanic -- the panic passed from the handler goroutine
+	handlerPanic struct {
+		value any
+		stack []byte
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetTimeouts -- the endpoints set by SetEndpointTimeout (the streaming ones and so on) are kept unless cfg.Endpoints redefines them.
+// nil disables all limits
+func (h *HTTP) SetTimeouts(cfg *TimeoutConfig) (err error) {
+	if cfg == nil {
+		h.Lock()
+		h.timeouts = nil
+		h.Unlock()
+		return
+	}
+
+	t := &timeouts{
+		cfg:  *cfg,
+		keys: make(misc.BoolMap, len(cfg.Endpoints)),
+	}
+
+	switch t.cfg.StatusCode {
+	case 0:
+		t.cfg.StatusCode = http.StatusServiceUnavailable
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return fmt.Errorf("timeouts: status code %d is not allowed, use %d or %d", t.cfg.StatusCode, http.StatusServiceUnavailable, http.StatusGatewayTimeout)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.timeouts != nil {
+		t.manual = h.timeouts.manual
+	}
+
+	endpoints := make(map[string]config.Duration, len(t.manual)+len(cfg.Endpoints))
+	for pattern, d := range t.manual {
+		endpoints[pattern] = d
+		t.keys[pattern] = true
+	}
+	for pattern, d := range cfg.Endpoints {
+		endpoints[pattern] = d
+		t.keys[pattern] = true
+	}
+	t.cfg.Endpoints = endpoints
+
+	h.timeouts = t
+	return
+}
+
+// SetEndpointTimeout -- d <= 0 disables the limit for the endpoint (streaming and so on)
+func (h *HTTP) SetEndpointTimeout(pattern string, d time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.timeouts == nil {
+		h.timeouts = &timeouts{
+			cfg: TimeoutConfig{
+				StatusCode: http.StatusServiceUnavailable,
+			},
+		}
+	}
+
+	t := h.timeouts
+
+	// copy on write, the old one may be in use
+	endpoints := make(map[string]config.Duration, len(t.cfg.Endpoints)+1)
+	keys := make(misc.BoolMap, len(t.keys)+1)
+	for p, v := range t.cfg.Endpoints {
+		endpoints[p] = v
+		keys[p] = true
+	}
+	endpoints[pattern] = config.Duration(d)
+	keys[pattern] = true
+
+	manual := make(map[string]config.Duration, len(t.manual)+1)
+	for p, v := range t.manual {
+		manual[p] = v
+	}
+	manual[pattern] = config.Duration(d)
+
+	nt := &timeouts{
+		cfg:    t.cfg,
+		keys:   keys,
+		manual: manual,
+	}
+	nt.cfg.Endpoints = endpoints
+
+	h.timeouts = nt
+}
+
+// endpointTimeout -- 0 means no limit
+func (h *HTTP) endpointTimeout(path string) (d time.Duration, code int) {
+	h.Lock()
+	t := h.timeouts
+	h.Unlock()
+
+	if t == nil {
+		return
+	}
+
+	code = t.cfg.StatusCode
+	d = t.cfg.Default.D()
+
+	pattern, exists := isPathInList(path, t.keys)
+	if exists {
+		d = t.cfg.Endpoints[pattern].D()
+	}
+
+	if d < 0 {
+		d = 0
+	}
+
+	return
+}
+
+// timeoutExempt -- the limit is disabled for the endpoint explicitly (streaming and so on)
+func (h *HTTP) timeoutExempt(path string) bool {
+	h.Lock()
+	t := h.timeouts
+	h.Unlock()
+
+	if t == nil {
+		return false
+	}
+
+	pattern, exists := isPathInList(path, t.keys)
+	return exists && t.cfg.Endpoints[pattern] <= 0
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// dispatchTimed -- calls dispatch with the deadline in the request context. Replies 503/504 if the deadline is exceeded before the handler has written anything
+func (h *HTTP) dispatchTimed(id uint64, panicID uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (processed bool, basePath string) {
+	timeout, code := h.endpointTimeout(path)
+	if timeout <= 0 {
+		return h.dispatch(id, prefix, path, w, r)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	tw := &timeoutWriter{
+		ctx:    ctx,
+		w:      w,
+		header: w.Header().Clone(),
+	}
+
+	done := make(chan struct{})
+	var hp *handlerPanic
+	var hProcessed bool
+	var hBasePath string
+
+	go func() {
+		defer func() {
+			rec := recover()
+
+			// done is closed under lock, so the timed out state can't change in between
+			tw.mutex.Lock()
+			defer tw.mutex.Unlock()
+			defer close(done)
+
+			if rec == nil {
+				return
+			}
+
+			if tw.timedOut {
+				h.lateHandlerPanic(id, panicID, path, r, rec, debug.Stack())
+				return
+			}
+
+			hp = &handlerPanic{value: rec, stack: debug.Stack()}
+		}()
+
+		hProcessed, hBasePath = h.dispatch(id, prefix, path, tw, r)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	finished := false
+	select {
+	case <-done:
+		finished = true
+	default:
+	}
+
+	if finished {
+		if hp != nil {
+			// recoverPanic in ServeHTTP handles it
+			panic(hp)
+		}
+
+		if tw.started || ctx.Err() != context.DeadlineExceeded {
+			if !tw.started {
+				// the handler has set headers only
+				tw.start()
+			}
+			return hProcessed, hBasePath
+		}
+	}
+
+	tw.timedOut = true
+
+	if ctx.Err() != context.DeadlineExceeded {
+		Log.Message(log.DEBUG, `[%d] Client has gone`, id)
+		return true, path
+	}
+
+	h.endpointTimedOut(path)
+	SpanFromContext(r.Context()).SetStatus(SpanStatusError, "timeout")
+
+	if tw.started {
+		Log.Message(log.WARNING, `[%d] Handler of "%s" exceeded the timeout %s, the reply is truncated`, id, path, timeout)
+		return true, path
+	}
+
+	Log.Message(log.WARNING, `[%d] Handler of "%s" exceeded the timeout %s`, id, path, timeout)
+	Error(id, false, w, r, code, "Request timeout", fmt.Errorf("timeout %s exceeded", timeout))
+
+	return true, path
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Header --
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// start -- must be called under lock
+func (tw *timeoutWriter) start() error {
+	if tw.timedOut || tw.ctx.Err() != nil {
+		return http.ErrHandlerTimeout
+	}
+
+	if !tw.started {
+		tw.started = true
+
+		dst := tw.w.Header()
+		for n := range dst {
+			if _, exists := tw.header[n]; !exists {
+				delete(dst, n)
+			}
+		}
+		for n, v := range tw.header {
+			dst[n] = v
+		}
+	}
+
+	return nil
+}
+
+// WriteHeader --
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	if tw.start() != nil {
+		return
+	}
+
+	tw.w.WriteHeader(code)
+}
+
+// Write --
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	if err := tw.start(); err != nil {
+		return 0, err
+	}
+
+	return tw.w.Write(b)
+}
+
+// Flush --
+func (tw *timeoutWriter) Flush() {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	if tw.start() != nil {
+		return
+	}
+
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack --
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	if err := tw.start(); err != nil {
+		return nil, nil, err
+	}
+
+	hj, ok := tw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", tw.w)
+	}
+
+	return hj.Hijack()
+}
+
+// Push --
+func (tw *timeoutWriter) Push(target string, opts *http.PushOptions) error {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	if tw.timedOut || tw.ctx.Err() != nil {
+		return http.ErrHandlerTimeout
+	}
+
+	p, ok := tw.w.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	return p.Push(target, opts)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
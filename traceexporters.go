@@ -0,0 +1,472 @@
+package stdhttp
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/jsonw"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// MemorySpanExporter -- keeps the last spans in memory
+	MemorySpanExporter struct {
+		mutex sync.Mutex
+		size  int
+		spans []*Span
+		next  int
+		full  bool
+	}
+
+	// TraceInfo -- spans of the one trace
+	TraceInfo struct {
+		TraceID  TraceID       `json:"traceID"`
+		Root     string        `json:"root"`
+		Start    time.Time     `json:"start"`
+		Duration time.Duration `json:"duration"`
+		Failed   bool          `json:"failed"`
+		Spans    []*Span       `json:"spans"`
+	}
+)
+
+// NewMemorySpanExporter --
+func NewMemorySpanExporter(size int) *MemorySpanExporter {
+	if size <= 0 {
+		size = defaultMemorySpans
+	}
+
+	return &MemorySpanExporter{
+		size:  size,
+		spans: make([]*Span, size),
+	}
+}
+
+// ExportSpan --
+func (e *MemorySpanExporter) ExportSpan(span *Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.spans[e.next] = span
+	e.next++
+	if e.next == e.size {
+		e.next = 0
+		e.full = true
+	}
+}
+
+// Shutdown --
+func (e *MemorySpanExporter) Shutdown() {
+}
+
+// Spans -- the oldest first
+func (e *MemorySpanExporter) Spans() (list []*Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.full {
+		list = make([]*Span, 0, e.size)
+		list = append(list, e.spans[e.next:]...)
+	}
+
+	list = append(list, e.spans[:e.next]...)
+	return
+}
+
+// Traces -- spans grouped by the trace, the newest trace first
+func (e *MemorySpanExporter) Traces() (list []*TraceInfo) {
+	traces := make(map[TraceID]*TraceInfo)
+
+	for _, span := range e.Spans() {
+		t, exists := traces[span.TraceID]
+		if !exists {
+			t = &TraceInfo{
+				TraceID: span.TraceID,
+				Start:   span.Start,
+			}
+			traces[span.TraceID] = t
+			list = append(list, t)
+		}
+
+		t.Spans = append(t.Spans, span)
+
+		if span.Start.Before(t.Start) {
+			t.Start = span.Start
+		}
+
+		if d := span.End.Sub(t.Start); d > t.Duration {
+			t.Duration = d
+		}
+
+		if span.Status == SpanStatusError {
+			t.Failed = true
+		}
+
+		if span.Kind == SpanKindServer && (t.Root == "" || !span.ParentID.IsValid()) {
+			t.Root = span.Name
+		}
+	}
+
+	for _, t := range list {
+		sort.Slice(t.Spans, func(i, j int) bool {
+			return t.Spans[i].Start.Before(t.Spans[j].Start)
+		})
+
+		if t.Root == "" {
+			t.Root = t.Spans[0].Name
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Start.After(list[j].Start)
+	})
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// OTLPExporter -- sends spans to the OpenTelemetry collector using OTLP/HTTP with the JSON encoding
+	OTLPExporter struct {
+		mutex       sync.Mutex
+		endpoint    string
+		headers     misc.StringMap
+		serviceName string
+		batchSize   int
+		interval    time.Duration
+		queue       chan *Span
+		done        chan struct{}
+		wg          sync.WaitGroup
+		client      *http.Client
+	}
+
+	otlpKeyValue struct {
+		Key   string         `json:"key"`
+		Value otlpValueUnion `json:"value"`
+	}
+
+	otlpValueUnion struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		TraceState        string         `json:"traceState,omitempty"`
+		Name              string         `json:"name"`
+		Kind              SpanKind       `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            struct {
+			Code    SpanStatus `json:"code"`
+			Message string     `json:"message,omitempty"`
+		} `json:"status"`
+	}
+
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+)
+
+const (
+	defaultOTLPBatchSize = 256
+	defaultOTLPInterval  = 5 * time.Second
+	otlpScopeName        = "github.com/alrusov/stdhttp"
+)
+
+// NewOTLPExporter --
+func NewOTLPExporter(cfg *TracingConfig) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint:    cfg.OTLPEndpoint,
+		headers:     cfg.OTLPHeaders,
+		serviceName: cfg.ServiceName,
+		batchSize:   cfg.OTLPBatchSize,
+		interval:    cfg.OTLPInterval.D(),
+		done:        make(chan struct{}),
+	}
+
+	if e.batchSize <= 0 {
+		e.batchSize = defaultOTLPBatchSize
+	}
+
+	if e.interval <= 0 {
+		e.interval = defaultOTLPInterval
+	}
+
+	e.queue = make(chan *Span, e.batchSize*4)
+	e.client = &http.Client{
+		Timeout: config.ClientDefaultTimeout.D(),
+	}
+
+	e.wg.Add(1)
+	go e.loop()
+
+	return e
+}
+
+// ExportSpan -- the span is dropped if the queue is full
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		Log.Message(log.TRACE3, "OTLP: queue is full, span dropped")
+	}
+}
+
+// Shutdown -- sends the rest of spans and stops
+func (e *OTLPExporter) Shutdown() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *OTLPExporter) loop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, e.batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := e.send(batch)
+		if err != nil {
+			Log.Message(log.WARNING, "OTLP: %d spans are not sent: %s", len(batch), err)
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case <-e.done:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) send(batch []*Span) (err error) {
+	rs := otlpResourceSpans{}
+	rs.Resource.Attributes = []otlpKeyValue{otlpAttr("service.name", e.serviceName)}
+
+	ss := otlpScopeSpans{
+		Spans: make([]otlpSpan, 0, len(batch)),
+	}
+	ss.Scope.Name = otlpScopeName
+
+	for _, span := range batch {
+		ss.Spans = append(ss.Spans, span.otlp())
+	}
+
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+
+	body, err := jsonw.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	ct, _ := ContentHeader(ContentTypeJSON)
+	req.Header.Set("Content-Type", ct)
+	for n, v := range e.headers {
+		req.Header.Set(n, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("status code %d", resp.StatusCode)
+		return
+	}
+
+	return
+}
+
+func (s *Span) otlp() (o otlpSpan) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	o = otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		TraceState:        s.TraceState,
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+	}
+
+	if s.ParentID.IsValid() {
+		o.ParentSpanID = s.ParentID.String()
+	}
+
+	o.Status.Code = s.Status
+	o.Status.Message = s.StatusMessage
+
+	names := make([]string, 0, len(s.Attributes))
+	for n := range s.Attributes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		o.Attributes = append(o.Attributes, otlpAttr(n, s.Attributes[n]))
+	}
+
+	return
+}
+
+func otlpAttr(name string, v any) (kv otlpKeyValue) {
+	kv.Key = name
+
+	switch v := v.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) showTraces(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) {
+	t := h.Tracer()
+	if t == nil || t.memory == nil {
+		Error(id, false, w, r, http.StatusNotImplemented, "Tracing is not enabled", nil)
+		return
+	}
+
+	list := t.memory.Traces()
+
+	if traceID := r.URL.Query().Get("trace"); traceID != "" {
+		filtered := make([]*TraceInfo, 0, 1)
+		for _, ti := range list {
+			if ti.TraceID.String() == traceID {
+				filtered = append(filtered, ti)
+			}
+		}
+		list = filtered
+	}
+
+	if r.URL.Query().Get("format") == ContentTypeJSON {
+		SendJSON(w, r, http.StatusOK, list)
+		return
+	}
+
+	params := struct {
+		Prefix string
+		Nonce  string
+		Name   string
+		ErrMsg string
+		List   []*TraceInfo
+	}{
+		Prefix: prefix,
+		Nonce:  GetCSPNonce(r),
+		Name:   "Traces",
+		ErrMsg: r.URL.Query().Get("___err"),
+		List:   list,
+	}
+
+	tp, err := template.New("traces").Parse(tracesPage)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = tp.Execute(buf, params)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	err = WriteReply(w, r, http.StatusOK, ContentTypeHTML, nil, buf.Bytes())
+	if err != nil {
+		Log.Message(log.DEBUG, "[%d] %s", id, err.Error())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
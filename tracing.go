@@ -0,0 +1,497 @@
+package stdhttp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// TraceID --
+	TraceID [16]byte
+
+	// SpanID --
+	SpanID [8]byte
+
+	// SpanKind -- values match OTLP
+	SpanKind int
+
+	// SpanStatus -- values match OTLP
+	SpanStatus int
+
+	// Span --
+	Span struct {
+		mutex         sync.Mutex
+		tracer        *Tracer
+		ended         bool
+		TraceID       TraceID        `json:"traceID"`
+		SpanID        SpanID         `json:"spanID"`
+		ParentID      SpanID         `json:"parentID"`
+		Sampled       bool           `json:"sampled"`
+		TraceState    string         `json:"traceState,omitempty"`
+		Name          string         `json:"name"`
+		Kind          SpanKind       `json:"kind"`
+		Start         time.Time      `json:"start"`
+		End           time.Time      `json:"end"`
+		Attributes    map[string]any `json:"attributes,omitempty"`
+		Status        SpanStatus     `json:"status"`
+		StatusMessage string         `json:"statusMessage,omitempty"`
+	}
+
+	// SpanExporter --
+	SpanExporter interface {
+		ExportSpan(span *Span)
+		Shutdown()
+	}
+
+	// TracingConfig --
+	TracingConfig struct {
+		Enabled       bool            `toml:"enabled"`
+		ServiceName   string          `toml:"service-name"`    // empty -- application name
+		SampleRatio   float64         `toml:"sample-ratio"`    // for the new traces, 0 -- 1.0
+		MemorySpans   int             `toml:"memory-spans"`    // spans kept for the maintenance page, 0 -- 1000, <0 -- don't keep
+		OTLPEndpoint  string          `toml:"otlp-endpoint"`   // e.g. http://collector:4318/v1/traces, empty -- don't export
+		OTLPHeaders   misc.StringMap  `toml:"otlp-headers"`    // extra headers for the collector
+		OTLPBatchSize int             `toml:"otlp-batch-size"` // 0 -- 256
+		OTLPInterval  config.Duration `toml:"otlp-interval"`   // 0 -- 5s
+	}
+
+	// Tracer --
+	Tracer struct {
+		mutex       sync.RWMutex
+		cfg         TracingConfig
+		exporters   []SpanExporter
+		memory      *MemorySpanExporter
+		sampleBound uint64
+	}
+
+	ctxSpanKey struct{}
+)
+
+const (
+	SpanKindUnspecified SpanKind = 0
+	SpanKindInternal    SpanKind = 1
+	SpanKindServer      SpanKind = 2
+	SpanKindClient      SpanKind = 3
+
+	SpanStatusUnset SpanStatus = 0
+	SpanStatusOK    SpanStatus = 1
+	SpanStatusError SpanStatus = 2
+
+	HTTPheaderTraceParent = "traceparent"
+	HTTPheaderTraceState  = "tracestate"
+
+	defaultMemorySpans = 1000
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid --
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+// MarshalText --
+func (id TraceID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid --
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// MarshalText --
+func (id SpanID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return
+}
+
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// ParseTraceParent -- W3C traceparent header
+func ParseTraceParent(s string) (traceID TraceID, parentID SpanID, sampled bool, err error) {
+	s = strings.TrimSpace(s)
+
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 {
+		err = fmt.Errorf(`bad traceparent "%s"`, s)
+		return
+	}
+
+	version := parts[0]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		err = fmt.Errorf(`bad traceparent version "%s"`, version)
+		return
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		err = fmt.Errorf(`bad traceparent "%s"`, s)
+		return
+	}
+
+	if strings.ToLower(s) != s {
+		err = fmt.Errorf(`bad traceparent "%s": uppercase is not allowed`, s)
+		return
+	}
+
+	_, err = hex.Decode(traceID[:], []byte(parts[1]))
+	if err != nil {
+		return
+	}
+
+	_, err = hex.Decode(parentID[:], []byte(parts[2]))
+	if err != nil {
+		return
+	}
+
+	var flags [1]byte
+	_, err = hex.Decode(flags[:], []byte(parts[3]))
+	if err != nil {
+		return
+	}
+
+	if !traceID.IsValid() || !parentID.IsValid() {
+		err = fmt.Errorf(`bad traceparent "%s": zero id`, s)
+		return
+	}
+
+	sampled = flags[0]&0x01 != 0
+	return
+}
+
+// TraceParent -- W3C traceparent header value for the span
+func (s *Span) TraceParent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + s.TraceID.String() + "-" + s.SpanID.String() + "-" + flags
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetTracing --
+func (h *HTTP) SetTracing(cfg *TracingConfig) (err error) {
+	if cfg == nil || !cfg.Enabled {
+		h.replaceTracer(nil)
+		return
+	}
+
+	t := &Tracer{
+		cfg: *cfg,
+	}
+
+	if t.cfg.ServiceName == "" {
+		t.cfg.ServiceName = misc.AppName()
+	}
+
+	if t.cfg.SampleRatio <= 0 || t.cfg.SampleRatio > 1 {
+		t.cfg.SampleRatio = 1
+	}
+	t.sampleBound = uint64(t.cfg.SampleRatio * math.MaxUint64)
+	if t.cfg.SampleRatio >= 1 {
+		t.sampleBound = math.MaxUint64
+	}
+
+	if t.cfg.MemorySpans >= 0 {
+		size := t.cfg.MemorySpans
+		if size == 0 {
+			size = defaultMemorySpans
+		}
+		t.memory = NewMemorySpanExporter(size)
+		t.exporters = append(t.exporters, t.memory)
+	}
+
+	if t.cfg.OTLPEndpoint != "" {
+		t.exporters = append(t.exporters, NewOTLPExporter(&t.cfg))
+	}
+
+	h.replaceTracer(t)
+
+	h.AddEndpointsInfo(misc.StringMap{
+		"/maintenance/traces": "Recent traces ([format=json])",
+	})
+
+	return
+}
+
+// replaceTracer -- the previous tracer is shut down outside the lock, it flushes the exporters
+func (h *HTTP) replaceTracer(t *Tracer) {
+	h.Lock()
+	old := h.tracer
+	h.tracer = t
+	h.Unlock()
+
+	if old != nil {
+		old.Shutdown()
+	}
+}
+
+// Tracer --
+func (h *HTTP) Tracer() *Tracer {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.tracer
+}
+
+// AddExporter -- plug the custom exporter
+func (t *Tracer) AddExporter(e SpanExporter) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.exporters = append(t.exporters, e)
+}
+
+// Shutdown -- flush and stop exporters
+func (t *Tracer) Shutdown() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, e := range t.exporters {
+		e.Shutdown()
+	}
+	t.exporters = nil
+}
+
+func (t *Tracer) export(span *Span) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for _, e := range t.exporters {
+		e.ExportSpan(span)
+	}
+}
+
+func (t *Tracer) sample(traceID TraceID) bool {
+	if t.sampleBound == math.MaxUint64 {
+		return true
+	}
+
+	return binary.BigEndian.Uint64(traceID[8:]) < t.sampleBound
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// newSpan -- parent may be nil (a new trace is started)
+func (t *Tracer) newSpan(parent *Span, name string, kind SpanKind) *Span {
+	span := &Span{
+		tracer: t,
+		SpanID: newSpanID(),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+	}
+
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+		span.Sampled = parent.Sampled
+		span.TraceState = parent.TraceState
+	} else {
+		span.TraceID = newTraceID()
+		span.Sampled = t.sample(span.TraceID)
+	}
+
+	return span
+}
+
+// startServerSpan -- continues the incoming trace (if any) and stores the span in the request context
+func (h *HTTP) startServerSpan(r *http.Request, rid string) (newR *http.Request, span *Span) {
+	t := h.Tracer()
+	if t == nil {
+		return r, nil
+	}
+
+	var parent *Span
+
+	if tp := r.Header.Get(HTTPheaderTraceParent); tp != "" {
+		traceID, parentID, sampled, err := ParseTraceParent(tp)
+		if err != nil {
+			Log.Message(log.DEBUG, "%s", err)
+		} else {
+			parent = &Span{
+				TraceID:    traceID,
+				SpanID:     parentID,
+				Sampled:    sampled,
+				TraceState: r.Header.Get(HTTPheaderTraceState),
+			}
+		}
+	}
+
+	span = t.newSpan(parent, r.Method+" "+r.URL.Path, SpanKindServer)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("client.address", h.ClientAddr(r))
+	span.SetAttribute("http.request_id", rid)
+
+	newR = r.WithContext(ContextWithSpan(r.Context(), span))
+	return
+}
+
+func finishServerSpan(span *Span, rr *ResponseRecorder) {
+	if span == nil {
+		return
+	}
+
+	if status := rr.Status(); status != 0 {
+		span.SetAttribute("http.response.status_code", status)
+		if status >= 500 {
+			span.setDefaultStatus(SpanStatusError, http.StatusText(status))
+		}
+	}
+
+	span.SetAttribute("http.response.body.size", rr.Bytes())
+	span.Finish()
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// ContextWithSpan --
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, ctxSpanKey{}, span)
+}
+
+// SpanFromContext -- nil if tracing is not active
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+
+	span, _ := ctx.Value(ctxSpanKey{}).(*Span)
+	return span
+}
+
+// StartSpan -- creates the child span of the span from the context. Returns nil span (all methods are safe) if tracing is not active
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil || parent.tracer == nil {
+		return ctx, nil
+	}
+
+	span := parent.tracer.newSpan(parent, name, kind)
+	return ContextWithSpan(ctx, span), span
+}
+
+// StartRequestSpan -- the same as StartSpan for the request
+func StartRequestSpan(r *http.Request, name string) (*http.Request, *Span) {
+	ctx, span := StartSpan(r.Context(), name, SpanKindInternal)
+	if span == nil {
+		return r, nil
+	}
+
+	return r.WithContext(ctx), span
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetAttribute --
+func (s *Span) SetAttribute(name string, v any) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]any)
+	}
+	s.Attributes[name] = v
+}
+
+// SetStatus --
+func (s *Span) SetStatus(status SpanStatus, message string) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Status = status
+	s.StatusMessage = message
+}
+
+// setDefaultStatus -- the status set by the handler is kept
+func (s *Span) setDefaultStatus(status SpanStatus, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Status == SpanStatusUnset {
+		s.Status = status
+		s.StatusMessage = message
+	}
+}
+
+// SetError --
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.SetStatus(SpanStatusError, err.Error())
+}
+
+// Finish -- ends the span and sends it to exporters. Repeated calls are ignored
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mutex.Unlock()
+
+	if s.Sampled && s.tracer != nil {
+		s.tracer.export(s)
+	}
+}
+
+// Duration --
+func (s *Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,370 @@
+package stdhttp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// UploadConfig --
+	UploadConfig struct {
+		Dir          string   `toml:"dir"`            // directory for the received files, empty -- the system temp directory
+		MaxFileSize  int64    `toml:"max-file-size"`  // 0 -- no limit
+		MaxTotalSize int64    `toml:"max-total-size"` // all parts including the form values, 0 -- no limit
+		MaxFiles     int      `toml:"max-files"`      // 0 -- no limit
+		MaxValueSize int64    `toml:"max-value-size"` // size of the form value, 0 -- 1MB
+		ContentTypes []string `toml:"content-types"`  // allowed types (both declared and sniffed), "image/*" is allowed too, empty -- any
+		Checksums    []string `toml:"checksums"`      // md5, sha1, sha256, sha512, crc32
+	}
+
+	// UploadedFile --
+	UploadedFile struct {
+		Field       string            `json:"field"`
+		FileName    string            `json:"fileName"`
+		ContentType string            `json:"contentType"` // declared by the client or detected by the content if it is not declared or application/octet-stream
+		Size        int64             `json:"size"`
+		Path        string            `json:"path,omitempty"` // the received file if it is stored by ReceiveUpload, the caller must move or remove it
+		Checksums   map[string]string `json:"checksums,omitempty"`
+	}
+
+	// UploadResult --
+	UploadResult struct {
+		Files  []*UploadedFile
+		Values url.Values
+	}
+
+	// UploadTarget -- returns the writer for the file instead of the file in UploadConfig.Dir. If the writer has the Abort() error method it is called instead of Close() on failure
+	UploadTarget func(f *UploadedFile) (io.WriteCloser, error)
+
+	// UploadError -- Code is the suggested HTTP status
+	UploadError struct {
+		Code    int
+		Message string
+		Err     error
+	}
+
+	uploadAborter interface {
+		Abort() error
+	}
+)
+
+const (
+	defaultUploadMaxValueSize = 1 << 20
+
+	// ChecksumMD5 --
+	ChecksumMD5 = "md5"
+	// ChecksumSHA1 --
+	ChecksumSHA1 = "sha1"
+	// ChecksumSHA256 --
+	ChecksumSHA256 = "sha256"
+	// ChecksumSHA512 --
+	ChecksumSHA512 = "sha512"
+	// ChecksumCRC32 --
+	ChecksumCRC32 = "crc32"
+)
+
+var (
+	checksumFuncs = map[string]func() hash.Hash{
+		ChecksumMD5:    md5.New,
+		ChecksumSHA1:   sha1.New,
+		ChecksumSHA256: sha256.New,
+		ChecksumSHA512: sha512.New,
+		ChecksumCRC32:  func() hash.Hash { return crc32.NewIEEE() },
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Error --
+func (e *UploadError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%s: %s", e.Message, e.Err)
+}
+
+// Unwrap --
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// UploadErrorCode -- HTTP status for the error returned by the upload functions
+func UploadErrorCode(err error) int {
+	var e *UploadError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	return http.StatusInternalServerError
+}
+
+func uploadError(code int, message string, err error) *UploadError {
+	return &UploadError{
+		Code:    code,
+		Message: message,
+		Err:     err,
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// ReceiveUpload -- streams the multipart/form-data parts to the files in cfg.Dir or to the writers returned by target (if not nil).
+// Nothing is kept on error
+func ReceiveUpload(r *http.Request, cfg *UploadConfig, target UploadTarget) (result *UploadResult, err error) {
+	if cfg == nil {
+		cfg = &UploadConfig{}
+	}
+
+	for _, name := range cfg.Checksums {
+		if _, exists := checksumFuncs[name]; !exists {
+			return nil, uploadError(http.StatusInternalServerError, "Bad upload config", fmt.Errorf(`unknown checksum "%s"`, name))
+		}
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, uploadError(http.StatusBadRequest, "Bad multipart request", err)
+	}
+
+	result = &UploadResult{
+		Values: url.Values{},
+	}
+
+	defer func() {
+		if err != nil {
+			result.Cleanup()
+			result = nil
+		}
+	}()
+
+	totalLeft := cfg.MaxTotalSize
+	if totalLeft <= 0 {
+		totalLeft = math.MaxInt64 - 1
+	}
+
+	for {
+		part, e := mr.NextPart()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			err = uploadError(http.StatusBadRequest, "Bad multipart request", e)
+			return
+		}
+
+		if part.FileName() == "" {
+			err = result.receiveValue(part, cfg, &totalLeft)
+			part.Close()
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		if cfg.MaxFiles > 0 && len(result.Files) >= cfg.MaxFiles {
+			part.Close()
+			err = uploadError(http.StatusRequestEntityTooLarge, "Too many files", fmt.Errorf("more than %d", cfg.MaxFiles))
+			return
+		}
+
+		err = result.receiveFile(part, cfg, target, &totalLeft)
+		part.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (result *UploadResult) receiveValue(part *multipart.Part, cfg *UploadConfig, totalLeft *int64) (err error) {
+	limit := cfg.MaxValueSize
+	if limit <= 0 {
+		limit = defaultUploadMaxValueSize
+	}
+
+	data, err := io.ReadAll(io.LimitReader(part, min(limit, *totalLeft)+1))
+	if err != nil {
+		return uploadError(http.StatusBadRequest, "Bad multipart request", err)
+	}
+
+	size := int64(len(data))
+
+	if size > *totalLeft {
+		return uploadError(http.StatusRequestEntityTooLarge, "Upload too large", nil)
+	}
+
+	if size > limit {
+		return uploadError(http.StatusRequestEntityTooLarge, "Form value too large", fmt.Errorf(`"%s"`, part.FormName()))
+	}
+
+	*totalLeft -= size
+	result.Values.Add(part.FormName(), string(data))
+	return
+}
+
+func (result *UploadResult) receiveFile(part *multipart.Part, cfg *UploadConfig, target UploadTarget, totalLeft *int64) (err error) {
+	f := &UploadedFile{
+		Field:       part.FormName(),
+		FileName:    part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return uploadError(http.StatusBadRequest, "Bad multipart request", err)
+	}
+	head = head[:n]
+
+	detected := http.DetectContentType(head)
+
+	if f.ContentType == "" || isBinaryContent(f.ContentType) {
+		// nothing certain from the client
+		f.ContentType = detected
+	}
+
+	if !contentTypeAllowed(f.ContentType, cfg.ContentTypes) {
+		return uploadError(http.StatusUnsupportedMediaType, "Content type is not allowed", fmt.Errorf(`"%s" (%s)`, f.FileName, f.ContentType))
+	}
+
+	// the declared type may be forged (e.g. HTML as image/png)
+	if !genericContentType(detected) && !contentTypeAllowed(detected, cfg.ContentTypes) {
+		return uploadError(http.StatusUnsupportedMediaType, "Content type is not allowed", fmt.Errorf(`"%s" (%s declared, %s detected)`, f.FileName, f.ContentType, detected))
+	}
+
+	var wc io.WriteCloser
+
+	if target != nil {
+		wc, err = target(f)
+		if err != nil {
+			return uploadError(http.StatusInternalServerError, "Upload target error", err)
+		}
+	} else {
+		fd, e := os.CreateTemp(cfg.Dir, "upload-*")
+		if e != nil {
+			return uploadError(http.StatusInternalServerError, "Upload target error", e)
+		}
+		f.Path = fd.Name()
+		wc = fd
+	}
+
+	// from here Cleanup knows about the file
+	result.Files = append(result.Files, f)
+
+	hashes := make(map[string]hash.Hash, len(cfg.Checksums))
+	writers := make([]io.Writer, 0, len(cfg.Checksums)+1)
+	writers = append(writers, wc)
+	for _, name := range cfg.Checksums {
+		hashes[name] = checksumFuncs[name]()
+		writers = append(writers, hashes[name])
+	}
+
+	fileLimit := cfg.MaxFileSize
+	if fileLimit <= 0 {
+		fileLimit = math.MaxInt64 - 1
+	}
+	limit := min(fileLimit, *totalLeft)
+
+	f.Size, err = io.Copy(io.MultiWriter(writers...), io.LimitReader(io.MultiReader(bytes.NewReader(head), part), limit+1))
+
+	switch {
+	case err != nil:
+		err = uploadError(http.StatusBadRequest, "Upload error", err)
+	case f.Size > fileLimit:
+		err = uploadError(http.StatusRequestEntityTooLarge, "File too large", fmt.Errorf(`"%s"`, f.FileName))
+	case f.Size > *totalLeft:
+		err = uploadError(http.StatusRequestEntityTooLarge, "Upload too large", nil)
+	}
+
+	if err != nil {
+		if a, ok := wc.(uploadAborter); ok {
+			a.Abort()
+		} else {
+			wc.Close()
+		}
+		return
+	}
+
+	err = wc.Close()
+	if err != nil {
+		return uploadError(http.StatusInternalServerError, "Upload target error", err)
+	}
+
+	*totalLeft -= f.Size
+
+	if len(hashes) > 0 {
+		f.Checksums = make(map[string]string, len(hashes))
+		for name, h := range hashes {
+			f.Checksums[name] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+
+	return
+}
+
+// Cleanup -- removes the received files stored by ReceiveUpload
+func (result *UploadResult) Cleanup() {
+	if result == nil {
+		return
+	}
+
+	for _, f := range result.Files {
+		if f.Path != "" {
+			os.Remove(f.Path)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// genericContentType -- DetectContentType can't say more about JSON, CSV, unknown binary formats and so on
+func genericContentType(contentType string) bool {
+	ct, _, _ := strings.Cut(contentType, ";")
+	return ct == "application/octet-stream" || ct == "text/plain"
+}
+
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+
+		switch {
+		case a == "*/*" || a == ct:
+			return true
+		case strings.HasSuffix(a, "/*") && strings.HasPrefix(ct, strings.TrimSuffix(a, "*")):
+			return true
+		}
+	}
+
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,630 @@
+package stdhttp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// ResumableConfig --
+	ResumableConfig struct {
+		Dir        string                `toml:"dir"`       // uploads and their state, required
+		MaxSize    int64                 `toml:"max-size"`  // 0 -- no limit
+		Expire     config.Duration       `toml:"expire"`    // unfinished uploads are removed after that time of inactivity, 0 -- 24h
+		Checksums  []string              `toml:"checksums"` // checksums of the whole file calculated on completion
+		OnComplete ResumableCompleteFunc `toml:"-"`         // required, the completed file belongs to it
+	}
+
+	// ResumableCompleteFunc -- called after the last chunk. The upload is removed on error, the file must be moved or removed otherwise
+	ResumableCompleteFunc func(id uint64, r *http.Request, u *ResumableUpload) error
+
+	// ResumableUpload --
+	ResumableUpload struct {
+		ID        string            `json:"id"`
+		Length    int64             `json:"length"`
+		Offset    int64             `json:"offset"`
+		Metadata  map[string]string `json:"metadata,omitempty"`
+		Created   time.Time         `json:"created"`
+		Updated   time.Time         `json:"updated"`
+		Path      string            `json:"-"` // data file
+		Checksums map[string]string `json:"checksums,omitempty"`
+	}
+
+	// ResumableUploads -- tus 1.0.0 core protocol with the creation, termination, checksum and expiration extensions
+	ResumableUploads struct {
+		prefix string
+		cfg    ResumableConfig
+		mutex  sync.Mutex
+		busy   misc.BoolMap
+	}
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+
+	HTTPheaderTusResumable         = "Tus-Resumable"
+	HTTPheaderTusVersion           = "Tus-Version"
+	HTTPheaderTusExtension         = "Tus-Extension"
+	HTTPheaderTusMaxSize           = "Tus-Max-Size"
+	HTTPheaderTusChecksumAlgorithm = "Tus-Checksum-Algorithm"
+	HTTPheaderUploadOffset         = "Upload-Offset"
+	HTTPheaderUploadLength         = "Upload-Length"
+	HTTPheaderUploadMetadata       = "Upload-Metadata"
+	HTTPheaderUploadChecksum       = "Upload-Checksum"
+	HTTPheaderUploadExpires        = "Upload-Expires"
+
+	mimeOffsetOctetStream = "application/offset+octet-stream"
+
+	// StatusChecksumMismatch -- tus checksum extension
+	StatusChecksumMismatch = 460
+
+	defaultResumableExpire = 24 * time.Hour
+)
+
+var (
+	resumableIDre = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// AddResumableUploads -- registers the resumable uploads handler at the path prefix. The request timeout is disabled for it
+func (h *HTTP) AddResumableUploads(prefix string, cfg *ResumableConfig) (u *ResumableUploads, err error) {
+	if cfg == nil || cfg.Dir == "" {
+		return nil, fmt.Errorf("resumable uploads: dir is not defined")
+	}
+
+	if cfg.OnComplete == nil {
+		// nobody would take or remove the completed files
+		return nil, fmt.Errorf("resumable uploads: OnComplete is not defined")
+	}
+
+	for _, name := range cfg.Checksums {
+		if _, exists := checksumFuncs[name]; !exists {
+			return nil, fmt.Errorf(`resumable uploads: unknown checksum "%s"`, name)
+		}
+	}
+
+	err = os.MkdirAll(cfg.Dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("resumable uploads: %s", err)
+	}
+
+	u = &ResumableUploads{
+		prefix: "/" + strings.Trim(prefix, "/"),
+		cfg:    *cfg,
+		busy:   make(misc.BoolMap),
+	}
+
+	if u.cfg.Expire <= 0 {
+		u.cfg.Expire = config.Duration(defaultResumableExpire)
+	}
+
+	h.AddHandlerEx(u, false)
+
+	h.AddEndpointsInfo(misc.StringMap{
+		u.prefix + "/*": "Resumable uploads (tus " + tusVersion + ")",
+	})
+
+	h.SetEndpointTimeout(u.prefix, 0)
+	h.SetEndpointTimeout(u.prefix+"/*", 0)
+	h.SetRawBodyEndpoint(u.prefix + "/*")
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Handler --
+func (u *ResumableUploads) Handler(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (processed bool, basePath string) {
+	if path != u.prefix && !strings.HasPrefix(path, u.prefix+"/") {
+		return false, ""
+	}
+
+	processed = true
+	basePath = u.prefix + "/*"
+
+	w.Header().Set(HTTPheaderTusResumable, tusVersion)
+
+	if r.Method == http.MethodOptions {
+		u.options(w)
+		return
+	}
+
+	if r.Header.Get(HTTPheaderTusResumable) != tusVersion {
+		w.Header().Set(HTTPheaderTusVersion, tusVersion)
+		Error(id, false, w, r, http.StatusPreconditionFailed, "Unsupported protocol version", nil)
+		return
+	}
+
+	uploadID := strings.Trim(path[len(u.prefix):], "/")
+
+	if uploadID == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "OPTIONS, POST")
+			Error(id, false, w, r, http.StatusMethodNotAllowed, "Method not allowed", nil)
+			return
+		}
+
+		u.create(id, prefix, w, r)
+		return
+	}
+
+	if !resumableIDre.MatchString(uploadID) {
+		Error(id, false, w, r, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		u.head(id, uploadID, w, r)
+	case http.MethodPatch:
+		u.patch(id, uploadID, w, r)
+	case http.MethodDelete:
+		u.delete(id, uploadID, w, r)
+	default:
+		w.Header().Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		Error(id, false, w, r, http.StatusMethodNotAllowed, "Method not allowed", nil)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (u *ResumableUploads) options(w http.ResponseWriter) {
+	w.Header().Set(HTTPheaderTusVersion, tusVersion)
+	w.Header().Set(HTTPheaderTusExtension, tusExtensions)
+	w.Header().Set(HTTPheaderTusChecksumAlgorithm, ChecksumMD5+","+ChecksumSHA1+","+ChecksumSHA256+","+ChecksumSHA512)
+	if u.cfg.MaxSize > 0 {
+		w.Header().Set(HTTPheaderTusMaxSize, strconv.FormatInt(u.cfg.MaxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u *ResumableUploads) create(id uint64, prefix string, w http.ResponseWriter, r *http.Request) {
+	u.removeExpired()
+
+	length, err := strconv.ParseInt(r.Header.Get(HTTPheaderUploadLength), 10, 64)
+	if err != nil || length < 0 {
+		Error(id, false, w, r, http.StatusBadRequest, "Bad "+HTTPheaderUploadLength, err)
+		return
+	}
+
+	if u.cfg.MaxSize > 0 && length > u.cfg.MaxSize {
+		Error(id, false, w, r, http.StatusRequestEntityTooLarge, "Upload too large", nil)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get(HTTPheaderUploadMetadata))
+	if err != nil {
+		Error(id, false, w, r, http.StatusBadRequest, "Bad "+HTTPheaderUploadMetadata, err)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	now := misc.NowUTC()
+	upload := &ResumableUpload{
+		ID:       hex.EncodeToString(b),
+		Length:   length,
+		Metadata: metadata,
+		Created:  now,
+		Updated:  now,
+	}
+	upload.Path = u.dataPath(upload.ID)
+
+	fd, err := os.OpenFile(upload.Path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, "Upload error", err)
+		return
+	}
+	fd.Close()
+
+	err = u.saveState(upload)
+	if err != nil {
+		os.Remove(upload.Path)
+		Error(id, false, w, r, http.StatusInternalServerError, "Upload error", err)
+		return
+	}
+
+	Log.Message(log.DEBUG, `[%d] Upload %s created, %d bytes`, id, upload.ID, length)
+
+	if length == 0 {
+		// nothing to wait for
+		if !u.complete(id, upload, w, r) {
+			return
+		}
+	} else {
+		w.Header().Set(HTTPheaderUploadExpires, u.expires(upload))
+	}
+
+	w.Header().Set("Location", prefix+u.prefix+"/"+upload.ID)
+	w.Header().Set(HTTPheaderUploadOffset, "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (u *ResumableUploads) head(id uint64, uploadID string, w http.ResponseWriter, r *http.Request) {
+	upload, err := u.loadState(uploadID)
+	if err != nil {
+		u.stateError(id, err, w, r)
+		return
+	}
+
+	w.Header().Set(HTTPheaderCacheControl, "no-store")
+	w.Header().Set(HTTPheaderUploadOffset, strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set(HTTPheaderUploadLength, strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set(HTTPheaderUploadMetadata, formatUploadMetadata(upload.Metadata))
+	}
+	w.Header().Set(HTTPheaderUploadExpires, u.expires(upload))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (u *ResumableUploads) patch(id uint64, uploadID string, w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != mimeOffsetOctetStream {
+		Error(id, false, w, r, http.StatusUnsupportedMediaType, "Content type must be "+mimeOffsetOctetStream, nil)
+		return
+	}
+
+	if !u.lock(uploadID) {
+		Error(id, false, w, r, http.StatusLocked, "Upload is in progress", nil)
+		return
+	}
+	defer u.unlock(uploadID)
+
+	upload, err := u.loadState(uploadID)
+	if err != nil {
+		u.stateError(id, err, w, r)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(HTTPheaderUploadOffset), 10, 64)
+	if err != nil {
+		Error(id, false, w, r, http.StatusBadRequest, "Bad "+HTTPheaderUploadOffset, err)
+		return
+	}
+
+	if offset != upload.Offset {
+		Error(id, false, w, r, http.StatusConflict, "Offset mismatch", fmt.Errorf("%d expected, %d received", upload.Offset, offset))
+		return
+	}
+
+	var chunkHash hash.Hash
+	var expectedSum []byte
+
+	if v := r.Header.Get(HTTPheaderUploadChecksum); v != "" {
+		name, sum, _ := strings.Cut(v, " ")
+		f, exists := checksumFuncs[name]
+		if !exists || name == ChecksumCRC32 {
+			Error(id, false, w, r, http.StatusBadRequest, "Unsupported checksum algorithm", fmt.Errorf(`"%s"`, name))
+			return
+		}
+
+		expectedSum, err = base64.StdEncoding.DecodeString(sum)
+		if err != nil {
+			Error(id, false, w, r, http.StatusBadRequest, "Bad "+HTTPheaderUploadChecksum, err)
+			return
+		}
+
+		chunkHash = f()
+	}
+
+	fd, err := os.OpenFile(upload.Path, os.O_WRONLY, 0)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, "Upload error", err)
+		return
+	}
+	defer fd.Close()
+
+	_, err = fd.Seek(upload.Offset, io.SeekStart)
+	if err != nil {
+		Error(id, false, w, r, http.StatusInternalServerError, "Upload error", err)
+		return
+	}
+
+	var dst io.Writer = fd
+	if chunkHash != nil {
+		dst = io.MultiWriter(fd, chunkHash)
+	}
+
+	left := upload.Length - upload.Offset
+	n, copyErr := io.Copy(dst, io.LimitReader(r.Body, left+1))
+
+	rollback := func() {
+		fd.Truncate(upload.Offset)
+	}
+
+	switch {
+	case n > left:
+		rollback()
+		Error(id, false, w, r, http.StatusRequestEntityTooLarge, "Chunk exceeds the upload length", nil)
+		return
+
+	case chunkHash != nil && (copyErr != nil || string(chunkHash.Sum(nil)) != string(expectedSum)):
+		// the chunk can't be verified partially
+		rollback()
+		if copyErr != nil {
+			Log.Message(log.DEBUG, `[%d] Upload %s: %s`, id, upload.ID, copyErr)
+			return
+		}
+		Error(id, false, w, r, StatusChecksumMismatch, "Checksum mismatch", nil)
+		return
+	}
+
+	// without the checksum the received part is kept even if the connection has been lost
+	upload.Offset += n
+	upload.Updated = misc.NowUTC()
+
+	err = u.saveState(upload)
+	if err != nil {
+		rollback()
+		Error(id, false, w, r, http.StatusInternalServerError, "Upload error", err)
+		return
+	}
+
+	if copyErr != nil {
+		Log.Message(log.DEBUG, `[%d] Upload %s interrupted at %d: %s`, id, upload.ID, upload.Offset, copyErr)
+		return
+	}
+
+	Log.Message(log.TRACE3, `[%d] Upload %s: %d of %d bytes`, id, upload.ID, upload.Offset, upload.Length)
+
+	if upload.Offset == upload.Length {
+		fd.Close()
+		if !u.complete(id, upload, w, r) {
+			return
+		}
+	} else {
+		w.Header().Set(HTTPheaderUploadExpires, u.expires(upload))
+	}
+
+	w.Header().Set(HTTPheaderUploadOffset, strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u *ResumableUploads) delete(id uint64, uploadID string, w http.ResponseWriter, r *http.Request) {
+	if !u.lock(uploadID) {
+		Error(id, false, w, r, http.StatusLocked, "Upload is in progress", nil)
+		return
+	}
+	defer u.unlock(uploadID)
+
+	_, err := u.loadState(uploadID)
+	if err != nil {
+		u.stateError(id, err, w, r)
+		return
+	}
+
+	u.Remove(uploadID)
+	Log.Message(log.DEBUG, `[%d] Upload %s terminated`, id, uploadID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete -- false if the reply has already been sent
+func (u *ResumableUploads) complete(id uint64, upload *ResumableUpload, w http.ResponseWriter, r *http.Request) bool {
+	// the state is not needed anymore, the data file belongs to OnComplete now
+	os.Remove(u.statePath(upload.ID))
+
+	if len(u.cfg.Checksums) > 0 {
+		sums, err := fileChecksums(upload.Path, u.cfg.Checksums)
+		if err != nil {
+			os.Remove(upload.Path)
+			Error(id, false, w, r, http.StatusInternalServerError, "Upload error", err)
+			return false
+		}
+		upload.Checksums = sums
+	}
+
+	Log.Message(log.DEBUG, `[%d] Upload %s completed, %d bytes`, id, upload.ID, upload.Length)
+
+	err := u.cfg.OnComplete(id, r, upload)
+	if err != nil {
+		os.Remove(upload.Path)
+		Error(id, false, w, r, UploadErrorCode(err), "Upload is not accepted", err)
+		return false
+	}
+
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Remove -- removes the unfinished upload
+func (u *ResumableUploads) Remove(uploadID string) {
+	os.Remove(u.statePath(uploadID))
+	os.Remove(u.dataPath(uploadID))
+}
+
+func (u *ResumableUploads) removeExpired() {
+	entries, err := os.ReadDir(u.cfg.Dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		uploadID, isState := strings.CutSuffix(e.Name(), ".json")
+		if !isState || !resumableIDre.MatchString(uploadID) {
+			continue
+		}
+
+		upload, err := u.loadState(uploadID)
+		if err != nil || time.Since(upload.Updated) <= u.cfg.Expire.D() {
+			continue
+		}
+
+		if u.lock(uploadID) {
+			u.Remove(uploadID)
+			u.unlock(uploadID)
+			Log.Message(log.DEBUG, `Upload %s expired`, uploadID)
+		}
+	}
+}
+
+func (u *ResumableUploads) expires(upload *ResumableUpload) string {
+	return upload.Updated.Add(u.cfg.Expire.D()).Format(http.TimeFormat)
+}
+
+func (u *ResumableUploads) lock(uploadID string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.busy[uploadID] {
+		return false
+	}
+
+	u.busy[uploadID] = true
+	return true
+}
+
+func (u *ResumableUploads) unlock(uploadID string) {
+	u.mutex.Lock()
+	delete(u.busy, uploadID)
+	u.mutex.Unlock()
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (u *ResumableUploads) dataPath(uploadID string) string {
+	return filepath.Join(u.cfg.Dir, uploadID+".bin")
+}
+
+func (u *ResumableUploads) statePath(uploadID string) string {
+	return filepath.Join(u.cfg.Dir, uploadID+".json")
+}
+
+func (u *ResumableUploads) saveState(upload *ResumableUpload) (err error) {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return
+	}
+
+	fn := u.statePath(upload.ID)
+	tmp := fn + ".tmp"
+
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp, fn)
+}
+
+func (u *ResumableUploads) loadState(uploadID string) (upload *ResumableUpload, err error) {
+	data, err := os.ReadFile(u.statePath(uploadID))
+	if err != nil {
+		return
+	}
+
+	upload = &ResumableUpload{}
+	err = json.Unmarshal(data, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	upload.Path = u.dataPath(uploadID)
+
+	if time.Since(upload.Updated) > u.cfg.Expire.D() {
+		return nil, fs.ErrNotExist
+	}
+
+	return
+}
+
+func (u *ResumableUploads) stateError(id uint64, err error, w http.ResponseWriter, r *http.Request) {
+	if errors.Is(err, fs.ErrNotExist) {
+		Error(id, false, w, r, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+
+	Error(id, false, w, r, http.StatusInternalServerError, "Upload error", err)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// parseUploadMetadata -- "key base64value,key2 base64value2"
+func parseUploadMetadata(s string) (md map[string]string, err error) {
+	md = make(map[string]string)
+
+	for pair := range strings.SplitSeq(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(pair, " ")
+		if key == "" {
+			return nil, fmt.Errorf(`empty key in "%s"`, pair)
+		}
+
+		v, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf(`"%s": %s`, key, err)
+		}
+
+		md[key] = string(v)
+	}
+
+	return
+}
+
+func formatUploadMetadata(md map[string]string) string {
+	list := make([]string, 0, len(md))
+	for k, v := range md {
+		list = append(list, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+
+	return strings.Join(list, ",")
+}
+
+func fileChecksums(fn string, names []string) (sums map[string]string, err error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	hashes := make([]hash.Hash, len(names))
+	writers := make([]io.Writer, len(names))
+	for i, name := range names {
+		hashes[i] = checksumFuncs[name]()
+		writers[i] = hashes[i]
+	}
+
+	_, err = io.Copy(io.MultiWriter(writers...), fd)
+	if err != nil {
+		return
+	}
+
+	sums = make(map[string]string, len(names))
+	for i, name := range names {
+		sums[name] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
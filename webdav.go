@@ -0,0 +1,392 @@
+package stdhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// WebDAVConfig --
+	WebDAVConfig struct {
+		Prefix   string                  `toml:"prefix"`    // URL path, e.g. "/dav", protect it in Auth.Endpoints
+		ReadOnly bool                    `toml:"read-only"` // PUT, DELETE, MKCOL, MOVE, COPY, PROPPATCH, LOCK and UNLOCK are forbidden even if Write is defined
+		Write    map[string]misc.BoolMap `toml:"write"`     // path pattern inside the WebDAV tree ("/incoming/*") -> "user", "@group" or "*". The paths without the matched pattern are read only, empty -- all of them
+	}
+
+	webDAV struct {
+		prefix    string
+		cfg       WebDAVConfig
+		writeKeys misc.BoolMap
+		fs        *webdavFS
+		ls        webdav.LockSystem
+		h         *HTTP
+	}
+
+	// webdavFS -- webdav.FileSystem confined to the root by os.Root. Dotfiles, deny patterns and the symlinks policy of the file server are applied too
+	webdavFS struct {
+		root *os.Root
+		h    *HTTP
+	}
+
+	// webdavFile -- hides the rejected entries in the directory listings
+	webdavFile struct {
+		*os.File
+		fs   *webdavFS
+		name string
+	}
+)
+
+const (
+	ctxWebDAVrequest = ContextKey("webdav-request")
+)
+
+var (
+	webdavWriteMethods = misc.BoolMap{
+		MethodPUT:    true,
+		MethodDELETE: true,
+		"MKCOL":      true,
+		"MOVE":       true,
+		"COPY":       true,
+		"PROPPATCH":  true,
+		"LOCK":       true,
+		"UNLOCK":     true,
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SetWebDAV -- WebDAV access to the listener root, read only unless cfg.Write is defined. The handler is added to the end of the handlers chain.
+// The dotfiles, deny and symlinks rules of the file server are used, "all" symlinks policy works as "within-root" here
+func (h *HTTP) SetWebDAV(cfg *WebDAVConfig) (err error) {
+	if cfg == nil {
+		return fmt.Errorf("webdav: config is nil")
+	}
+
+	if h.listenerCfg.Root == "" {
+		return fmt.Errorf("webdav: root is not defined")
+	}
+
+	if h.webdav != nil {
+		return fmt.Errorf("webdav: already enabled at %s", h.webdav.prefix)
+	}
+
+	prefix := "/" + strings.Trim(cfg.Prefix, "/")
+	if prefix == "/" {
+		return fmt.Errorf("webdav: prefix is not defined")
+	}
+
+	rt, err := os.OpenRoot(h.listenerCfg.Root)
+	if err != nil {
+		return fmt.Errorf("webdav: %s", err)
+	}
+
+	d := &webDAV{
+		prefix:    prefix,
+		cfg:       *cfg,
+		writeKeys: make(misc.BoolMap, len(cfg.Write)),
+		fs:        &webdavFS{root: rt, h: h},
+		ls:        webdav.NewMemLS(),
+		h:         h,
+	}
+
+	for pattern := range cfg.Write {
+		d.writeKeys[pattern] = true
+	}
+
+	h.webdav = d
+	h.AddHandlerEx(d, false)
+
+	mode := "read only"
+	if !cfg.ReadOnly && len(cfg.Write) != 0 {
+		mode = "read/write"
+	}
+
+	h.AddEndpointsInfo(misc.StringMap{
+		prefix + "/*": "WebDAV access to the root (" + mode + ")",
+	})
+
+	// large files, their content must not be changed
+	for _, pattern := range []string{prefix, prefix + "/*"} {
+		h.SetEndpointTimeout(pattern, 0)
+		h.SetRawBodyEndpoint(pattern)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Handler --
+func (d *webDAV) Handler(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (processed bool, basePath string) {
+	if path != d.prefix && !strings.HasPrefix(path, d.prefix+"/") {
+		return false, ""
+	}
+
+	processed = true
+	basePath = d.prefix + "/*"
+
+	davPath := "/" + strings.Trim(path[len(d.prefix):], "/")
+	isWrite := webdavWriteMethods[r.Method]
+
+	r = r.WithContext(context.WithValue(r.Context(), ctxWebDAVrequest, id))
+
+	// the file system refuses them too, but the webdav package replies to the most of errors with 404
+	if !d.nameAllowed(id, davPath, w, r) {
+		return
+	}
+
+	if isWrite {
+		if !d.writeAllowed(id, davPath, r) {
+			Error(id, false, w, r, http.StatusForbidden, "Write access denied", fmt.Errorf("%s %s", r.Method, davPath))
+			return
+		}
+
+		if r.Method == "MOVE" || r.Method == "COPY" {
+			dst, ok := d.destination(prefix, r)
+			if !ok || !d.writeAllowed(id, dst, r) {
+				Error(id, false, w, r, http.StatusForbidden, "Write access denied", fmt.Errorf("%s %s -> %s", r.Method, davPath, dst))
+				return
+			}
+
+			if !d.nameAllowed(id, dst, w, r) {
+				return
+			}
+		}
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     prefix + d.prefix,
+		FileSystem: d.fs,
+		LockSystem: d.ls,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				Log.Message(log.DEBUG, `[%d] WebDAV %s "%s": %s`, id, r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	handler.ServeHTTP(w, r)
+
+	if isWrite && r.Method != "LOCK" && r.Method != "UNLOCK" {
+		var err error
+		if rr := GetResponseRecorder(r); rr != nil && rr.Status() >= http.StatusBadRequest {
+			err = fmt.Errorf("status %d", rr.Status())
+		}
+		d.h.Audit(id, r, "webdav", r.Method+" "+davPath, err)
+	}
+
+	return
+}
+
+// writeAllowed -- davPath is relative to the WebDAV tree
+func (d *webDAV) writeAllowed(id uint64, davPath string, r *http.Request) bool {
+	if d.cfg.ReadOnly || len(d.cfg.Write) == 0 {
+		return false
+	}
+
+	pattern, exists := isPathInList(davPath, d.writeKeys)
+	if !exists {
+		return false
+	}
+
+	identity, _ := GetIdentityFromRequestContext(r)
+	if CheckPermissions(identity, d.cfg.Write[pattern]) {
+		return true
+	}
+
+	Log.Message(log.DEBUG, `[%d] WebDAV write to "%s" is not permitted by "%s"`, id, davPath, pattern)
+	return false
+}
+
+// nameAllowed -- replies 404 or 403 if the name is rejected by the file server rules
+func (d *webDAV) nameAllowed(id uint64, davPath string, w http.ResponseWriter, r *http.Request) bool {
+	_, err := d.fs.name(r.Context(), davPath)
+	if err == nil {
+		return true
+	}
+
+	code := http.StatusForbidden
+	if errors.Is(err, os.ErrNotExist) {
+		code = http.StatusNotFound
+	}
+
+	Error(id, false, w, r, code, http.StatusText(code), nil)
+	return false
+}
+
+// destination -- the Destination header of MOVE and COPY relative to the WebDAV tree
+func (d *webDAV) destination(prefix string, r *http.Request) (davPath string, ok bool) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+
+	p := path.Clean(u.Path)
+	base := prefix + d.prefix
+	if p != base && !strings.HasPrefix(p, base+"/") {
+		return "", false
+	}
+
+	return "/" + strings.Trim(p[len(base):], "/"), true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// name -- relative to the root, "." is the root itself. The rejected names are reported as absent (dotfiles with the ignore policy) or forbidden
+func (f *webdavFS) name(ctx context.Context, name string) (string, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return ".", nil
+	}
+
+	s := f.h.getFileServer()
+
+	reason := s.checkName(name)
+	if reason == "" && s.cfg.Symlinks == SymlinksDeny && f.symlinkInPath(name) {
+		reason = RejectSymlink
+	}
+
+	if reason == "" {
+		return name, nil
+	}
+
+	id, _ := ctx.Value(ctxWebDAVrequest).(uint64)
+	s.reject(id, reason, name, nil)
+
+	if reason == RejectDotfile && s.cfg.Dotfiles == DotfilesIgnore {
+		return "", os.ErrNotExist
+	}
+
+	return "", os.ErrPermission
+}
+
+// symlinkInPath -- some existing element of the path is the symbolic link
+func (f *webdavFS) symlinkInPath(name string) bool {
+	elems := strings.Split(name, "/")
+	for i := range elems {
+		fi, err := f.root.Lstat(strings.Join(elems[:i+1], "/"))
+		if err != nil {
+			return false
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hidden -- the entry of the directory listing is rejected, nothing is logged
+func (f *webdavFS) hidden(name string) bool {
+	s := f.h.getFileServer()
+
+	if s.checkName(name) != "" {
+		return true
+	}
+
+	if s.cfg.Symlinks == SymlinksDeny && f.symlinkInPath(name) {
+		return true
+	}
+
+	return false
+}
+
+// Mkdir --
+func (f *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := f.name(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return f.root.Mkdir(name, perm)
+}
+
+// OpenFile --
+func (f *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := f.name(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := f.root.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webdavFile{File: fd, fs: f, name: name}, nil
+}
+
+// RemoveAll --
+func (f *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	name, err := f.name(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if name == "." {
+		return os.ErrPermission
+	}
+
+	return f.root.RemoveAll(name)
+}
+
+// Rename --
+func (f *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := f.name(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	newName, err = f.name(ctx, newName)
+	if err != nil {
+		return err
+	}
+
+	if oldName == "." || newName == "." {
+		return os.ErrPermission
+	}
+
+	return f.root.Rename(oldName, newName)
+}
+
+// Stat --
+func (f *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := f.name(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.root.Stat(name)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Readdir --
+func (fd *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	list, err := fd.File.Readdir(count)
+
+	filtered := list[:0]
+	for _, fi := range list {
+		if !fd.fs.hidden(path.Join(fd.name, fi.Name())) {
+			filtered = append(filtered, fi)
+		}
+	}
+
+	return filtered, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,850 @@
+package stdhttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/loadavg"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// WebSocketConfig --
+	WebSocketConfig struct {
+		Subprotocols   []string                   `toml:"subprotocols"`     // in the order of preference
+		MaxMessageSize int64                      `toml:"max-message-size"` // after decompression, 0 -- 1MB
+		Compression    bool                       `toml:"compression"`      // permessage-deflate if the client offers it
+		PingInterval   config.Duration            `toml:"ping-interval"`    // 0 -- 30s, <0 -- no pings
+		PongTimeout    config.Duration            `toml:"pong-timeout"`     // the connection is closed if nothing is received during PingInterval+PongTimeout, 0 -- 10s
+		WriteTimeout   config.Duration            `toml:"write-timeout"`    // 0 -- 10s
+		CheckOrigin    func(r *http.Request) bool `toml:"-"`                // nil -- no Origin or the same host
+	}
+
+	// WebSocketConn -- ReadMessage must be called from one goroutine, writes are safe from any
+	WebSocketConn struct {
+		id          uint64
+		h           *HTTP
+		conn        net.Conn
+		br          *bufio.Reader
+		cfg         WebSocketConfig
+		subprotocol string
+		compress    bool
+		writeMutex  sync.Mutex
+		closeSent   bool
+		closeOnce   sync.Once
+		done        chan struct{}
+	}
+
+	// WebSocketHandler -- serves the connection accepted by the endpoint added by AddWebSocketEndpoint, the connection is closed when it returns
+	WebSocketHandler func(id uint64, c *WebSocketConn, r *http.Request)
+
+	webSocketEndpoint struct {
+		path    string
+		cfg     *WebSocketConfig
+		handler WebSocketHandler
+		h       *HTTP
+	}
+
+	// WebSocketCloseError -- the connection was closed by the client
+	WebSocketCloseError struct {
+		Code int
+		Text string
+	}
+
+	// WebSocketStat --
+	WebSocketStat struct {
+		Active      int64   `json:"active" comment:"Active connections"`
+		Total       uint64  `json:"total" comment:"Accepted connections"`
+		MessagesIn  uint64  `json:"messagesIn" comment:"Received messages"`
+		MessagesOut uint64  `json:"messagesOut" comment:"Sent messages"`
+		BytesIn     uint64  `json:"bytesIn" comment:"Received payload bytes"`
+		BytesOut    uint64  `json:"bytesOut" comment:"Sent payload bytes"`
+		InRate      float64 `json:"inRate" comment:"Received messages load average"`
+		OutRate     float64 `json:"outRate" comment:"Sent messages load average"`
+	}
+
+	webSockets struct {
+		mutex sync.Mutex
+		conns map[*WebSocketConn]bool
+		stat  WebSocketStat
+		laIn  *loadavg.LoadAvg
+		laOut *loadavg.LoadAvg
+	}
+
+	wsFrame struct {
+		fin     bool
+		rsv1    bool
+		opcode  byte
+		payload []byte
+	}
+)
+
+const (
+	// WebSocketText --
+	WebSocketText = 1
+	// WebSocketBinary --
+	WebSocketBinary = 2
+
+	wsContinuation = 0
+	wsClose        = 8
+	wsPing         = 9
+	wsPong         = 10
+
+	// WebSocketCloseNormal --
+	WebSocketCloseNormal = 1000
+	// WebSocketCloseGoingAway --
+	WebSocketCloseGoingAway = 1001
+	// WebSocketCloseProtocolError --
+	WebSocketCloseProtocolError = 1002
+	// WebSocketCloseUnsupportedData --
+	WebSocketCloseUnsupportedData = 1003
+	// WebSocketCloseNoStatus -- received only
+	WebSocketCloseNoStatus = 1005
+	// WebSocketCloseAbnormal -- received only
+	WebSocketCloseAbnormal = 1006
+	// WebSocketCloseInvalidPayload --
+	WebSocketCloseInvalidPayload = 1007
+	// WebSocketClosePolicyViolation --
+	WebSocketClosePolicyViolation = 1008
+	// WebSocketCloseMessageTooBig --
+	WebSocketCloseMessageTooBig = 1009
+	// WebSocketCloseMandatoryExtension --
+	WebSocketCloseMandatoryExtension = 1010
+	// WebSocketCloseInternalError --
+	WebSocketCloseInternalError = 1011
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsDeflate             = "permessage-deflate"
+	wsCompressMinSize     = 128
+	wsCloseGrace          = time.Second
+	wsMaxControlPayload   = 125
+	defaultWSMaxMessage   = 1 << 20
+	defaultWSPingInterval = 30 * time.Second
+	defaultWSPongTimeout  = 10 * time.Second
+	defaultWSWriteTimeout = 10 * time.Second
+)
+
+var (
+	// tail of the sync flush and the final empty block
+	wsDeflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+	wsFlateWriters = sync.Pool{
+		New: func() any {
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		},
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Error --
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Text)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// UpgradeWebSocket -- switches the request to the WebSocket protocol. The error reply has already been sent if err is not nil.
+// Call it from the handler after the listener checks, disable the request timeout for the endpoint (SetEndpointTimeout(path, 0))
+// and close the connection when the handler exits. AddWebSocketEndpoint does all of it
+func (h *HTTP) UpgradeWebSocket(id uint64, w http.ResponseWriter, r *http.Request, cfg *WebSocketConfig) (c *WebSocketConn, err error) {
+	c = &WebSocketConn{
+		id:   id,
+		h:    h,
+		done: make(chan struct{}),
+	}
+
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+
+	if c.cfg.MaxMessageSize <= 0 {
+		c.cfg.MaxMessageSize = defaultWSMaxMessage
+	}
+	if c.cfg.PingInterval == 0 {
+		c.cfg.PingInterval = config.Duration(defaultWSPingInterval)
+	}
+	if c.cfg.PongTimeout <= 0 {
+		c.cfg.PongTimeout = config.Duration(defaultWSPongTimeout)
+	}
+	if c.cfg.WriteTimeout <= 0 {
+		c.cfg.WriteTimeout = config.Duration(defaultWSWriteTimeout)
+	}
+
+	fail := func(code int, msg string, e error) (*WebSocketConn, error) {
+		Error(id, false, w, r, code, msg, e)
+		if e == nil {
+			e = errors.New(msg)
+		}
+		return nil, e
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return fail(http.StatusMethodNotAllowed, "Method not allowed", nil)
+	}
+
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "WebSocket upgrade expected", nil)
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "Unsupported WebSocket version", nil)
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if k, e := base64.StdEncoding.DecodeString(key); e != nil || len(k) != 16 {
+		return fail(http.StatusBadRequest, "Bad Sec-WebSocket-Key", e)
+	}
+
+	checkOrigin := c.cfg.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return fail(http.StatusForbidden, "Origin is not allowed", fmt.Errorf(`"%s"`, r.Header.Get(HTTPheaderOrigin)))
+	}
+
+	c.subprotocol = selectSubprotocol(r, c.cfg.Subprotocols)
+	c.compress = c.cfg.Compression && offersDeflate(r)
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "WebSocket is not supported", fmt.Errorf("%T does not support hijacking", w))
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return fail(http.StatusInternalServerError, "WebSocket is not supported", err)
+	}
+
+	c.conn = conn
+	c.br = rw.Reader
+
+	// the server timeouts are not applicable anymore
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+
+	var sb strings.Builder
+	sb.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	sb.WriteString(base64.StdEncoding.EncodeToString(sum[:]))
+	sb.WriteString("\r\n")
+	if c.subprotocol != "" {
+		sb.WriteString("Sec-WebSocket-Protocol: " + c.subprotocol + "\r\n")
+	}
+	if c.compress {
+		sb.WriteString("Sec-WebSocket-Extensions: " + wsDeflate + "; server_no_context_takeover; client_no_context_takeover\r\n")
+	}
+	if rid := GetRequestID(r); rid != "" {
+		sb.WriteString(HTTPheaderRequestID + ": " + rid + "\r\n")
+	}
+	sb.WriteString("\r\n")
+
+	conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout.D()))
+	_, err = conn.Write([]byte(sb.String()))
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	h.getWebSockets().attach(c)
+
+	if c.cfg.PingInterval > 0 {
+		go c.pinger()
+	}
+
+	Log.Message(log.DEBUG, `[%d] WebSocket connected, subprotocol "%s", compression %t`, id, c.subprotocol, c.compress)
+	return c, nil
+}
+
+// AddWebSocketEndpoint -- the handler is called for the upgraded connections of the path, the request timeout is disabled for it
+func (h *HTTP) AddWebSocketEndpoint(path string, cfg *WebSocketConfig, handler WebSocketHandler, description string) {
+	if description == "" {
+		description = "WebSocket"
+	}
+
+	h.AddHandlerEx(&webSocketEndpoint{path: path, cfg: cfg, handler: handler, h: h}, false)
+	h.AddEndpointsInfo(misc.StringMap{path: description})
+	h.SetEndpointTimeout(path, 0)
+}
+
+// Handler --
+func (e *webSocketEndpoint) Handler(id uint64, prefix string, path string, w http.ResponseWriter, r *http.Request) (processed bool, basePath string) {
+	if path != e.path {
+		return false, ""
+	}
+
+	c, err := e.h.UpgradeWebSocket(id, w, r, e.cfg)
+	if err != nil {
+		return true, path
+	}
+	defer c.Close(WebSocketCloseNormal, "")
+
+	e.handler(id, c, r)
+	return true, path
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, v := range header.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get(HTTPheaderOrigin)
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func selectSubprotocol(r *http.Request, supported []string) string {
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for p := range strings.SplitSeq(v, ",") {
+			p = strings.TrimSpace(p)
+			for _, s := range supported {
+				if p == s {
+					return p
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// offersDeflate -- a permessage-deflate offer we can accept: the window of the server is not limited
+func offersDeflate(r *http.Request) bool {
+	for _, v := range r.Header.Values("Sec-WebSocket-Extensions") {
+	offers:
+		for offer := range strings.SplitSeq(v, ",") {
+			params := strings.Split(offer, ";")
+			if strings.TrimSpace(params[0]) != wsDeflate {
+				continue
+			}
+
+			for _, p := range params[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+				switch strings.TrimSpace(name) {
+				case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+				case "server_max_window_bits":
+					if strings.Trim(strings.TrimSpace(value), `"`) != "15" {
+						continue offers
+					}
+				default:
+					continue offers
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Subprotocol --
+func (c *WebSocketConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// RemoteAddr --
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Done -- closed when the connection is closed
+func (c *WebSocketConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// ReadMessage -- the next text or binary message. Pings are answered, the close handshake is completed
+func (c *WebSocketConn) ReadMessage() (messageType int, data []byte, err error) {
+	var msg []byte
+	compressed := false
+
+	for {
+		if c.cfg.PingInterval > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.cfg.PingInterval.D() + c.cfg.PongTimeout.D()))
+		}
+
+		f, code, err := c.readFrame()
+		if err != nil {
+			if code != 0 {
+				c.fail(code)
+			} else {
+				c.closeConn()
+			}
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case wsPing:
+			c.writeFrame(wsPong, f.payload, false)
+			continue
+
+		case wsPong:
+			continue
+
+		case wsClose:
+			ce := &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+			if len(f.payload) >= 2 {
+				ce.Code = int(binary.BigEndian.Uint16(f.payload))
+				ce.Text = string(f.payload[2:])
+			}
+
+			switch {
+			case len(f.payload) == 1 || (len(f.payload) >= 2 && !validCloseCode(ce.Code)):
+				c.fail(WebSocketCloseProtocolError)
+			case !utf8.ValidString(ce.Text):
+				c.fail(WebSocketCloseInvalidPayload)
+			case ce.Code == WebSocketCloseNoStatus:
+				c.writeClose(WebSocketCloseNormal, "")
+			default:
+				c.writeClose(ce.Code, "")
+			}
+
+			c.closeConn()
+			return 0, nil, ce
+
+		case WebSocketText, WebSocketBinary:
+			if messageType != 0 {
+				c.fail(WebSocketCloseProtocolError)
+				return 0, nil, fmt.Errorf("new message inside the fragmented one")
+			}
+			messageType = int(f.opcode)
+			compressed = f.rsv1
+
+		case wsContinuation:
+			if messageType == 0 {
+				c.fail(WebSocketCloseProtocolError)
+				return 0, nil, fmt.Errorf("continuation without the message")
+			}
+		}
+
+		if int64(len(msg)+len(f.payload)) > c.cfg.MaxMessageSize {
+			c.fail(WebSocketCloseMessageTooBig)
+			return 0, nil, fmt.Errorf("message is larger than %d bytes", c.cfg.MaxMessageSize)
+		}
+		msg = append(msg, f.payload...)
+
+		if f.fin {
+			break
+		}
+	}
+
+	if compressed {
+		var code int
+		msg, code, err = c.inflate(msg)
+		if err != nil {
+			c.fail(code)
+			return 0, nil, err
+		}
+	}
+
+	if messageType == WebSocketText && !utf8.Valid(msg) {
+		c.fail(WebSocketCloseInvalidPayload)
+		return 0, nil, fmt.Errorf("invalid UTF-8 in the text message")
+	}
+
+	c.h.getWebSockets().received(len(msg))
+	return messageType, msg, nil
+}
+
+// readFrame -- code is the close code for the protocol errors
+func (c *WebSocketConn) readFrame() (f *wsFrame, code int, err error) {
+	var hdr [2]byte
+	_, err = io.ReadFull(c.br, hdr[:])
+	if err != nil {
+		return
+	}
+
+	f = &wsFrame{
+		fin:    hdr[0]&0x80 != 0,
+		rsv1:   hdr[0]&0x40 != 0,
+		opcode: hdr[0] & 0x0f,
+	}
+
+	if hdr[0]&0x30 != 0 || (f.rsv1 && (!c.compress || f.opcode == wsContinuation || f.opcode >= wsClose)) {
+		return nil, WebSocketCloseProtocolError, fmt.Errorf("unexpected RSV bits")
+	}
+
+	switch f.opcode {
+	case wsContinuation, WebSocketText, WebSocketBinary:
+	case wsClose, wsPing, wsPong:
+		if !f.fin {
+			return nil, WebSocketCloseProtocolError, fmt.Errorf("fragmented control frame")
+		}
+	default:
+		return nil, WebSocketCloseProtocolError, fmt.Errorf("unknown opcode %d", f.opcode)
+	}
+
+	if hdr[1]&0x80 == 0 {
+		return nil, WebSocketCloseProtocolError, fmt.Errorf("unmasked client frame")
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return nil, 0, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return nil, 0, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+		if length&(1<<63) != 0 {
+			return nil, WebSocketCloseProtocolError, fmt.Errorf("bad frame length")
+		}
+	}
+
+	if f.opcode >= wsClose && length > wsMaxControlPayload {
+		return nil, WebSocketCloseProtocolError, fmt.Errorf("control frame is too long")
+	}
+
+	if length > uint64(c.cfg.MaxMessageSize) {
+		return nil, WebSocketCloseMessageTooBig, fmt.Errorf("frame is larger than %d bytes", c.cfg.MaxMessageSize)
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return nil, 0, err
+	}
+
+	f.payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, f.payload); err != nil {
+		return nil, 0, err
+	}
+
+	for i := range f.payload {
+		f.payload[i] ^= mask[i&3]
+	}
+
+	return f, 0, nil
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= WebSocketCloseNormal && code <= WebSocketCloseUnsupportedData:
+		return true
+	case code >= WebSocketCloseInvalidPayload && code <= WebSocketCloseInternalError:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+
+	return false
+}
+
+// inflate -- code is the close code for the errors
+func (c *WebSocketConn) inflate(data []byte) (msg []byte, code int, err error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(wsDeflateTail)))
+	defer fr.Close()
+
+	msg, err = io.ReadAll(io.LimitReader(fr, c.cfg.MaxMessageSize+1))
+	if err != nil {
+		return nil, WebSocketCloseInvalidPayload, err
+	}
+
+	if int64(len(msg)) > c.cfg.MaxMessageSize {
+		return nil, WebSocketCloseMessageTooBig, fmt.Errorf("message is larger than %d bytes", c.cfg.MaxMessageSize)
+	}
+
+	return msg, 0, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// WriteMessage --
+func (c *WebSocketConn) WriteMessage(messageType int, data []byte) (err error) {
+	if messageType != WebSocketText && messageType != WebSocketBinary {
+		return fmt.Errorf("bad message type %d", messageType)
+	}
+
+	size := len(data)
+	compressed := false
+
+	if c.compress && size >= wsCompressMinSize {
+		data, err = deflateMessage(data)
+		if err != nil {
+			return
+		}
+		compressed = true
+	}
+
+	err = c.writeFrame(byte(messageType), data, compressed)
+	if err != nil {
+		return
+	}
+
+	c.h.getWebSockets().sent(size)
+	return
+}
+
+// WriteText --
+func (c *WebSocketConn) WriteText(s string) error {
+	return c.WriteMessage(WebSocketText, []byte(s))
+}
+
+func deflateMessage(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	fw := wsFlateWriters.Get().(*flate.Writer)
+	defer wsFlateWriters.Put(fw)
+	fw.Reset(buf)
+
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	// RFC 7692 7.2.1: the tail of the sync flush is removed
+	return bytes.TrimSuffix(buf.Bytes(), wsDeflateTail[:4]), nil
+}
+
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte, compressed bool) (err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+
+	return c.writeFrameLocked(opcode, payload, compressed)
+}
+
+// writeFrameLocked -- must be called under the write lock
+func (c *WebSocketConn) writeFrameLocked(opcode byte, payload []byte, compressed bool) (err error) {
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | opcode
+	if compressed {
+		hdr[0] |= 0x40
+	}
+
+	n := len(payload)
+	switch {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout.D()))
+	defer c.conn.SetWriteDeadline(time.Time{})
+
+	bufs := net.Buffers{hdr, payload}
+	_, err = bufs.WriteTo(c.conn)
+	return
+}
+
+// writeClose -- sends the close frame once
+func (c *WebSocketConn) writeClose(code int, reason string) (err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	if len(reason) > wsMaxControlPayload-2 {
+		reason = reason[:wsMaxControlPayload-2]
+	}
+
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+
+	return c.writeFrameLocked(wsClose, payload, false)
+}
+
+func (c *WebSocketConn) pinger() {
+	ticker := time.NewTicker(c.cfg.PingInterval.D())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.writeFrame(wsPing, nil, false) != nil {
+				return
+			}
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Close -- starts the close handshake. The connection is closed when the reply is read by ReadMessage or after a short delay
+func (c *WebSocketConn) Close(code int, reason string) (err error) {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+
+	err = c.writeClose(code, reason)
+	if err != nil {
+		c.closeConn()
+		return
+	}
+
+	time.AfterFunc(wsCloseGrace, c.closeConn)
+	return
+}
+
+// fail -- RFC 6455 7.1.7, the connection is closed without waiting for the reply
+func (c *WebSocketConn) fail(code int) {
+	c.writeClose(code, "")
+	c.closeConn()
+}
+
+func (c *WebSocketConn) closeConn() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		close(c.done)
+		c.h.getWebSockets().detach(c)
+		Log.Message(log.DEBUG, `[%d] WebSocket closed`, c.id)
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *HTTP) getWebSockets() *webSockets {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.webSockets == nil {
+		h.webSockets = &webSockets{
+			conns: make(map[*WebSocketConn]bool),
+			laIn:  loadavg.Init(h.commonConfig.LoadAvgPeriod.D()),
+			laOut: loadavg.Init(h.commonConfig.LoadAvgPeriod.D()),
+		}
+	}
+
+	return h.webSockets
+}
+
+func (ws *webSockets) attach(c *WebSocketConn) {
+	ws.mutex.Lock()
+	ws.conns[c] = true
+	ws.mutex.Unlock()
+
+	atomic.AddInt64(&ws.stat.Active, 1)
+	atomic.AddUint64(&ws.stat.Total, 1)
+}
+
+func (ws *webSockets) detach(c *WebSocketConn) {
+	ws.mutex.Lock()
+	delete(ws.conns, c)
+	ws.mutex.Unlock()
+
+	atomic.AddInt64(&ws.stat.Active, -1)
+}
+
+func (ws *webSockets) received(size int) {
+	atomic.AddUint64(&ws.stat.MessagesIn, 1)
+	atomic.AddUint64(&ws.stat.BytesIn, uint64(size))
+	ws.laIn.Add(1)
+}
+
+func (ws *webSockets) sent(size int) {
+	atomic.AddUint64(&ws.stat.MessagesOut, 1)
+	atomic.AddUint64(&ws.stat.BytesOut, uint64(size))
+	ws.laOut.Add(1)
+}
+
+// WebSocketStat -- nil if WebSockets were never used
+func (h *HTTP) WebSocketStat() *WebSocketStat {
+	h.Lock()
+	ws := h.webSockets
+	h.Unlock()
+
+	if ws == nil {
+		return nil
+	}
+
+	return &WebSocketStat{
+		Active:      atomic.LoadInt64(&ws.stat.Active),
+		Total:       atomic.LoadUint64(&ws.stat.Total),
+		MessagesIn:  atomic.LoadUint64(&ws.stat.MessagesIn),
+		MessagesOut: atomic.LoadUint64(&ws.stat.MessagesOut),
+		BytesIn:     atomic.LoadUint64(&ws.stat.BytesIn),
+		BytesOut:    atomic.LoadUint64(&ws.stat.BytesOut),
+		InRate:      ws.laIn.Value(),
+		OutRate:     ws.laOut.Value(),
+	}
+}
+
+// closeWebSockets -- "going away" for all connections
+func (h *HTTP) closeWebSockets() {
+	h.Lock()
+	ws := h.webSockets
+	h.Unlock()
+
+	if ws == nil {
+		return
+	}
+
+	ws.mutex.Lock()
+	conns := make([]*WebSocketConn, 0, len(ws.conns))
+	for c := range ws.conns {
+		conns = append(conns, c)
+	}
+	ws.mutex.Unlock()
+
+	for _, c := range conns {
+		c.writeClose(WebSocketCloseGoingAway, "server is stopping")
+		c.closeConn()
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//